@@ -0,0 +1,150 @@
+// Package certs generates a throwaway CA and a certificate signed by it,
+// so that the proxy and the backends can be tested over TLS without any
+// certificates checked in.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Bundle is a CA and a certificate for hosts, written as PEM files.
+type Bundle struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+
+	CA   *x509.CertPool
+	Cert tls.Certificate
+}
+
+// Generate creates a CA and a certificate valid for hosts, IPs or DNS
+// names, and writes ca.crt, server.crt and server.key into dir. The
+// certificate is usable by both servers and clients and expires in a day.
+func Generate(dir string, hosts ...string) (*Bundle, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("certs: at least one host is required")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{CommonName: "ngproxy-test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial(),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Bundle{
+		CAFile:   filepath.Join(dir, "ca.crt"),
+		CertFile: filepath.Join(dir, "server.crt"),
+		KeyFile:  filepath.Join(dir, "server.key"),
+		CA:       x509.NewCertPool(),
+	}
+	b.CA.AddCert(ca)
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for path, data := range map[string][]byte{b.CAFile: caPEM, b.CertFile: certPEM, b.KeyFile: keyPEM} {
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	b.Cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ClientConfig trusts the bundle's CA and expects serverName in the
+// server's certificate.
+func (b *Bundle) ClientConfig(serverName string) *tls.Config {
+	return &tls.Config{RootCAs: b.CA, ServerName: serverName}
+}
+
+// ServerConfig serves the bundle's certificate.
+func (b *Bundle) ServerConfig() *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{b.Cert}}
+}
+
+// LoadCA reads a PEM file of CA certificates.
+func LoadCA(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("certs: no certificate in " + path)
+	}
+	return pool, nil
+}
+
+func serial() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 120))
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
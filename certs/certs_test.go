@@ -0,0 +1,72 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func handshake(t *testing.T, server *tls.Config, client *tls.Config) error {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), client)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestGenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := Generate(dir, "127.0.0.1", "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCA(b.CAFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.LoadX509KeyPair(b.CertFile, b.KeyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handshake(t, b.ServerConfig(), b.ClientConfig("127.0.0.1")); err != nil {
+		t.Fatalf("handshake with the bundle's CA: %s", err)
+	}
+
+	err = handshake(t, b.ServerConfig(), b.ClientConfig("wrong.example.com"))
+	var hostErr x509.HostnameError
+	if !errors.As(err, &hostErr) {
+		t.Fatalf("got %v, want a hostname error", err)
+	}
+
+	other, err := Generate(dir+"/other", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handshake(t, b.ServerConfig(), other.ClientConfig("127.0.0.1"))
+	var authErr x509.UnknownAuthorityError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("got %v, want an unknown authority error", err)
+	}
+}
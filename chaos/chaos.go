@@ -0,0 +1,257 @@
+// Package chaos runs fault scenarios described in YAML against a
+// supervised topology: a workload runs for the whole scenario while steps
+// kill, pause or slow down nodes at given times, and the workload is
+// measured separately between every two steps.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-redis/redis"
+	"gopkg.in/yaml.v2"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+	"github.com/lidaohang/test-redis-ngproxy/supervisor"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+// Actions of a step.
+const (
+	// Kill, Stop, Restart, Pause and Resume act on Step.Node.
+	Kill    = "kill"
+	Stop    = "stop"
+	Restart = "restart"
+	Pause   = "pause"
+	Resume  = "resume"
+	// DebugSleep sends DEBUG SLEEP Step.For to Step.Node.
+	DebugSleep = "debug-sleep"
+	// Latency, Stall and Unstall act on the relay of Step.Shard.
+	Latency = "latency"
+	Stall   = "stall"
+	Unstall = "unstall"
+)
+
+// Step is one fault injected At after the start of the scenario.
+type Step struct {
+	At     time.Duration `yaml:"at"`
+	Action string        `yaml:"action"`
+	// Node is a supervisor node name, e.g. "shard0-master".
+	Node string `yaml:"node"`
+	// Shard names the relay of the latency, stall and unstall actions.
+	Shard string `yaml:"shard"`
+	// Latency is added by the latency action, zero removes it.
+	Latency time.Duration `yaml:"latency"`
+	// For is how long debug-sleep blocks the node.
+	For time.Duration `yaml:"for"`
+}
+
+// Scenario is a workload and the steps injected while it runs.
+type Scenario struct {
+	Name string `yaml:"name"`
+	// Profile is a workload.Profiles name, set by default.
+	Profile  string        `yaml:"profile"`
+	Clients  int           `yaml:"clients"`
+	Payload  int           `yaml:"payload"`
+	Keys     int           `yaml:"keys"`
+	Duration time.Duration `yaml:"duration"`
+	Steps    []Step        `yaml:"steps"`
+}
+
+// Load reads and validates the scenario in the YAML file at path.
+func Load(path string) (*Scenario, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sc Scenario
+	if err := yaml.Unmarshal(b, &sc); err != nil {
+		return nil, fmt.Errorf("chaos: %s: %s", path, err)
+	}
+	if err := sc.init(); err != nil {
+		return nil, fmt.Errorf("chaos: %s: %s", path, err)
+	}
+	return &sc, nil
+}
+
+func (sc *Scenario) init() error {
+	if sc.Name == "" {
+		return errors.New("name is required")
+	}
+	if sc.Profile == "" {
+		sc.Profile = "set"
+	}
+	if _, ok := workload.Profiles[sc.Profile]; !ok {
+		return fmt.Errorf("unknown profile %q", sc.Profile)
+	}
+	if sc.Duration <= 0 {
+		return errors.New("duration is required")
+	}
+
+	var last time.Duration
+	for i, step := range sc.Steps {
+		if step.At < last || step.At > sc.Duration {
+			return fmt.Errorf("step %d: at %s is out of order or after the duration", i, step.At)
+		}
+		last = step.At
+
+		switch step.Action {
+		case Kill, Stop, Restart, Pause, Resume:
+			if step.Node == "" {
+				return fmt.Errorf("step %d: %s requires a node", i, step.Action)
+			}
+		case DebugSleep:
+			if step.Node == "" || step.For <= 0 {
+				return fmt.Errorf("step %d: %s requires a node and for", i, step.Action)
+			}
+		case Latency, Stall, Unstall:
+			if step.Shard == "" {
+				return fmt.Errorf("step %d: %s requires a shard", i, step.Action)
+			}
+		default:
+			return fmt.Errorf("step %d: unknown action %q", i, step.Action)
+		}
+	}
+	return nil
+}
+
+// String describes the step, e.g. "pause shard0-master".
+func (s Step) String() string {
+	switch s.Action {
+	case Latency:
+		return fmt.Sprintf("%s %s %s", s.Action, s.Shard, s.Latency)
+	case Stall, Unstall:
+		return s.Action + " " + s.Shard
+	case DebugSleep:
+		return fmt.Sprintf("%s %s %s", s.Action, s.Node, s.For)
+	}
+	return s.Action + " " + s.Node
+}
+
+// Phase is the workload between two steps.
+type Phase struct {
+	// Name is the step that started the phase, "baseline" for the first.
+	Name  string        `json:"name"`
+	Start time.Duration `json:"start_ns"`
+	Error string        `json:"error,omitempty"`
+
+	workload.Result
+}
+
+// Report is the outcome of a scenario.
+type Report struct {
+	Scenario string    `json:"scenario"`
+	Started  time.Time `json:"started"`
+	Phases   []Phase   `json:"phases"`
+	// Timeline is the workload per second over the whole scenario.
+	Timeline []workload.Point `json:"timeline"`
+	// Samples are the proxy's INFO and the client's pool stats per second.
+	Samples []stats.Sample `json:"-"`
+}
+
+// Failed reports whether any step could not be applied.
+func (r *Report) Failed() bool {
+	for _, phase := range r.Phases {
+		if phase.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Run drives the scenario's workload through client while applying the
+// steps to the nodes of s. A step that fails is reported in its phase and
+// the scenario goes on.
+func Run(sc *Scenario, s *supervisor.Supervisor, client *redis.Client) *Report {
+	w := Workload{
+		Client:  client,
+		Profile: workload.Profiles[sc.Profile],
+		Options: workload.Options{
+			Clients:   sc.Clients,
+			Payload:   sc.Payload,
+			Keys:      sc.Keys,
+			KeyPrefix: "chaos:" + sc.Name + ":",
+			Duration:  sc.Duration,
+		},
+	}
+
+	report := &Report{Scenario: sc.Name}
+	if err := workload.Prepare(client, w.Options); err != nil {
+		report.Phases = append(report.Phases, Phase{Name: "prepare", Error: err.Error()})
+		return report
+	}
+
+	r := start([]Workload{w}, "baseline")
+	errs := make(map[int]error)
+	for _, step := range sc.Steps {
+		time.Sleep(step.At - r.elapsed())
+		phase := r.next(step.String())
+		if err := apply(s, step); err != nil {
+			errs[phase] = err
+		}
+	}
+	time.Sleep(sc.Duration - r.elapsed())
+	r.wait()
+
+	for i, result := range r.results(0) {
+		phase := Phase{Name: r.names[i], Start: r.starts[i], Result: result}
+		if err := errs[i]; err != nil {
+			phase.Error = err.Error()
+		}
+		report.Phases = append(report.Phases, phase)
+	}
+	report.Started = r.start
+	report.Timeline = r.timelines[0].Points()
+	report.Samples = r.collector.Samples("proxy")
+	return report
+}
+
+// apply injects one step.
+func apply(s *supervisor.Supervisor, step Step) error {
+	switch step.Action {
+	case Latency, Stall, Unstall:
+		r := s.Relay(step.Shard)
+		if r == nil {
+			return fmt.Errorf("shard %q has no relay", step.Shard)
+		}
+		switch step.Action {
+		case Latency:
+			r.SetLatency(step.Latency)
+		case Stall:
+			r.Stall()
+		case Unstall:
+			r.Unstall()
+		}
+		return nil
+	}
+
+	node := s.Node(step.Node)
+	if node == nil {
+		return fmt.Errorf("no node %q", step.Node)
+	}
+	switch step.Action {
+	case Kill:
+		return node.Kill()
+	case Stop:
+		return node.Stop()
+	case Restart:
+		return node.Restart()
+	case Pause:
+		return node.Pause()
+	case Resume:
+		return node.Resume()
+	case DebugSleep:
+		client := node.Client()
+		// The reply only comes once the node wakes up.
+		go func() {
+			defer client.Close()
+			cmd := redis.NewCmd("DEBUG", "SLEEP", step.For.Seconds())
+			client.Process(cmd)
+		}()
+		return nil
+	}
+	return fmt.Errorf("unknown action %q", step.Action)
+}
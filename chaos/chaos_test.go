@@ -0,0 +1,97 @@
+package chaos
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+func TestLoadExample(t *testing.T) {
+	sc, err := Load("../config/scenario.master_pause.example.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Name != "master_pause" || sc.Profile != "set" || sc.Duration != 3*time.Minute {
+		t.Fatalf("got %+v", sc)
+	}
+	if len(sc.Steps) != 4 || sc.Steps[0].At != time.Minute || sc.Steps[2].Latency != 200*time.Millisecond {
+		t.Fatalf("got steps %+v", sc.Steps)
+	}
+	if got := sc.Steps[0].String(); got != "pause shard0-master" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestScenarioInit(t *testing.T) {
+	for _, c := range []struct {
+		sc   Scenario
+		want string
+	}{
+		{Scenario{Duration: time.Minute}, "name is required"},
+		{Scenario{Name: "x", Duration: time.Minute, Profile: "nope"}, "unknown profile"},
+		{Scenario{Name: "x"}, "duration is required"},
+		{Scenario{Name: "x", Duration: time.Minute, Steps: []Step{
+			{At: 2 * time.Second, Action: Pause, Node: "n"},
+			{At: time.Second, Action: Resume, Node: "n"},
+		}}, "out of order"},
+		{Scenario{Name: "x", Duration: time.Minute, Steps: []Step{{Action: Pause}}}, "requires a node"},
+		{Scenario{Name: "x", Duration: time.Minute, Steps: []Step{{Action: Stall}}}, "requires a shard"},
+		{Scenario{Name: "x", Duration: time.Minute, Steps: []Step{{Action: "explode"}}}, "unknown action"},
+	} {
+		err := c.sc.init()
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%+v: got %v, want %q", c.sc, err, c.want)
+		}
+	}
+}
+
+func TestRunFaultUnrecovered(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	// Every operation fails to connect, so the faulty shard never recovers.
+	client := workload.NewClient(addr, "", nil, 2)
+	defer client.Close()
+
+	var injected, healed int
+	boom := errors.New("boom")
+	report := RunFault(Fault{
+		Name:    "refused",
+		Inject:  func() error { injected++; return boom },
+		Heal:    func() error { healed++; return nil },
+		After:   50 * time.Millisecond,
+		For:     50 * time.Millisecond,
+		Recover: 50 * time.Millisecond,
+		Settle:  time.Hour,
+	}, Workload{
+		Client:  client,
+		Profile: workload.Profiles["set"],
+		Options: workload.Options{Clients: 2, Key: "k", Duration: time.Hour},
+	}, Workload{})
+
+	if injected != 1 || healed != 1 || report.InjectErr != boom || report.HealErr != nil {
+		t.Fatalf("got inject %d %v, heal %d %v", injected, report.InjectErr, healed, report.HealErr)
+	}
+	if report.RecoveredOK || report.Reconnects != -1 {
+		t.Fatalf("got %+v", report)
+	}
+	for phase := PhaseBefore; phase <= PhaseAfter; phase++ {
+		if r := report.Faulty[phase]; r.Ops == 0 || r.Errors != r.Ops {
+			t.Errorf("%s: got %+v, want only errors", PhaseNames[phase], r)
+		}
+	}
+	if report.Faulty[PhaseSettled].Ops != 0 || report.Healthy[PhaseBefore].Ops != 0 {
+		t.Errorf("got settled %+v, healthy %+v", report.Faulty[PhaseSettled], report.Healthy[PhaseBefore])
+	}
+	if report.LastError <= 0 || report.LastError > time.Second {
+		t.Errorf("got last error %s after the heal", report.LastError)
+	}
+}
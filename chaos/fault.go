@@ -0,0 +1,121 @@
+package chaos
+
+import (
+	"time"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+// Phases of a fault run.
+const (
+	PhaseBefore = iota
+	PhaseDuring
+	PhaseAfter
+	PhaseSettled
+)
+
+// PhaseNames are the names of the phases of a fault run.
+var PhaseNames = [...]string{"before", "during", "after", "settled"}
+
+// Fault is a fault of one shard: Inject is called After the start of the
+// run and Heal For later, then the run goes on until the faulty shard
+// serves again or Recover passes, and for Settle after the recovery.
+type Fault struct {
+	Name    string
+	Inject  func() error
+	Heal    func() error
+	After   time.Duration
+	For     time.Duration
+	Recover time.Duration
+	Settle  time.Duration
+}
+
+// FaultReport is the outcome of the workloads on the faulty and the
+// healthy shard before, during and after a fault, and once the faulty
+// shard has recovered.
+type FaultReport struct {
+	Name    string
+	Started time.Time
+
+	// Faulty and Healthy are the workloads per phase.
+	Faulty  [len(PhaseNames)]workload.Result
+	Healthy [len(PhaseNames)]workload.Result
+
+	// Recovered is how long after the heal the faulty shard first served
+	// again, if RecoveredOK.
+	Recovered   time.Duration
+	RecoveredOK bool
+	// LastError is the last error on the faulty shard after the heal,
+	// relative to the heal, zero if none.
+	LastError time.Duration
+	// Reconnects is the change of the proxy's backend_reconnections from
+	// the fault to the end of the run, -1 if it was not scraped or the
+	// proxy's INFO has no such field.
+	Reconnects int64
+
+	FaultyTimeline, HealthyTimeline []workload.Point
+
+	// InjectErr and HealErr are the errors of Inject and Heal.
+	InjectErr, HealErr error
+
+	// Collector holds the samples of the proxy, with the fault marked as
+	// Name and the heal as Name+" healed".
+	Collector *stats.Collector
+}
+
+// RunFault drives faulty on a key of the faulty shard and healthy, unless
+// its Client is nil, on a key of another shard while f is injected. The
+// workloads run until the end of the run, whatever their Duration.
+func RunFault(f Fault, faulty, healthy Workload) *FaultReport {
+	faulty.Options.Duration = 0
+	healthy.Options.Duration = 0
+	ws := []Workload{faulty}
+	if healthy.Client != nil {
+		ws = append(ws, healthy)
+	}
+
+	r := start(ws, PhaseNames[PhaseBefore])
+	report := &FaultReport{Name: f.Name, Started: r.start, Reconnects: -1, Collector: r.collector}
+
+	time.Sleep(f.After)
+	r.collector.Mark(f.Name)
+	r.next(PhaseNames[PhaseDuring])
+	report.InjectErr = f.Inject()
+
+	time.Sleep(f.For)
+	report.HealErr = f.Heal()
+	r.collector.Mark(f.Name + " healed")
+	r.next(PhaseNames[PhaseAfter])
+	healedAt := time.Now()
+
+	deadline := healedAt.Add(f.Recover)
+	for r.firstSuccess(PhaseAfter, 0).IsZero() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if ok := r.firstSuccess(PhaseAfter, 0); !ok.IsZero() {
+		report.Recovered = ok.Sub(healedAt)
+		report.RecoveredOK = true
+		r.next(PhaseNames[PhaseSettled])
+		time.Sleep(f.Settle)
+	}
+
+	end := r.wait()
+	if before := r.collector.Before("proxy", f.Name); before != nil && end.Info != nil &&
+		before.Stats.BackendReconnections >= 0 && end.Info.Stats.BackendReconnections >= 0 {
+		report.Reconnects = end.Info.Stats.BackendReconnections - before.Stats.BackendReconnections
+	}
+
+	for phase := PhaseAfter; phase < len(r.names); phase++ {
+		if t := r.lastFailure(phase, 0); !t.IsZero() {
+			report.LastError = t.Sub(healedAt)
+		}
+	}
+	copy(report.Faulty[:], r.results(0))
+	report.FaultyTimeline = r.timelines[0].Points()
+	if len(ws) > 1 {
+		copy(report.Healthy[:], r.results(1))
+		report.HealthyTimeline = r.timelines[1].Points()
+	}
+	return report
+}
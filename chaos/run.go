@@ -0,0 +1,146 @@
+package chaos
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+// Workload is a profile driven through its own client during a run.
+type Workload struct {
+	Client  *redis.Client
+	Profile workload.Profile
+	Options workload.Options
+}
+
+// run drives workloads while faults are injected, and records every
+// operation into the phase it completes in and into a timeline per
+// workload. The proxy's INFO is scraped every second as "proxy" through a
+// client of its own, with the pool stats of the first workload's client.
+type run struct {
+	start     time.Time
+	collector *stats.Collector
+	admin     *redis.Client
+	timelines []*workload.Timeline
+	stop      chan struct{}
+	done      sync.WaitGroup
+
+	mu    sync.Mutex
+	phase int
+	// Per phase, and per phase and workload.
+	names   []string
+	starts  []time.Duration
+	recs    [][]*workload.Recorder
+	firstOK [][]time.Time
+	lastErr [][]time.Time
+}
+
+// start starts ws in a first phase called name. A workload runs until
+// wait, or for its Options.Duration if that ends first.
+func start(ws []Workload, name string) *run {
+	r := &run{
+		start:     time.Now(),
+		collector: stats.NewCollector(time.Second),
+		stop:      make(chan struct{}),
+	}
+	for range ws {
+		r.timelines = append(r.timelines, workload.NewTimeline(r.start, time.Second))
+	}
+	r.next(name)
+
+	opt := *ws[0].Client.Options()
+	opt.PoolSize = 1
+	r.admin = redis.NewClient(&opt)
+	r.collector.AddPool("proxy", r.admin, ws[0].Client)
+	r.collector.Start()
+	for i, w := range ws {
+		w.Options.Timeline = r.timelines[i]
+		r.done.Add(1)
+		go func(i int, w Workload) {
+			defer r.done.Done()
+			workload.Drive(w.Client, w.Profile, w.Options, r.stop, func(latency time.Duration, err error) {
+				r.add(i, latency, err)
+			})
+		}(i, w)
+	}
+	return r
+}
+
+func (r *run) elapsed() time.Duration {
+	return time.Since(r.start)
+}
+
+// next starts a phase called name and returns its index.
+func (r *run) next(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	recs := make([]*workload.Recorder, len(r.timelines))
+	for i := range recs {
+		recs[i] = workload.NewRecorder()
+	}
+	r.names = append(r.names, name)
+	r.starts = append(r.starts, r.elapsed())
+	r.recs = append(r.recs, recs)
+	r.firstOK = append(r.firstOK, make([]time.Time, len(recs)))
+	r.lastErr = append(r.lastErr, make([]time.Time, len(recs)))
+	r.phase = len(r.names) - 1
+	return r.phase
+}
+
+// add records an operation of workload w.
+func (r *run) add(w int, latency time.Duration, err error) {
+	now := time.Now()
+	r.mu.Lock()
+	rec := r.recs[r.phase][w]
+	if err != nil {
+		r.lastErr[r.phase][w] = now
+	} else if r.firstOK[r.phase][w].IsZero() {
+		r.firstOK[r.phase][w] = now
+	}
+	r.mu.Unlock()
+	rec.Add(latency, err)
+}
+
+// firstSuccess returns when workload w first succeeded in phase, the zero
+// time if it did not yet.
+func (r *run) firstSuccess(phase, w int) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.firstOK[phase][w]
+}
+
+// lastFailure returns when workload w last failed in phase, the zero time
+// if it did not.
+func (r *run) lastFailure(phase, w int) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastErr[phase][w]
+}
+
+// wait stops the workloads that run until then, waits for the others and
+// stops the collector. It returns the last scrape of the proxy.
+func (r *run) wait() stats.Sample {
+	close(r.stop)
+	r.done.Wait()
+	end := r.collector.ScrapeOne("proxy")
+	r.collector.Stop()
+	r.admin.Close()
+	return end
+}
+
+// results returns the measurements of workload w per phase.
+func (r *run) results(w int) []workload.Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	results := make([]workload.Result, len(r.recs))
+	for i, recs := range r.recs {
+		results[i] = recs[w].Result()
+	}
+	return results
+}
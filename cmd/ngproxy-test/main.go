@@ -0,0 +1,518 @@
+// Command ngproxy-test runs the ngproxy tests without go test, for
+// operators checking a deployment. Every command writes its results as
+// JSON, the input of compare.
+//
+//	ngproxy-test verify  [flags]               functional checks
+//	ngproxy-test bench   [flags]               workload profiles
+//	ngproxy-test chaos   [flags] scenario.yml  fault scenarios, needs -topology
+//	ngproxy-test replay  [flags] report.xml    tcpflow captures
+//	ngproxy-test matrix  [flags]               command support matrix
+//	ngproxy-test compare [flags] old.json new.json
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lidaohang/test-redis-ngproxy/chaos"
+	"github.com/lidaohang/test-redis-ngproxy/compare"
+	"github.com/lidaohang/test-redis-ngproxy/matrix"
+	"github.com/lidaohang/test-redis-ngproxy/replay"
+	"github.com/lidaohang/test-redis-ngproxy/report"
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+	"github.com/lidaohang/test-redis-ngproxy/target"
+	"github.com/lidaohang/test-redis-ngproxy/verify"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+// output is the JSON written by every command.
+type output struct {
+	Kind    string      `json:"kind"`
+	Proxy   string      `json:"proxy,omitempty"`
+	Started time.Time   `json:"started"`
+	Results interface{} `json:"results"`
+}
+
+// errFailed makes the command exit 1 after writing its results, e.g. when
+// a check failed.
+var errFailed = errors.New("failed")
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands map[string]command
+
+// The commands refer to the map for their usage, it cannot be initialized
+// statically.
+func init() {
+	commands = map[string]command{
+		"verify":  {"[flags]", runVerify},
+		"bench":   {"[flags]", runBench},
+		"chaos":   {"[flags] scenario.yml...", runChaos},
+		"replay":  {"[flags] report.xml", runReplay},
+		"matrix":  {"[flags]", runMatrix},
+		"compare": {"[flags] old.json new.json", runCompare},
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ngproxy-test <command> [flags] [args]\n\ncommands:")
+	for _, name := range []string{"verify", "bench", "chaos", "replay", "matrix", "compare"} {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nrun ngproxy-test <command> -h for the flags of a command")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(os.Args[2:])
+	switch {
+	case err == errFailed:
+		os.Exit(1)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "ngproxy-test %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// newFlagSet returns the flags of a command with -out, and with the target
+// flags unless t is nil.
+func newFlagSet(name string, t *target.Target, out *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: ngproxy-test %s %s\n", name, commands[name].usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(out, "out", "", "file the JSON results are written to, stdout if empty")
+	if t != nil {
+		registerTarget(fs, t)
+	}
+	return fs
+}
+
+// withTarget starts t for the duration of fn and stops it on interrupt.
+func withTarget(t *target.Target, fn func() error) error {
+	if err := t.Start(); err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		t.Stop()
+		os.Exit(1)
+	}()
+
+	err := fn()
+	if serr := t.Stop(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// write writes results of kind as JSON to path, stdout if empty.
+func write(path, kind, proxy string, started time.Time, results interface{}) error {
+	var w io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(output{Kind: kind, Proxy: proxy, Started: started, Results: results})
+}
+
+func runVerify(args []string) error {
+	var t target.Target
+	var out string
+	fs := newFlagSet("verify", &t, &out)
+	focus := fs.String("focus", "", "regexp of the \"group name\" of the checks to run")
+	fs.Parse(args)
+
+	var re *regexp.Regexp
+	if *focus != "" {
+		var err error
+		if re, err = regexp.Compile(*focus); err != nil {
+			return err
+		}
+	}
+
+	return withTarget(&t, func() error {
+		client := t.Client(t.Proxy, 1)
+		defer client.Close()
+
+		started := time.Now()
+		results := verify.Run(client, fmt.Sprintf("ngproxy-test.%d:", os.Getpid()), re)
+		for _, r := range results {
+			status := "ok  "
+			if !r.Passed {
+				status = "FAIL"
+			}
+			fmt.Fprintf(os.Stderr, "%s %s %s %s\n", status, r.Group, r.Name, r.Error)
+		}
+
+		if err := write(out, "verify", t.Proxy, started, results); err != nil {
+			return err
+		}
+		if verify.Failed(results) > 0 {
+			return errFailed
+		}
+		return nil
+	})
+}
+
+func runBench(args []string) error {
+	var t target.Target
+	var out string
+	fs := newFlagSet("bench", &t, &out)
+	profiles := fs.String("profiles", "ping,get,set,setget,mget,pipeline",
+		"comma separated profiles, of "+strings.Join(workload.Names(), ","))
+	var opts workload.Options
+	fs.IntVar(&opts.Clients, "clients", 10, "concurrent clients")
+	fs.IntVar(&opts.Payload, "payload", 32, "value size in bytes")
+	fs.IntVar(&opts.Keys, "keys", 100, "distinct keys")
+	fs.DurationVar(&opts.Duration, "duration", time.Minute, "duration of every profile")
+	reportDir := fs.String("report.dir", "", "directory an HTML report is written to")
+	fs.Parse(args)
+	if opts.Duration <= 0 {
+		return errors.New("-duration must be positive")
+	}
+	opts.KeyPrefix = "bench:"
+
+	var selected []workload.Profile
+	for _, name := range strings.Split(*profiles, ",") {
+		p, ok := workload.Profiles[name]
+		if !ok {
+			return fmt.Errorf("unknown profile %q", name)
+		}
+		selected = append(selected, p)
+	}
+
+	return withTarget(&t, func() error {
+		client := t.Client(t.Proxy, opts.Clients)
+		defer client.Close()
+
+		started := time.Now()
+		if err := workload.Prepare(client, opts); err != nil {
+			return err
+		}
+
+		collector := stats.NewCollector(time.Second)
+		collector.Add("proxy", client)
+		collector.Start()
+
+		var results []workload.Result
+		var series []report.Series
+		for _, p := range selected {
+			collector.Mark(p.Name)
+			opts.Timeline = workload.NewTimeline(started, time.Second)
+			r := workload.Run(client, p, opts)
+			fmt.Fprintf(os.Stderr, "%-10s %10.0f ops/s  p50=%s p99=%s max=%s errors=%d\n",
+				p.Name, r.OpsPerSec, r.P50, r.P99, r.Max, r.Errors)
+			results = append(results, r)
+			series = append(series, report.Series{Name: p.Name, Points: opts.Timeline.Points()})
+		}
+		collector.Stop()
+
+		if *reportDir != "" {
+			summary := &report.Table{Columns: []string{"profile", "ops/s", "p50", "p99", "max", "errors"}}
+			for _, r := range results {
+				summary.Rows = append(summary.Rows, []string{
+					r.Profile, fmt.Sprintf("%.0f", r.OpsPerSec),
+					r.P50.String(), r.P99.String(), r.Max.String(), fmt.Sprint(r.Errors),
+				})
+			}
+			path, err := report.WriteFile(*reportDir, "bench", &report.Run{
+				Title:   "Bench " + t.Proxy,
+				Started: started,
+				Summary: summary,
+				Series:  series,
+				Events:  collector.Events(),
+				Pool:    collector.Samples("proxy"),
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "report written to", path)
+		}
+		return write(out, "bench", t.Proxy, started, results)
+	})
+}
+
+func runChaos(args []string) error {
+	var t target.Target
+	var out string
+	fs := newFlagSet("chaos", &t, &out)
+	reportDir := fs.String("report.dir", "", "directory an HTML report per scenario is written to")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var scenarios []*chaos.Scenario
+	for _, path := range fs.Args() {
+		sc, err := chaos.Load(path)
+		if err != nil {
+			return err
+		}
+		scenarios = append(scenarios, sc)
+	}
+
+	return withTarget(&t, func() error {
+		if err := t.RequireCluster(); err != nil {
+			return err
+		}
+
+		started := time.Now()
+		var reports []*chaos.Report
+		failed := false
+		for _, sc := range scenarios {
+			clients := sc.Clients
+			if clients <= 0 {
+				clients = 10
+			}
+			client := t.Client(t.Proxy, clients)
+			report := chaos.Run(sc, t.Cluster, client)
+			client.Close()
+
+			for _, phase := range report.Phases {
+				fmt.Fprintf(os.Stderr, "%s %-30s ops=%d errors=%d p99=%s %s\n",
+					sc.Name, phase.Name, phase.Ops, phase.Errors, phase.P99, phase.Error)
+			}
+			failed = failed || report.Failed()
+			reports = append(reports, report)
+
+			if *reportDir != "" {
+				path, err := writeChaosHTML(*reportDir, report)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(os.Stderr, "report written to", path)
+			}
+		}
+
+		if err := write(out, "chaos", t.Proxy, started, reports); err != nil {
+			return err
+		}
+		if failed {
+			return errFailed
+		}
+		return nil
+	})
+}
+
+// writeChaosHTML writes r to dir with a fault marker at the start of every
+// phase but the baseline.
+func writeChaosHTML(dir string, r *chaos.Report) (string, error) {
+	summary := &report.Table{Columns: []string{"phase", "start", "ops", "errors", "p50", "p99", "max", "error"}}
+	var events []stats.Event
+	for i, phase := range r.Phases {
+		summary.Rows = append(summary.Rows, []string{
+			phase.Name, phase.Start.String(), fmt.Sprint(phase.Ops), fmt.Sprint(phase.Errors),
+			phase.P50.String(), phase.P99.String(), phase.Max.String(), phase.Error,
+		})
+		if i > 0 {
+			events = append(events, stats.Event{Time: r.Started.Add(phase.Start), Name: phase.Name})
+		}
+	}
+
+	return report.WriteFile(dir, r.Scenario, &report.Run{
+		Title:   "Chaos: " + r.Scenario,
+		Started: r.Started,
+		Summary: summary,
+		Series:  []report.Series{{Name: r.Scenario, Points: r.Timeline}},
+		Events:  events,
+		Pool:    r.Samples,
+	})
+}
+
+func runReplay(args []string) error {
+	var t target.Target
+	var out string
+	fs := newFlagSet("replay", &t, &out)
+	port := fs.Int("port", 8015, "proxy port of the capture, flows towards it are replayed")
+	concurrency := fs.Int("concurrency", 10, "flows replayed at once")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	flows, err := replay.LoadReport(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	flows = replay.ClientFlows(flows, *port)
+	if len(flows) == 0 {
+		return fmt.Errorf("%s: no flows towards port %d", fs.Arg(0), *port)
+	}
+
+	return withTarget(&t, func() error {
+		client := t.Client(t.Proxy, *concurrency)
+		defer client.Close()
+
+		started := time.Now()
+		p := &replay.Replayer{Client: client, Concurrency: *concurrency}
+		res, err := p.Run(flows)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "replayed %d commands of %d flows in %s, %d skipped, %d errors\n",
+			res.Commands, res.Flows, res.Elapsed, res.Skipped, res.Errors)
+		return write(out, "replay", t.Proxy, started, res)
+	})
+}
+
+func runMatrix(args []string) error {
+	var t target.Target
+	var out string
+	fs := newFlagSet("matrix", &t, &out)
+	reference := fs.String("reference", "", "backend whose COMMAND table and replies are the reference, -master if empty")
+	timeout := fs.Duration("timeout", 2*time.Second, "how long a command may take through the proxy before it counts as a hang")
+	markdown := fs.String("markdown", "", "also write the matrix as a markdown table to this file")
+	fs.Parse(args)
+
+	return withTarget(&t, func() error {
+		ref := *reference
+		if ref == "" {
+			ref = t.Master
+		}
+		p := &matrix.Prober{
+			Proxy:     matrix.NewClient(t.Proxy, t.PasswordFor(t.Proxy), t.Dialer(t.Proxy), *timeout),
+			Reference: matrix.NewClient(ref, t.PasswordFor(ref), t.Dialer(ref), *timeout),
+		}
+		defer p.Proxy.Close()
+		defer p.Reference.Close()
+
+		started := time.Now()
+		results, err := p.Run()
+		if err != nil {
+			return err
+		}
+		if *markdown != "" {
+			f, err := os.Create(*markdown)
+			if err != nil {
+				return err
+			}
+			err = matrix.WriteMarkdown(f, results)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := write(out, "matrix", t.Proxy, started, results); err != nil {
+			return err
+		}
+		for _, r := range results {
+			if r.Status == matrix.Hang {
+				fmt.Fprintf(os.Stderr, "%s %q hangs through the proxy\n", r.Command, r.Args)
+				err = errFailed
+			}
+		}
+		return err
+	})
+}
+
+func runCompare(args []string) error {
+	var out string
+	fs := newFlagSet("compare", nil, &out)
+	tolerance := fs.Float64("tolerance", 0.1, "relative bench change tolerated, 0.1 for 10%")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	type raw struct {
+		Kind    string          `json:"kind"`
+		Results json.RawMessage `json:"results"`
+	}
+	var files [2]raw
+	for i, path := range fs.Args() {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &files[i]); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	old, cur := files[0], files[1]
+	if old.Kind != cur.Kind {
+		return fmt.Errorf("cannot compare %s results with %s results", old.Kind, cur.Kind)
+	}
+
+	// decode fills the results of both files.
+	decode := func(o, c interface{}) error {
+		if err := json.Unmarshal(old.Results, o); err != nil {
+			return err
+		}
+		return json.Unmarshal(cur.Results, c)
+	}
+
+	var changes []compare.Change
+	switch old.Kind {
+	case "bench":
+		var o, c []workload.Result
+		if err := decode(&o, &c); err != nil {
+			return err
+		}
+		changes = compare.Bench(o, c, *tolerance)
+	case "matrix":
+		var o, c []matrix.Result
+		if err := decode(&o, &c); err != nil {
+			return err
+		}
+		changes = compare.Matrix(o, c)
+	case "verify":
+		var o, c []verify.Result
+		if err := decode(&o, &c); err != nil {
+			return err
+		}
+		changes = compare.Verify(o, c)
+	default:
+		return fmt.Errorf("cannot compare %s results", old.Kind)
+	}
+
+	for _, c := range changes {
+		fmt.Fprintln(os.Stderr, c)
+	}
+	if err := write(out, "compare", "", time.Now(), changes); err != nil {
+		return err
+	}
+	if compare.Regressions(changes) > 0 {
+		return errFailed
+	}
+	return nil
+}
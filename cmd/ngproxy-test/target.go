@@ -0,0 +1,21 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/lidaohang/test-redis-ngproxy/target"
+)
+
+// registerTarget registers the flags of the proxy and backends a command
+// runs against: an external proxy, or a topology launched for the run like
+// -ngproxy.topology of the test suite.
+func registerTarget(fs *flag.FlagSet, t *target.Target) {
+	fs.StringVar(&t.Topology, "topology", "", "topology file of a proxy and backends to launch for the run")
+	fs.StringVar(&t.Proxy, "proxy", "10.94.106.240:8015", "address of the external proxy")
+	fs.StringVar(&t.Master, "master", "127.0.0.1:8001", "address of a master of the external proxy")
+	fs.StringVar(&t.Password, "password", "", "password the proxy requires from clients")
+	fs.StringVar(&t.BackendPassword, "backend.password", "", "password the backends require")
+	fs.BoolVar(&t.TLS, "tls", false, "dial the external proxy over TLS")
+	fs.StringVar(&t.TLSCA, "tls.ca", "", "PEM file of the CA of the external proxy, the system roots if empty")
+	fs.StringVar(&t.TLSServerName, "tls.servername", "", "name expected in the external proxy's certificate")
+}
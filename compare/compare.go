@@ -0,0 +1,178 @@
+// Package compare diffs two results of the same ngproxy-test command, e.g.
+// the bench results of two proxy releases, and flags regressions.
+package compare
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/lidaohang/test-redis-ngproxy/matrix"
+	"github.com/lidaohang/test-redis-ngproxy/verify"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+// Change is one difference between the old and the new result.
+type Change struct {
+	Name       string `json:"name"`
+	Field      string `json:"field"`
+	Old        string `json:"old"`
+	New        string `json:"new"`
+	Regression bool   `json:"regression"`
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s %s: %s -> %s", c.Name, c.Field, c.Old, c.New)
+	if c.Regression {
+		s += " (regression)"
+	}
+	return s
+}
+
+// Regressions returns how many changes are regressions.
+func Regressions(changes []Change) int {
+	n := 0
+	for _, c := range changes {
+		if c.Regression {
+			n++
+		}
+	}
+	return n
+}
+
+// Bench compares bench results by profile. Throughput dropping or p99
+// latency growing by more than tolerance, e.g. 0.1 for 10%, and new errors
+// are regressions. Profiles missing from either side are reported too.
+func Bench(old, cur []workload.Result, tolerance float64) []Change {
+	key := func(r workload.Result) string {
+		return fmt.Sprintf("%s/%dc/%db", r.Profile, r.Clients, r.Payload)
+	}
+	olds := make(map[string]workload.Result)
+	for _, r := range old {
+		olds[key(r)] = r
+	}
+
+	var changes []Change
+	seen := make(map[string]bool)
+	for _, n := range cur {
+		name := key(n)
+		seen[name] = true
+		o, ok := olds[name]
+		if !ok {
+			changes = append(changes, Change{Name: name, Field: "profile", Old: "-", New: "added"})
+			continue
+		}
+
+		if o.OpsPerSec > 0 {
+			ratio := n.OpsPerSec / o.OpsPerSec
+			if ratio < 1-tolerance || ratio > 1+tolerance {
+				changes = append(changes, Change{
+					Name: name, Field: "ops_per_sec",
+					Old:        fmt.Sprintf("%.0f", o.OpsPerSec),
+					New:        fmt.Sprintf("%.0f (%+.1f%%)", n.OpsPerSec, (ratio-1)*100),
+					Regression: ratio < 1-tolerance,
+				})
+			}
+		}
+		if o.P99 > 0 {
+			ratio := float64(n.P99) / float64(o.P99)
+			if ratio < 1-tolerance || ratio > 1+tolerance {
+				changes = append(changes, Change{
+					Name: name, Field: "p99",
+					Old:        o.P99.String(),
+					New:        fmt.Sprintf("%s (%+.1f%%)", n.P99, (ratio-1)*100),
+					Regression: ratio > 1+tolerance,
+				})
+			}
+		}
+		if n.Errors != o.Errors {
+			changes = append(changes, Change{
+				Name: name, Field: "errors",
+				Old:        fmt.Sprint(o.Errors),
+				New:        fmt.Sprint(n.Errors),
+				Regression: n.Errors > o.Errors,
+			})
+		}
+	}
+	for name := range olds {
+		if !seen[name] {
+			changes = append(changes, Change{Name: name, Field: "profile", Old: "present", New: "removed"})
+		}
+	}
+	sortChanges(changes)
+	return changes
+}
+
+// Matrix compares command support matrices. A command that was supported
+// and no longer is, is a regression.
+func Matrix(old, cur []matrix.Result) []Change {
+	olds := make(map[string]matrix.Status)
+	for _, r := range old {
+		olds[r.Command] = r.Status
+	}
+
+	var changes []Change
+	for _, n := range cur {
+		o, ok := olds[n.Command]
+		if !ok {
+			o = "-"
+		}
+		if o == n.Status {
+			continue
+		}
+		changes = append(changes, Change{
+			Name: n.Command, Field: "status",
+			Old:        string(o),
+			New:        string(n.Status),
+			Regression: o == matrix.Supported,
+		})
+	}
+	sortChanges(changes)
+	return changes
+}
+
+// Verify compares functional checks. A check that passed and now fails
+// is a regression.
+func Verify(old, cur []verify.Result) []Change {
+	key := func(r verify.Result) string { return r.Group + " " + r.Name }
+	olds := make(map[string]verify.Result)
+	for _, r := range old {
+		olds[key(r)] = r
+	}
+
+	status := func(r verify.Result) string {
+		if r.Passed {
+			return "passed"
+		}
+		return "failed"
+	}
+
+	var changes []Change
+	for _, n := range cur {
+		name := key(n)
+		o, ok := olds[name]
+		if ok && o.Passed == n.Passed {
+			continue
+		}
+		was := "-"
+		if ok {
+			was = status(o)
+		}
+		changes = append(changes, Change{
+			Name: name, Field: "status",
+			Old:        was,
+			New:        status(n),
+			Regression: !n.Passed,
+		})
+	}
+	sortChanges(changes)
+	return changes
+}
+
+func sortChanges(changes []Change) {
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Name != changes[j].Name {
+			return changes[i].Name < changes[j].Name
+		}
+		return changes[i].Field < changes[j].Field
+	})
+}
@@ -0,0 +1,90 @@
+package compare
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lidaohang/test-redis-ngproxy/matrix"
+	"github.com/lidaohang/test-redis-ngproxy/verify"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+func TestBench(t *testing.T) {
+	old := []workload.Result{
+		{Profile: "get", Clients: 10, Payload: 32, OpsPerSec: 1000, P99: time.Millisecond},
+		{Profile: "set", Clients: 10, Payload: 32, OpsPerSec: 1000, P99: time.Millisecond},
+		{Profile: "ping", Clients: 10, Payload: 32, OpsPerSec: 1000},
+	}
+	cur := []workload.Result{
+		{Profile: "get", Clients: 10, Payload: 32, OpsPerSec: 1050, P99: time.Millisecond},
+		{Profile: "set", Clients: 10, Payload: 32, OpsPerSec: 800, P99: 2 * time.Millisecond, Errors: 3},
+		{Profile: "zadd", Clients: 10, Payload: 32, OpsPerSec: 1000},
+	}
+
+	changes := Bench(old, cur, 0.1)
+	want := []struct {
+		name, field string
+		regression  bool
+	}{
+		{"ping/10c/32b", "profile", false},
+		{"set/10c/32b", "errors", true},
+		{"set/10c/32b", "ops_per_sec", true},
+		{"set/10c/32b", "p99", true},
+		{"zadd/10c/32b", "profile", false},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("got %v", changes)
+	}
+	for i, w := range want {
+		c := changes[i]
+		if c.Name != w.name || c.Field != w.field || c.Regression != w.regression {
+			t.Errorf("change %d: got %v, want %+v", i, c, w)
+		}
+	}
+	if n := Regressions(changes); n != 3 {
+		t.Fatalf("got %d regressions", n)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	old := []matrix.Result{
+		{Command: "get", Status: matrix.Supported},
+		{Command: "keys", Status: matrix.Rejected},
+		{Command: "mget", Status: matrix.Supported},
+	}
+	cur := []matrix.Result{
+		{Command: "get", Status: matrix.Supported},
+		{Command: "keys", Status: matrix.Supported},
+		{Command: "mget", Status: matrix.WrongResult},
+	}
+
+	changes := Matrix(old, cur)
+	if len(changes) != 2 {
+		t.Fatalf("got %v", changes)
+	}
+	if changes[0].Name != "keys" || changes[0].Regression {
+		t.Errorf("got %v", changes[0])
+	}
+	if changes[1].Name != "mget" || !changes[1].Regression {
+		t.Errorf("got %v", changes[1])
+	}
+}
+
+func TestVerify(t *testing.T) {
+	old := []verify.Result{
+		{Group: "strings", Name: "SET", Passed: true},
+		{Group: "lists", Name: "LPUSH", Passed: false},
+	}
+	cur := []verify.Result{
+		{Group: "strings", Name: "SET", Passed: false},
+		{Group: "lists", Name: "LPUSH", Passed: true},
+	}
+
+	changes := Verify(old, cur)
+	if len(changes) != 2 || Regressions(changes) != 1 {
+		t.Fatalf("got %v", changes)
+	}
+	if changes[1].Name != "strings SET" || !changes[1].Regression {
+		t.Errorf("got %v", changes[1])
+	}
+}
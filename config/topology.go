@@ -0,0 +1,120 @@
+// Package config loads the topology of the proxy and redis backends that
+// the tests run against.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Proxy describes how to launch ngproxy.
+type Proxy struct {
+	// Binary is the path of the ngproxy executable.
+	Binary string `yaml:"binary"`
+	// Args are passed to Binary. Each argument is a text/template
+	// rendered with the supervisor's proxy data, e.g. "{{.ConfigFile}}".
+	Args []string `yaml:"args"`
+	// ConfigTemplate is the path of a text/template that is rendered
+	// into the proxy's config file before it starts.
+	ConfigTemplate string `yaml:"config_template"`
+}
+
+// Shard is one master and its slaves.
+type Shard struct {
+	Name   string `yaml:"name"`
+	Slaves int    `yaml:"slaves"`
+	// Relay puts a fault-injecting relay between the proxy and the
+	// master, so that tests can slow it down or stall it.
+	Relay bool `yaml:"relay"`
+}
+
+// TLS enables TLS with a CA and certificates generated by the supervisor
+// for every run.
+type TLS struct {
+	// Proxy serves clients over TLS with the certificate paths rendered
+	// into the proxy's config.
+	Proxy bool `yaml:"proxy"`
+	// Terminate serves clients over TLS through a relay in front of a
+	// plaintext proxy instead, for proxies without TLS support.
+	Terminate bool `yaml:"terminate"`
+	// Backends runs every redis-server with TLS only, which needs a
+	// redis-server 6.0 or later built with TLS.
+	Backends bool `yaml:"backends"`
+}
+
+// Topology is the set of processes launched for a test run.
+type Topology struct {
+	// RedisServer is the path of the redis-server executable.
+	RedisServer string `yaml:"redis_server"`
+	// RedisArgs are extra arguments passed to every redis-server.
+	RedisArgs []string `yaml:"redis_args"`
+	// Host is the address every process binds to, 127.0.0.1 by default.
+	Host string `yaml:"host"`
+
+	// Password is required by the proxy from its clients, empty for none.
+	Password string `yaml:"password"`
+	// BackendPassword is set as requirepass and masterauth of every
+	// redis-server, and used by the proxy to authenticate to them.
+	BackendPassword string `yaml:"backend_password"`
+
+	TLS TLS `yaml:"tls"`
+
+	Proxy  Proxy   `yaml:"proxy"`
+	Shards []Shard `yaml:"shards"`
+}
+
+// Enabled reports whether any TLS is configured.
+func (t TLS) Enabled() bool {
+	return t.Proxy || t.Terminate || t.Backends
+}
+
+// Load reads and validates the topology in the YAML file at path.
+func Load(path string) (*Topology, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var topo Topology
+	if err := yaml.Unmarshal(b, &topo); err != nil {
+		return nil, fmt.Errorf("config: %s: %s", path, err)
+	}
+	if err := topo.init(); err != nil {
+		return nil, fmt.Errorf("config: %s: %s", path, err)
+	}
+	return &topo, nil
+}
+
+func (t *Topology) init() error {
+	if t.Host == "" {
+		t.Host = "127.0.0.1"
+	}
+	if t.RedisServer == "" {
+		t.RedisServer = "redis-server"
+	}
+	if t.Proxy.Binary == "" {
+		return errors.New("proxy.binary is required")
+	}
+	if t.TLS.Proxy && t.TLS.Terminate {
+		return errors.New("tls.proxy and tls.terminate are exclusive")
+	}
+	if len(t.Shards) == 0 {
+		return errors.New("at least one shard is required")
+	}
+
+	names := make(map[string]bool)
+	for i := range t.Shards {
+		shard := &t.Shards[i]
+		if shard.Name == "" {
+			shard.Name = fmt.Sprintf("shard%d", i)
+		}
+		if names[shard.Name] {
+			return fmt.Errorf("duplicate shard %q", shard.Name)
+		}
+		names[shard.Name] = true
+	}
+	return nil
+}
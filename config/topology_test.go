@@ -0,0 +1,72 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadExample(t *testing.T) {
+	topo, err := Load("topology.example.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topo.Host != "127.0.0.1" || topo.Proxy.Binary == "" {
+		t.Fatalf("got %+v", topo)
+	}
+	if len(topo.Shards) != 2 || topo.Shards[0].Name != "shard0" || topo.Shards[0].Slaves != 1 {
+		t.Fatalf("got shards %+v", topo.Shards)
+	}
+}
+
+func TestLoadAuthExample(t *testing.T) {
+	topo, err := Load("topology.auth.example.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topo.Password != "proxy-secret" || topo.BackendPassword != "backend-secret" {
+		t.Fatalf("got passwords %q and %q", topo.Password, topo.BackendPassword)
+	}
+}
+
+func TestLoadTLSExample(t *testing.T) {
+	topo, err := Load("topology.tls.example.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !topo.TLS.Terminate || topo.TLS.Proxy || !topo.TLS.Enabled() {
+		t.Fatalf("got tls %+v", topo.TLS)
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	f, err := ioutil.TempFile("", "topology")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("proxy:\n  binary: ngproxy\nshards:\n  - slaves: 2\n")
+	f.Close()
+
+	topo, err := Load(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topo.RedisServer != "redis-server" || topo.Shards[0].Name != "shard0" {
+		t.Fatalf("got %+v", topo)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "topology")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("shards:\n  - name: a\n")
+	f.Close()
+
+	if _, err := Load(f.Name()); err == nil {
+		t.Fatal("expected an error without proxy.binary")
+	}
+}
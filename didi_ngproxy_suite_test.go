@@ -1,13 +1,34 @@
-package main_test
+package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
 	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/config"
+	"github.com/onsi/ginkgo/reporters"
 	. "github.com/onsi/gomega"
 
 	"testing"
 )
 
+// With -report.dir the specs are also reported as JUnit XML, one file per
+// parallel node, and the failover specs write an HTML report each.
+var reportDir = flag.String("report.dir", "", "directory the JUnit XML and HTML reports are written to")
+
 func TestDidiNgproxy(t *testing.T) {
 	RegisterFailHandler(Fail)
-	RunSpecs(t, "TestDidiNgproxy Suite")
+	if *reportDir == "" {
+		RunSpecs(t, "TestDidiNgproxy Suite")
+		return
+	}
+
+	if err := os.MkdirAll(*reportDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	junit := reporters.NewJUnitReporter(filepath.Join(*reportDir,
+		fmt.Sprintf("junit_%d.xml", config.GinkgoConfig.ParallelNode)))
+	RunSpecsWithDefaultAndCustomReporters(t, "TestDidiNgproxy Suite", []Reporter{junit})
 }
@@ -0,0 +1,304 @@
+// Package matrix probes which commands ngproxy supports. The command table,
+// with arity and key positions, comes from COMMAND on a reference backend;
+// every command is then sent with synthetic arguments to the reference and
+// to the proxy and the replies are compared.
+package matrix
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Status classifies how the proxy handled a command.
+type Status string
+
+const (
+	// Supported means the proxy replied like the reference backend.
+	Supported Status = "supported"
+	// Rejected means the proxy answered with an error reply where the
+	// reference did not.
+	Rejected Status = "rejected"
+	// WrongResult means the proxy replied, but not like the reference.
+	WrongResult Status = "wrong result"
+	// Hang means the proxy did not reply within the timeout.
+	Hang Status = "hang"
+	// Skipped means the command was not probed, see Prober.Skip.
+	Skipped Status = "skipped"
+)
+
+// Result is one row of the matrix.
+type Result struct {
+	Command     string   `json:"command"`
+	Arity       int8     `json:"arity"`
+	Flags       []string `json:"flags"`
+	FirstKeyPos int8     `json:"first_key_pos"`
+	LastKeyPos  int8     `json:"last_key_pos"`
+	StepCount   int8     `json:"step_count"`
+
+	Args     []string `json:"args,omitempty"`
+	Status   Status   `json:"status"`
+	Reply    string   `json:"reply,omitempty"`
+	Expected string   `json:"expected,omitempty"`
+}
+
+// DefaultSkip are commands that are never probed because they would take
+// down, reconfigure or flush the backends, or take over the connection.
+var DefaultSkip = []string{
+	"shutdown", "debug", "flushall", "flushdb", "monitor", "slaveof",
+	"replicaof", "sync", "psync", "save", "bgsave", "bgrewriteaof",
+	"config", "client", "cluster", "migrate", "move", "subscribe",
+	"psubscribe", "ssubscribe", "unsubscribe", "punsubscribe",
+	"sunsubscribe", "multi", "exec", "discard", "watch",
+	"unwatch", "select", "quit", "swapdb", "wait", "readonly", "readwrite",
+	"restore-asking", "asking", "pfdebug", "pfselftest", "latency",
+	"module", "script", "auth", "hello", "reset", "failover",
+}
+
+// Args are synthetic arguments for commands whose defaults would be
+// rejected by redis itself. "<key>" and "<key2>" are replaced by the
+// probe keys.
+var Args = map[string][]string{
+	"set":                  {"<key>", "value"},
+	"setex":                {"<key>", "10", "value"},
+	"psetex":               {"<key>", "10000", "value"},
+	"setnx":                {"<key>", "value"},
+	"append":               {"<key>", "value"},
+	"expire":               {"<key>", "10"},
+	"pexpire":              {"<key>", "10000"},
+	"expireat":             {"<key>", "4102444800"},
+	"pexpireat":            {"<key>", "4102444800000"},
+	"incrbyfloat":          {"<key>", "1.5"},
+	"mset":                 {"<key>", "value", "<key2>", "value"},
+	"msetnx":               {"<key>", "value", "<key2>", "value"},
+	"hset":                 {"<key>", "field", "value"},
+	"hsetnx":               {"<key>", "field", "value"},
+	"hmset":                {"<key>", "field", "value"},
+	"hincrbyfloat":         {"<key>", "field", "1.5"},
+	"zadd":                 {"<key>", "1", "member"},
+	"zincrby":              {"<key>", "1", "member"},
+	"zrangebyscore":        {"<key>", "-inf", "+inf"},
+	"zrevrangebyscore":     {"<key>", "+inf", "-inf"},
+	"zrangebylex":          {"<key>", "-", "+"},
+	"zrevrangebylex":       {"<key>", "+", "-"},
+	"zlexcount":            {"<key>", "-", "+"},
+	"zremrangebylex":       {"<key>", "-", "+"},
+	"zunionstore":          {"<key>", "1", "<key2>"},
+	"zinterstore":          {"<key>", "1", "<key2>"},
+	"linsert":              {"<key>", "BEFORE", "pivot", "value"},
+	"lset":                 {"<key>", "0", "value"},
+	"blpop":                {"<key>", "1"},
+	"brpop":                {"<key>", "1"},
+	"brpoplpush":           {"<key>", "<key2>", "1"},
+	"bzpopmin":             {"<key>", "1"},
+	"bzpopmax":             {"<key>", "1"},
+	"geoadd":               {"<key>", "13.361389", "38.115556", "Palermo"},
+	"georadius":            {"<key>", "15", "37", "200", "km"},
+	"georadiusbymember":    {"<key>", "Palermo", "200", "km"},
+	"georadius_ro":         {"<key>", "15", "37", "200", "km"},
+	"georadiusbymember_ro": {"<key>", "Palermo", "200", "km"},
+	"geodist":              {"<key>", "Palermo", "Catania"},
+	"bitop":                {"AND", "<key>", "<key2>"},
+	"bitfield":             {"<key>", "GET", "u4", "0"},
+	"restore":              {"<key>", "0", "invalid"},
+	"eval":                 {"return 1", "1", "<key>"},
+	"evalsha":              {"e0e1f9fabfc9d4800c877a703b823ac0578ff8db", "1", "<key>"},
+	"object":               {"ENCODING", "<key>"},
+	"sort":                 {"<key>"},
+	"scan":                 {"0"},
+	"sscan":                {"<key>", "0"},
+	"hscan":                {"<key>", "0"},
+	"zscan":                {"<key>", "0"},
+	"xadd":                 {"<key>", "*", "field", "value"},
+	"publish":              {"channel", "message"},
+	"pubsub":               {"CHANNELS"},
+	"command":              {"COUNT"},
+	"memory":               {"USAGE", "<key>"},
+	"slowlog":              {"LEN"},
+	"echo":                 {"hello"},
+}
+
+// Prober compares the replies of the proxy with a reference backend.
+type Prober struct {
+	Proxy     *redis.Client
+	Reference *redis.Client
+	// Skip lists commands that are not probed, DefaultSkip if nil.
+	Skip []string
+	// KeyPrefix prefixes every probe key.
+	KeyPrefix string
+}
+
+// Run probes every command of the reference's COMMAND table and returns
+// the results sorted by command name.
+func (p *Prober) Run() ([]Result, error) {
+	infos, err := p.Reference.Command().Result()
+	if err != nil {
+		return nil, err
+	}
+
+	skip := p.Skip
+	if skip == nil {
+		skip = DefaultSkip
+	}
+	skipped := make(map[string]bool, len(skip))
+	for _, name := range skip {
+		skipped[name] = true
+	}
+
+	names := make([]string, 0, len(infos))
+	for name := range infos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]Result, 0, len(names))
+	for _, name := range names {
+		info := infos[name]
+		r := Result{
+			Command:     info.Name,
+			Arity:       info.Arity,
+			Flags:       info.Flags,
+			FirstKeyPos: info.FirstKeyPos,
+			LastKeyPos:  info.LastKeyPos,
+			StepCount:   info.StepCount,
+		}
+		if skipped[name] {
+			r.Status = Skipped
+			results = append(results, r)
+			continue
+		}
+
+		keys := []string{p.KeyPrefix + "matrix:" + name, p.KeyPrefix + "matrix:" + name + ":2"}
+		r.Args = SyntheticArgs(info, keys)
+
+		refVal, refErr := p.probe(p.Reference, name, r.Args, keys)
+		proxyVal, proxyErr := p.probe(p.Proxy, name, r.Args, keys)
+
+		r.Status = Classify(proxyVal, proxyErr, refVal, refErr)
+		r.Reply = format(proxyVal, proxyErr)
+		if r.Status != Supported {
+			r.Expected = format(refVal, refErr)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// probe sends the command and removes the probe keys afterwards, so that
+// the proxy and the reference start from the same state.
+func (p *Prober) probe(client *redis.Client, name string, args, keys []string) (interface{}, error) {
+	cmdArgs := make([]interface{}, 0, 1+len(args))
+	cmdArgs = append(cmdArgs, name)
+	for _, arg := range args {
+		cmdArgs = append(cmdArgs, arg)
+	}
+	cmd := redis.NewCmd(cmdArgs...)
+	client.Process(cmd)
+	val, err := cmd.Result()
+
+	client.Del(keys...)
+	return val, err
+}
+
+// SyntheticArgs returns arguments for the command described by info,
+// using keys at the key positions. Commands listed in Args use those.
+func SyntheticArgs(info *redis.CommandInfo, keys []string) []string {
+	if args, ok := Args[info.Name]; ok {
+		out := make([]string, len(args))
+		for i, arg := range args {
+			switch arg {
+			case "<key>":
+				arg = keys[0]
+			case "<key2>":
+				arg = keys[1]
+			}
+			out[i] = arg
+		}
+		return out
+	}
+
+	// Arity counts the command name, negative means "at least".
+	n := int(info.Arity)
+	if n < 0 {
+		n = -n
+	}
+	n--
+
+	first, last, step := int(info.FirstKeyPos), int(info.LastKeyPos), int(info.StepCount)
+	if first > 0 && last < 0 {
+		// Variadic keys, probe with two of them.
+		if min := first + step; min > n {
+			n = min
+		}
+		last = first + step
+	}
+
+	args := make([]string, n)
+	k := 0
+	for i := range args {
+		pos := i + 1
+		if first > 0 && step > 0 && pos >= first && pos <= last && (pos-first)%step == 0 {
+			args[i] = keys[k%len(keys)]
+			k++
+			continue
+		}
+		args[i] = strconv.Itoa(i)
+	}
+	return args
+}
+
+// Classify compares the proxy's reply with the reference's.
+func Classify(proxyVal interface{}, proxyErr error, refVal interface{}, refErr error) Status {
+	if netErr, ok := proxyErr.(net.Error); ok && netErr.Timeout() {
+		return Hang
+	}
+	if proxyErr != nil && proxyErr != redis.Nil {
+		if refErr != nil && refErr != redis.Nil && errorKind(refErr) == errorKind(proxyErr) {
+			return Supported
+		}
+		if _, ok := proxyErr.(net.Error); ok {
+			return WrongResult
+		}
+		return Rejected
+	}
+	if format(proxyVal, proxyErr) == format(refVal, refErr) {
+		return Supported
+	}
+	return WrongResult
+}
+
+// errorKind is the first word of an error reply, e.g. "ERR" or "WRONGTYPE".
+func errorKind(err error) string {
+	s := err.Error()
+	if i := strings.IndexByte(s, ' '); i > 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func format(val interface{}, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return fmt.Sprint(val)
+}
+
+// NewClient returns a client for probing addr, timeout bounds how long a
+// command may take before it is classified as Hang. A nil dialer dials
+// plaintext.
+func NewClient(addr, password string, dialer func() (net.Conn, error), timeout time.Duration) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:         addr,
+		Password:     password,
+		Dialer:       dialer,
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		PoolSize:     1,
+	})
+}
@@ -0,0 +1,83 @@
+package matrix
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestSyntheticArgs(t *testing.T) {
+	keys := []string{"k1", "k2"}
+	for _, test := range []struct {
+		info *redis.CommandInfo
+		want []string
+	}{
+		{&redis.CommandInfo{Name: "get", Arity: 2, FirstKeyPos: 1, LastKeyPos: 1, StepCount: 1}, []string{"k1"}},
+		{&redis.CommandInfo{Name: "mget", Arity: -2, FirstKeyPos: 1, LastKeyPos: -1, StepCount: 1}, []string{"k1", "k2"}},
+		{&redis.CommandInfo{Name: "rpoplpush", Arity: 3, FirstKeyPos: 1, LastKeyPos: 2, StepCount: 1}, []string{"k1", "k2"}},
+		{&redis.CommandInfo{Name: "hget", Arity: 3, FirstKeyPos: 1, LastKeyPos: 1, StepCount: 1}, []string{"k1", "1"}},
+		{&redis.CommandInfo{Name: "ping", Arity: -1}, []string{}},
+		{&redis.CommandInfo{Name: "set", Arity: -3, FirstKeyPos: 1, LastKeyPos: 1, StepCount: 1}, []string{"k1", "value"}},
+	} {
+		got := SyntheticArgs(test.info, keys)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.info.Name, got, test.want)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	errReply := errors.New("ERR unknown command")
+	for _, test := range []struct {
+		proxyVal interface{}
+		proxyErr error
+		refVal   interface{}
+		refErr   error
+		want     Status
+	}{
+		{"OK", nil, "OK", nil, Supported},
+		{nil, redis.Nil, nil, redis.Nil, Supported},
+		{nil, errors.New("ERR wrong number of arguments"), nil, errors.New("ERR syntax error"), Supported},
+		{nil, errReply, "OK", nil, Rejected},
+		{int64(1), nil, int64(2), nil, WrongResult},
+		{nil, timeoutError{}, "OK", nil, Hang},
+	} {
+		if got := Classify(test.proxyVal, test.proxyErr, test.refVal, test.refErr); got != test.want {
+			t.Errorf("Classify(%v, %v, %v, %v) = %q, want %q",
+				test.proxyVal, test.proxyErr, test.refVal, test.refErr, got, test.want)
+		}
+	}
+}
+
+func TestWriteMarkdown(t *testing.T) {
+	results := []Result{
+		{Command: "get", Flags: []string{"readonly"}, FirstKeyPos: 1, LastKeyPos: 1, StepCount: 1, Status: Supported},
+		{Command: "keys", Flags: []string{"readonly"}, Status: Rejected, Reply: "error: ERR a|b", Expected: "[]"},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteMarkdown(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"supported: 1, rejected: 1",
+		"| get | readonly | 1:1:1 | supported |  |",
+		"| keys | readonly | - | rejected | got `error: ERR a\\|b`, want `[]` |",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
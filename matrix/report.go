@@ -0,0 +1,62 @@
+package matrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteJSON writes results as an indented JSON array.
+func WriteJSON(w io.Writer, results []Result) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+// WriteMarkdown writes a summary line and one table row per command.
+func WriteMarkdown(w io.Writer, results []Result) error {
+	counts := make(map[Status]int)
+	for _, r := range results {
+		counts[r.Status]++
+	}
+
+	var summary []string
+	for _, status := range []Status{Supported, Rejected, WrongResult, Hang, Skipped} {
+		summary = append(summary, fmt.Sprintf("%s: %d", status, counts[status]))
+	}
+	if _, err := fmt.Fprintf(w, "%s\n\n", strings.Join(summary, ", ")); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, "| command | flags | keys | status | detail |\n|---|---|---|---|---|\n"); err != nil {
+		return err
+	}
+	for _, r := range results {
+		keys := "-"
+		if r.FirstKeyPos > 0 {
+			keys = fmt.Sprintf("%d:%d:%d", r.FirstKeyPos, r.LastKeyPos, r.StepCount)
+		}
+		detail := ""
+		if r.Status != Supported && r.Status != Skipped {
+			detail = fmt.Sprintf("got `%s`, want `%s`", escape(r.Reply), escape(r.Expected))
+		}
+		_, err := fmt.Fprintf(w, "| %s | %s | %s | %s | %s |\n",
+			r.Command, strings.Join(r.Flags, " "), keys, r.Status, detail)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escape keeps a reply inside its table cell.
+func escape(s string) string {
+	const max = 80
+	if len(s) > max {
+		s = s[:max] + "..."
+	}
+	s = strings.Replace(s, "|", `\|`, -1)
+	s = strings.Replace(s, "`", "'", -1)
+	return strings.Replace(s, "\n", " ", -1)
+}
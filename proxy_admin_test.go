@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+)
+
+var adminPolicies = flag.String("ngproxy.policy", "",
+	"comma separated COMMAND=rejected|fanout|single overriding the expected admin command policy, rejected by default")
+
+const (
+	policyRejected = "rejected"
+	policyFanOut   = "fanout"
+	policySingle   = "single"
+)
+
+// adminPolicy returns the expected policy for command from -ngproxy.policy.
+func adminPolicy(command string) string {
+	for _, entry := range strings.Split(*adminPolicies, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], command) {
+			switch kv[1] {
+			case policyRejected, policyFanOut, policySingle:
+				return kv[1]
+			}
+			Fail(fmt.Sprintf("unknown policy in -ngproxy.policy entry %q", entry))
+		}
+	}
+	return policyRejected
+}
+
+// commandCalls returns how often every backend executed the command of
+// args, from INFO commandstats. Redis 7 counts a subcommand as
+// cmdstat_<command>|<subcommand>, older versions count the command.
+func commandCalls(backends []*redis.Client, args []string) []int64 {
+	names := []string{"cmdstat_" + strings.ToLower(args[0])}
+	if len(args) > 1 {
+		names = append([]string{names[0] + "|" + strings.ToLower(args[1])}, names...)
+	}
+
+	calls := make([]int64, len(backends))
+	for i, backend := range backends {
+		s, err := backend.Info("commandstats").Result()
+		Expect(err).NotTo(HaveOccurred())
+		info, err := stats.ParseInfo(s)
+		Expect(err).NotTo(HaveOccurred())
+
+		// cmdstat_get:calls=2,usec=15,usec_per_call=7.50
+		var v string
+		for _, name := range names {
+			var ok bool
+			if v, ok = info.Get("commandstats", name); ok {
+				break
+			}
+		}
+		for _, field := range strings.Split(v, ",") {
+			if strings.HasPrefix(field, "calls=") {
+				calls[i], err = strconv.ParseInt(strings.TrimPrefix(field, "calls="), 10, 64)
+				Expect(err).NotTo(HaveOccurred())
+			}
+		}
+	}
+	return calls
+}
+
+// sendRaw sends cmds on a fresh proxy connection and reads one reply per
+// command.
+func sendRaw(cmds ...[]string) []interface{} {
+	conn, err := dialProxy()
+	Expect(err).NotTo(HaveOccurred())
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+
+	Expect(writeRaw(conn, cmds...)).To(Succeed())
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		replies[i], err = readReply(r)
+		Expect(err).NotTo(HaveOccurred())
+	}
+	return replies
+}
+
+var _ = Describe("Admin [destructive]", func() {
+	var backends []*redis.Client
+
+	BeforeEach(func() {
+		backends = nil
+		requireDestructive()
+
+		for _, addr := range masterAddrs() {
+			backend := getRedisClient(addr, 1)
+			Expect(backend.Set("admin:marker", addr, 0).Err()).NotTo(HaveOccurred())
+			backends = append(backends, backend)
+		}
+	})
+
+	AfterEach(func() {
+		for _, backend := range backends {
+			backend.Del("admin:marker", "admin:select")
+			Expect(backend.Close()).NotTo(HaveOccurred())
+		}
+	})
+
+	// lostMarkers returns how many backends lost admin:marker.
+	lostMarkers := func() int {
+		lost := 0
+		for _, backend := range backends {
+			n, err := backend.Exists("admin:marker").Result()
+			Expect(err).NotTo(HaveOccurred())
+			if n == 0 {
+				lost++
+			}
+		}
+		return lost
+	}
+
+	for _, args := range [][]string{
+		{"FLUSHALL"},
+		{"FLUSHDB"},
+		{"KEYS", "admin:*"},
+		{"CONFIG", "GET", "maxmemory"},
+		{"DEBUG", "SLEEP", "0"},
+		{"MONITOR"},
+		{"SLAVEOF", "NO", "ONE"},
+		{"CLIENT", "KILL", "ID", "0"},
+		{"SELECT", "1"},
+		{"MIGRATE", "127.0.0.1", "1", "admin:missing", "0", "1000"},
+		{"SAVE"},
+	} {
+		args := args
+
+		It(fmt.Sprintf("should apply the policy for %s", strings.Join(args, " ")), func() {
+			policy := adminPolicy(args[0])
+
+			before := commandCalls(backends, args)
+			reply := sendRaw(args)[0]
+			after := commandCalls(backends, args)
+
+			reached := 0
+			for i := range backends {
+				if after[i] > before[i] {
+					reached++
+				}
+			}
+
+			switch policy {
+			case policyRejected:
+				expectRejectedReply(reply)
+				Expect(reached).To(Equal(0), "%s reached a backend", args[0])
+			case policyFanOut:
+				Expect(reply).NotTo(BeAssignableToTypeOf(replyError("")))
+				Expect(reached).To(Equal(len(backends)))
+			case policySingle:
+				Expect(reply).NotTo(BeAssignableToTypeOf(replyError("")))
+				Expect(reached).To(Equal(1))
+			}
+
+			switch args[0] {
+			case "FLUSHALL", "FLUSHDB":
+				Expect(lostMarkers()).To(Equal(reached))
+			case "KEYS":
+				if policy != policyRejected {
+					Expect(reply).To(HaveLen(reached))
+				}
+			}
+		})
+	}
+
+	It("should keep SELECT consistent across backends", func() {
+		replies := sendRaw(
+			[]string{"SELECT", "1"},
+			[]string{"SET", "admin:select", "hello"},
+			[]string{"GET", "admin:select"},
+		)
+		_, rejected := replies[0].(replyError)
+		if rejected {
+			expectRejectedReply(replies[0])
+		}
+		Expect(replies[1]).To(Equal("OK"))
+		Expect(replies[2]).To(Equal([]byte("hello")))
+
+		// A new connection is on DB 0 and must see the key only if the
+		// SELECT was rejected.
+		fresh := sendRaw([]string{"GET", "admin:select"})[0]
+		if rejected {
+			Expect(fresh).To(Equal([]byte("hello")))
+		} else {
+			Expect(fresh).To(BeNil())
+			sendRaw([]string{"SELECT", "1"}, []string{"DEL", "admin:select"})
+		}
+	})
+
+	It("should never forward SHUTDOWN", func() {
+		pids := make([]int64, len(backends))
+		for i, backend := range backends {
+			s, err := backend.Info("server").Result()
+			Expect(err).NotTo(HaveOccurred())
+			info, err := stats.ParseInfo(s)
+			Expect(err).NotTo(HaveOccurred())
+			pids[i] = info.Server.ProcessID
+		}
+
+		for _, args := range [][]string{{"SHUTDOWN"}, {"SHUTDOWN", "NOSAVE"}} {
+			expectRejectedReply(sendRaw(args)[0])
+		}
+
+		for i, backend := range backends {
+			Expect(backend.Ping().Err()).NotTo(HaveOccurred())
+			s, err := backend.Info("server").Result()
+			Expect(err).NotTo(HaveOccurred())
+			info, err := stats.ParseInfo(s)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Server.ProcessID).To(Equal(pids[i]))
+		}
+		Expect(sendRaw([]string{"PING"})[0]).To(Equal("PONG"))
+	})
+})
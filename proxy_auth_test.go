@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+
+	"github.com/lidaohang/test-redis-ngproxy/target"
+)
+
+// Error texts of redis for a missing and a wrong password. Older servers
+// answer a wrong AUTH with "ERR invalid password", newer with WRONGPASS.
+const (
+	noAuthError    = `^NOAUTH Authentication required`
+	wrongPassError = `^(ERR invalid password|WRONGPASS)`
+)
+
+var _ = Describe("Auth", func() {
+	var conn net.Conn
+	var r *bufio.Reader
+
+	expectError := func(reply interface{}, pattern string) {
+		Expect(reply).To(BeAssignableToTypeOf(replyError("")))
+		Expect(string(reply.(replyError))).To(MatchRegexp(pattern))
+	}
+
+	// send writes args on conn and reads the reply.
+	send := func(args ...string) interface{} {
+		Expect(writeRaw(conn, args)).To(Succeed())
+		reply, err := readReply(r)
+		Expect(err).NotTo(HaveOccurred())
+		return reply
+	}
+
+	BeforeEach(func() {
+		if *proxyPassword == "" {
+			Skip("requires -ngproxy.password or a topology with a password")
+		}
+
+		var err error
+		if proxyTLS != nil {
+			conn, err = target.DialTLS(proxyAddr, proxyTLS)
+		} else {
+			conn, err = net.DialTimeout("tcp", proxyAddr, time.Second)
+		}
+		Expect(err).NotTo(HaveOccurred())
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		r = bufio.NewReader(conn)
+	})
+
+	AfterEach(func() {
+		if conn != nil {
+			Expect(conn.Close()).To(Succeed())
+			conn = nil
+		}
+	})
+
+	It("should reject commands before AUTH", func() {
+		for _, args := range [][]string{{"GET", "key"}, {"SET", "key", "hello"}, {"PING"}} {
+			expectError(send(args...), noAuthError)
+		}
+	})
+
+	It("should AUTH through the proxy", func() {
+		Expect(send("AUTH", *proxyPassword)).To(Equal("OK"))
+		Expect(send("SET", "auth:key", "hello")).To(Equal("OK"))
+		Expect(send("GET", "auth:key")).To(Equal([]byte("hello")))
+		Expect(send("DEL", "auth:key")).To(Equal(int64(1)))
+	})
+
+	It("should reject a wrong password", func() {
+		expectError(send("AUTH", *proxyPassword+"-wrong"), wrongPassError)
+
+		// The connection stays unauthenticated.
+		expectError(send("GET", "key"), noAuthError)
+
+		Expect(send("AUTH", *proxyPassword)).To(Equal("OK"))
+		Expect(send("PING")).To(Equal("PONG"))
+	})
+
+	It("should not accept the backend password", func() {
+		if *backendPassword == "" || *backendPassword == *proxyPassword {
+			Skip("requires a backend password different from the proxy's")
+		}
+		expectError(send("AUTH", *backendPassword), wrongPassError)
+	})
+
+	It("should fail go-redis clients with a wrong or no password", func() {
+		for _, password := range []string{"", *proxyPassword + "-wrong"} {
+			client := redis.NewClient(&redis.Options{
+				Addr:        proxyAddr,
+				Password:    password,
+				Dialer:      dialerFor(proxyAddr),
+				DialTimeout: time.Second,
+				ReadTimeout: time.Second,
+			})
+			err := client.Ping().Err()
+			client.Close()
+
+			Expect(err).To(HaveOccurred())
+			if password == "" {
+				Expect(err).To(MatchError(MatchRegexp(noAuthError)))
+			} else {
+				Expect(err).To(MatchError(MatchRegexp(wrongPassError)))
+			}
+		}
+
+		client := getRedisClient(proxyAddr, 1)
+		defer client.Close()
+		Expect(client.Ping().Err()).NotTo(HaveOccurred())
+	})
+
+	It("should reauthenticate to restarted backends [destructive]", func() {
+		requireDestructive()
+		if cluster == nil || *backendPassword == "" {
+			Skip("requires -ngproxy.topology with a backend_password")
+		}
+
+		client := getRedisClient(proxyAddr, 10)
+		defer client.Close()
+
+		keys := make([]string, len(cluster.Masters))
+		for i, master := range cluster.Masters {
+			key, err := keyOn("auth", master.Addr)
+			Expect(err).NotTo(HaveOccurred())
+			keys[i] = key
+		}
+
+		for _, master := range cluster.Masters {
+			Expect(master.Restart()).To(Succeed())
+		}
+
+		for _, key := range keys {
+			Eventually(func() error {
+				return client.Set(key, "hello", 0).Err()
+			}, 30*time.Second, 100*time.Millisecond).Should(Succeed())
+			Expect(client.Get(key).Val()).To(Equal("hello"))
+			Expect(client.Del(key).Err()).NotTo(HaveOccurred())
+		}
+	})
+})
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+var (
+	bpValue    = flag.Int("backpressure.value", 1<<20, "size in bytes of the value the slow readers GET")
+	bpRequests = flag.Int("backpressure.requests", 2000, "GETs pipelined by a slow reader")
+	bpFor      = flag.Duration("backpressure.for", 10*time.Second, "how long a slow reader reads slowly or not at all")
+	bpRate     = flag.Int("backpressure.rate", 256<<10, "bytes per second read by the slow reader")
+	bpLimit    = flag.Int64("backpressure.limit", 256<<20, "proxy memory growth in bytes tolerated while a client reads slowly")
+	bpLatency  = flag.Duration("backpressure.latency", time.Second, "p99 tolerated for other clients while a client reads slowly")
+)
+
+// throttledReader reads at most rate bytes per second from r, without a
+// limit once rate is 0. go-redis always drains replies, so the slow readers
+// read raw RESP through it.
+type throttledReader struct {
+	r     io.Reader
+	rate  int
+	start time.Time
+	n     int
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.rate > 0 {
+		if len(p) > t.rate/10+1 {
+			p = p[:t.rate/10+1]
+		}
+		due := t.start.Add(time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second)))
+		time.Sleep(time.Until(due))
+	}
+	n, err := t.r.Read(p)
+	t.n += n
+	return n, err
+}
+
+// slowReader is the outcome of one slow reader.
+type slowReader struct {
+	written   int
+	replies   int
+	closedErr error
+
+	memBefore, memPeak int64
+	others             workload.Result
+}
+
+func (s *slowReader) log(name string) {
+	fmt.Fprintf(GinkgoWriter, "%s: %d requests written, %d replies read\n", name, s.written, s.replies)
+	if s.closedErr != nil {
+		fmt.Fprintf(GinkgoWriter, "%s: the proxy closed the connection: %s\n", name, s.closedErr)
+	}
+	if s.memBefore > 0 {
+		fmt.Fprintf(GinkgoWriter, "%s: proxy memory %d -> peak %d (+%d)\n",
+			name, s.memBefore, s.memPeak, s.memPeak-s.memBefore)
+	}
+	fmt.Fprintf(GinkgoWriter, "%s: other clients p50=%s p99=%s max=%s errors=%d\n",
+		name, s.others.P50, s.others.P99, s.others.Max, s.others.Errors)
+}
+
+var _ = Describe("Backpressure [slow]", func() {
+	var admin, probe *redis.Client
+	var collector *stats.Collector
+	var ns *keyspace
+	var pid int
+	var key, small, value string
+
+	// read pipelines -backpressure.requests GETs of the big value over a
+	// raw connection and reads the replies at rate bytes per second, or
+	// not at all for rate 0, for -backpressure.for. Meanwhile another
+	// client GETs a small key and the proxy's memory is sampled. With
+	// drain the replies are then read at full speed, otherwise the
+	// connection is closed with the replies pending.
+	read := func(rate int, drain bool) *slowReader {
+		s := &slowReader{}
+		s.memBefore = proxyMemory(collector, "proxy", pid)
+		s.memPeak = s.memBefore
+
+		conn, err := dialProxy()
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			// Keep the kernel from buffering the replies for the client.
+			tcp.SetReadBuffer(64 << 10)
+		}
+
+		// The proxy may stop reading requests to push back, the writer then
+		// blocks until the replies are read or the connection is closed.
+		req := fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+		var mu sync.Mutex
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			for i := 0; i < *bpRequests; i++ {
+				if _, err := io.WriteString(conn, req); err != nil {
+					return
+				}
+				mu.Lock()
+				s.written++
+				mu.Unlock()
+			}
+		}()
+
+		rec := workload.NewRecorder()
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			ticker := time.NewTicker(200 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+				start := time.Now()
+				err := probe.Get(small).Err()
+				rec.Add(time.Since(start), err)
+				if m := proxyMemory(collector, "proxy", pid); m > s.memPeak {
+					s.memPeak = m
+				}
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-done
+			s.others = rec.Result()
+		}()
+
+		collector.Mark("slow reader")
+		tr := &throttledReader{r: conn, rate: rate, start: time.Now()}
+		r := bufio.NewReaderSize(tr, 4096)
+		readReplies := func(until time.Time) {
+			conn.SetReadDeadline(until)
+			for s.replies < *bpRequests && time.Now().Before(until) {
+				reply, err := readReply(r)
+				if err != nil {
+					if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						return
+					}
+					s.closedErr = err
+					return
+				}
+				Expect(reply).To(Equal([]byte(value)), "reply %d", s.replies)
+				s.replies++
+			}
+		}
+
+		if rate > 0 {
+			readReplies(time.Now().Add(*bpFor))
+		} else {
+			time.Sleep(*bpFor)
+		}
+
+		if drain && s.closedErr == nil {
+			tr.rate = 0
+			readReplies(time.Now().Add(time.Minute))
+		}
+		conn.Close()
+		<-written
+		return s
+	}
+
+	BeforeEach(func() {
+		ns = newKeyspace()
+		admin = getRedisClient(proxyAddr, 1)
+		probe = getRedisClient(proxyAddr, 1)
+
+		collector = stats.NewCollector(time.Second)
+		collector.Add("proxy", admin)
+		pid = localProxyPid(collector.ScrapeOne("proxy").Info)
+
+		key = ns.Key("backpressure:big")
+		small = ns.Key("backpressure:small")
+		value = strings.Repeat("1", *bpValue)
+		Expect(admin.Set(key, value, 0).Err()).NotTo(HaveOccurred())
+		Expect(admin.Set(small, "hello", 0).Err()).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		ns.Cleanup()
+		Expect(probe.Close()).NotTo(HaveOccurred())
+		Expect(admin.Close()).NotTo(HaveOccurred())
+	})
+
+	// expectBounded fails the spec if the proxy buffered more than
+	// -backpressure.limit for the slow reader, or other clients suffered.
+	expectBounded := func(s *slowReader, name string) {
+		s.log(name)
+		if s.memBefore > 0 {
+			Expect(s.memPeak-s.memBefore).To(BeNumerically("<=", *bpLimit), "proxy memory growth")
+		}
+		Expect(s.others.Errors).To(BeZero(), "other clients: %s", s.others.FirstError)
+		Expect(s.others.P99).To(BeNumerically("<=", *bpLatency), "p99 of other clients")
+	}
+
+	// expectIntact fails the spec unless every reply arrived, or the proxy
+	// closed the connection as Redis does beyond client-output-buffer-limit.
+	expectIntact := func(s *slowReader) {
+		if s.closedErr == nil {
+			Expect(s.replies).To(Equal(*bpRequests))
+		}
+	}
+
+	It("should bound its memory for a client that stops reading", func() {
+		s := read(0, true)
+		expectBounded(s, "stopped reader")
+		expectIntact(s)
+	})
+
+	It("should bound its memory for a client that reads slowly", func() {
+		s := read(*bpRate, true)
+		expectBounded(s, "slow reader")
+		expectIntact(s)
+	})
+
+	It("should free the pending replies of a client that disconnects", func() {
+		base := collector.ScrapeOne("proxy").Info
+		Expect(base).NotTo(BeNil())
+
+		s := read(0, false)
+		expectBounded(s, "disconnected reader")
+
+		Eventually(func() (int64, error) {
+			return connectedClients(collector, "proxy")
+		}, 10*time.Second, 200*time.Millisecond).Should(BeNumerically("<=", base.Clients.ConnectedClients))
+		if s.memBefore > 0 {
+			Eventually(func() int64 {
+				return proxyMemory(collector, "proxy", pid)
+			}, 10*time.Second, 200*time.Millisecond).Should(BeNumerically("<=", s.memBefore+*leakRSSTol))
+		}
+	})
+})
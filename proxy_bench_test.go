@@ -2,57 +2,143 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/go-redis/redis"
+
+	"github.com/lidaohang/test-redis-ngproxy/report"
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
 )
 
 func benchmarkRedisClient(poolSize int) *redis.Client {
-	client := redis.NewClient(&redis.Options{
-		Addr:         "10.94.106.240:8015",
-		DialTimeout:  time.Second,
-		ReadTimeout:  time.Second,
-		WriteTimeout: time.Second,
-		PoolSize:     poolSize,
-	})
-	client.Del("key", "key1", "key2")
+	client := getRedisClient(proxyAddr, poolSize)
+	client.Del("key", "key:1", "key:2", "key:zset")
 
 	return client
 }
 
-func BenchmarkRedisPing(b *testing.B) {
-	client := benchmarkRedisClient(10)
+// benchmarkProfile runs the workload profile name, the operation of the
+// ngproxy-test bench command, on poolSize connections with a payload of
+// payloadSize bytes. With -report.dir the last round of the benchmark is
+// also written to bench_<benchmark>.html.
+func benchmarkProfile(b *testing.B, name string, poolSize, payloadSize int) {
+	client := benchmarkRedisClient(poolSize)
 	defer client.Close()
 
+	opts := workload.Options{Payload: payloadSize, Key: "key"}
+	if err := workload.Prepare(client, opts); err != nil {
+		b.Fatal(err)
+	}
+	op := workload.Profiles[name].Op
+	value := bytes.Repeat([]byte{'1'}, payloadSize)
+
+	var rep *benchReport
+	if *reportDir != "" {
+		rep = newBenchReport(client)
+		defer rep.stop()
+	}
+
 	b.ResetTimer()
 
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			if err := client.Ping().Err(); err != nil {
+			start := time.Now()
+			err := op(client, opts.Key, value)
+			if rep != nil {
+				rep.add(time.Since(start), err)
+			}
+			if err != nil {
 				b.Fatal(err)
 			}
 		}
 	})
+
+	if rep != nil {
+		b.StopTimer()
+		rep.stop()
+		if _, err := rep.write(b.Name(), name); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
 
-func BenchmarkRedisSetString(b *testing.B) {
-	client := benchmarkRedisClient(10)
-	defer client.Close()
+// benchReport records a round of a profile benchmark for -report.dir: the
+// latency of every operation over time and the pool stats of the client,
+// scraped through an admin connection of its own. Timing the operations
+// costs a little throughput, so it is only done with -report.dir.
+type benchReport struct {
+	started   time.Time
+	recorder  *workload.Recorder
+	timeline  *workload.Timeline
+	admin     *redis.Client
+	collector *stats.Collector
+}
 
-	value := string(bytes.Repeat([]byte{'1'}, 10000))
+func newBenchReport(client *redis.Client) *benchReport {
+	opts := *client.Options()
+	opts.PoolSize = 1
+	r := &benchReport{
+		started:   time.Now(),
+		recorder:  workload.NewRecorder(),
+		admin:     redis.NewClient(&opts),
+		collector: stats.NewCollector(100 * time.Millisecond),
+	}
+	r.timeline = workload.NewTimeline(r.started, 100*time.Millisecond)
+	r.collector.AddPool("proxy", r.admin, client)
+	r.collector.Start()
+	return r
+}
 
-	b.ResetTimer()
+func (r *benchReport) add(latency time.Duration, err error) {
+	r.recorder.Add(latency, err)
+	r.timeline.Add(latency, err)
+}
 
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			if err := client.Set("key", value, 0).Err(); err != nil {
-				b.Fatal(err)
-			}
-		}
+// stop stops the collector and closes the admin client, it may be called
+// again.
+func (r *benchReport) stop() {
+	if r.admin == nil {
+		return
+	}
+	r.collector.Stop()
+	r.admin.Close()
+	r.admin = nil
+}
+
+// write writes the round to -report.dir as bench_<benchmark>.html. Every
+// round of a benchmark overwrites it, the last and longest one remains.
+func (r *benchReport) write(benchmark, profile string) (string, error) {
+	res := r.recorder.Result()
+	summary := &report.Table{
+		Columns: []string{"profile", "ops", "ops/s", "p50", "p99", "max", "errors"},
+		Rows: [][]string{{
+			profile, fmt.Sprint(res.Ops), fmt.Sprintf("%.0f", res.OpsPerSec),
+			res.P50.String(), res.P99.String(), res.Max.String(), fmt.Sprint(res.Errors),
+		}},
+	}
+	return report.WriteFile(*reportDir, "bench_"+benchmark, &report.Run{
+		Title:   benchmark,
+		Started: r.started,
+		Summary: summary,
+		Series:  []report.Series{{Name: profile, Points: r.timeline.Points()}},
+		Pool:    r.collector.Samples("proxy"),
 	})
 }
 
+func BenchmarkRedisPing(b *testing.B) {
+	benchmarkProfile(b, "ping", 10, 32)
+}
+
+func BenchmarkRedisSetString(b *testing.B) {
+	benchmarkProfile(b, "set", 10, 10000)
+}
+
 func BenchmarkRedisGetNil(b *testing.B) {
 	client := benchmarkRedisClient(10)
 	defer client.Close()
@@ -68,148 +154,158 @@ func BenchmarkRedisGetNil(b *testing.B) {
 	})
 }
 
-func benchmarkSetRedis(b *testing.B, poolSize, payloadSize int) {
-	client := benchmarkRedisClient(poolSize)
-	defer client.Close()
-
-	value := string(bytes.Repeat([]byte{'1'}, payloadSize))
-
-	b.ResetTimer()
-
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			if err := client.Set("key", value, 0).Err(); err != nil {
-				b.Fatal(err)
-			}
-		}
-	})
+func BenchmarkRedisGet(b *testing.B) {
+	benchmarkProfile(b, "get", 10, 32)
 }
 
 func BenchmarkSetRedis10Conns64Bytes(b *testing.B) {
-	benchmarkSetRedis(b, 10, 64)
+	benchmarkProfile(b, "set", 10, 64)
 }
 
 func BenchmarkSetRedis100Conns64Bytes(b *testing.B) {
-	benchmarkSetRedis(b, 100, 64)
+	benchmarkProfile(b, "set", 100, 64)
 }
 
 func BenchmarkSetRedis10Conns1KB(b *testing.B) {
-	benchmarkSetRedis(b, 10, 1024)
+	benchmarkProfile(b, "set", 10, 1024)
 }
 
 func BenchmarkSetRedis100Conns1KB(b *testing.B) {
-	benchmarkSetRedis(b, 100, 1024)
+	benchmarkProfile(b, "set", 100, 1024)
 }
 
 func BenchmarkSetRedis10Conns10KB(b *testing.B) {
-	benchmarkSetRedis(b, 10, 10*1024)
+	benchmarkProfile(b, "set", 10, 10*1024)
 }
 
 func BenchmarkSetRedis100Conns10KB(b *testing.B) {
-	benchmarkSetRedis(b, 100, 10*1024)
+	benchmarkProfile(b, "set", 100, 10*1024)
 }
 
 func BenchmarkSetRedis10Conns1MB(b *testing.B) {
-	benchmarkSetRedis(b, 10, 1024*1024)
+	benchmarkProfile(b, "set", 10, 1024*1024)
 }
 
 func BenchmarkSetRedis100Conns1MB(b *testing.B) {
-	benchmarkSetRedis(b, 100, 1024*1024)
+	benchmarkProfile(b, "set", 100, 1024*1024)
 }
 
 func BenchmarkRedisSetGetBytes(b *testing.B) {
-	client := benchmarkRedisClient(10)
-	defer client.Close()
-
-	value := bytes.Repeat([]byte{'1'}, 10000)
-
-	b.ResetTimer()
-
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			if err := client.Set("key", value, 0).Err(); err != nil {
-				b.Fatal(err)
-			}
-
-			got, err := client.Get("key").Bytes()
-			if err != nil {
-				b.Fatal(err)
-			}
-			if !bytes.Equal(got, value) {
-				b.Fatalf("got != value")
-			}
-		}
-	})
+	benchmarkProfile(b, "setget", 10, 10000)
 }
 
 func BenchmarkRedisMGet(b *testing.B) {
-	client := benchmarkRedisClient(10)
-	defer client.Close()
+	benchmarkProfile(b, "mget", 10, 32)
+}
 
-	if err := client.MSet("key1", "hello1", "key2", "hello2").Err(); err != nil {
-		b.Fatal(err)
-	}
+func BenchmarkSetExpire(b *testing.B) {
+	benchmarkProfile(b, "setexpire", 10, 32)
+}
 
-	b.ResetTimer()
+func BenchmarkPipeline(b *testing.B) {
+	benchmarkProfile(b, "pipeline", 10, 32)
+}
 
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			if err := client.MGet("key1", "key2").Err(); err != nil {
-				b.Fatal(err)
-			}
-		}
-	})
+func BenchmarkZAdd(b *testing.B) {
+	benchmarkProfile(b, "zadd", 10, 32)
 }
 
-func BenchmarkSetExpire(b *testing.B) {
-	client := benchmarkRedisClient(10)
+// benchmarkBlockingList pushes b.N timestamps from producers onto one list
+// drained by consumers blocked in BRPOP, and reports the wakeup latency.
+func benchmarkBlockingList(b *testing.B, producers, consumers int) {
+	client := benchmarkRedisClient(producers + consumers)
 	defer client.Close()
+	client.Del("list")
+
+	latencies := make(chan time.Duration, b.N)
+	// received is closed with the b.N-th element, stop tells the consumers
+	// to return once their BRPOP does.
+	received := make(chan struct{})
+	stop := make(chan struct{})
+	var consumed int64
+	var wg sync.WaitGroup
+	for i := 0; i < consumers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				vals, err := client.BRPop(time.Second, "list").Result()
+				if err == redis.Nil {
+					continue
+				}
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				sent, err := strconv.ParseInt(vals[1], 10, 64)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				latencies <- time.Duration(time.Now().UnixNano() - sent)
+				if atomic.AddInt64(&consumed, 1) == int64(b.N) {
+					close(received)
+				}
+			}
+		}()
+	}
 
 	b.ResetTimer()
 
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			if err := client.Set("key", "hello", 0).Err(); err != nil {
-				b.Fatal(err)
-			}
-			if err := client.Expire("key", time.Second).Err(); err != nil {
-				b.Fatal(err)
+	var pushed int64
+	var pwg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		pwg.Add(1)
+		go func() {
+			defer pwg.Done()
+			for atomic.AddInt64(&pushed, 1) <= int64(b.N) {
+				now := strconv.FormatInt(time.Now().UnixNano(), 10)
+				if err := client.LPush("list", now).Err(); err != nil {
+					b.Error(err)
+					return
+				}
 			}
-		}
-	})
-}
+		}()
+	}
+	pwg.Wait()
 
-func BenchmarkPipeline(b *testing.B) {
-	client := benchmarkRedisClient(10)
-	defer client.Close()
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+	}
+	b.StopTimer()
 
-	b.ResetTimer()
+	// The idle BRPOPs of the consumers end within their timeout.
+	close(stop)
+	wg.Wait()
+	close(latencies)
 
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
-				pipe.Set("key", "hello", 0)
-				pipe.Expire("key", time.Second)
-				return nil
-			})
-			if err != nil {
-				b.Fatal(err)
-			}
-		}
-	})
+	var sorted []time.Duration
+	for latency := range latencies {
+		sorted = append(sorted, latency)
+	}
+	if len(sorted) != b.N {
+		b.Fatalf("consumed %d of %d elements", len(sorted), b.N)
+	}
+	sorted = sortLatencies(sorted)
+	b.ReportMetric(float64(percentile(sorted, 0.5))/float64(time.Millisecond), "wakeup-p50-ms")
+	b.ReportMetric(float64(percentile(sorted, 0.99))/float64(time.Millisecond), "wakeup-p99-ms")
 }
 
-func BenchmarkZAdd(b *testing.B) {
-	client := benchmarkRedisClient(10)
-	defer client.Close()
+func BenchmarkBlockingList1Producer1Consumer(b *testing.B) {
+	benchmarkBlockingList(b, 1, 1)
+}
 
-	b.ResetTimer()
+func BenchmarkBlockingList10Producers10Consumers(b *testing.B) {
+	benchmarkBlockingList(b, 10, 10)
+}
 
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			if err := client.ZAdd("key", redis.Z{float64(1), "hello"}).Err(); err != nil {
-				b.Fatal(err)
-			}
-		}
-	})
+func BenchmarkBlockingList1Producer100Consumers(b *testing.B) {
+	benchmarkBlockingList(b, 1, 100)
 }
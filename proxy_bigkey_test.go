@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+var (
+	bigValueMax = flag.Int("bigkey.value", 64<<20, "largest string value in bytes written by the big-key specs, up to 512MB")
+	bigElements = flag.Int("bigkey.elements", 1000000, "elements of the big hashes, lists, sets and zsets")
+	bigMGetKeys = flag.Int("bigkey.mget", 10000, "keys of the big MGET")
+	bigTimeout  = flag.Duration("bigkey.timeout", time.Minute, "read and write timeout of the big-key client")
+	bigLatency  = flag.Duration("bigkey.latency", time.Second, "p99 tolerated for small GETs while a big key is served")
+	bigRSSTol   = flag.Int64("bigkey.rss", 64<<20, "proxy memory growth in bytes tolerated once a big key is served")
+)
+
+// bigValueSizes are the string sizes written, up to -bigkey.value.
+var bigValueSizes = []int{1 << 20, 8 << 20, 64 << 20, 128 << 20, 256 << 20, 512 << 20}
+
+// bigImpact is what serving a big key cost the proxy: small GET latency on
+// another connection before and while it was served, and the proxy's
+// memory before, at the peak and once it settled.
+type bigImpact struct {
+	baseline, during            workload.Result
+	memBefore, memPeak, memLast int64
+}
+
+func (i bigImpact) log(name string) {
+	fmt.Fprintf(GinkgoWriter, "%s: small GET p50 %s -> %s, p99 %s -> %s, max %s, errors %d\n",
+		name, i.baseline.P50, i.during.P50, i.baseline.P99, i.during.P99, i.during.Max, i.during.Errors)
+	if i.memBefore > 0 {
+		fmt.Fprintf(GinkgoWriter, "%s: proxy memory %d -> peak %d (+%d) -> %d (+%d)\n",
+			name, i.memBefore, i.memPeak, i.memPeak-i.memBefore, i.memLast, i.memLast-i.memBefore)
+	}
+}
+
+// checksum hashes the elements in order, each terminated by a newline.
+func checksum(elems []string) []byte {
+	h := sha1.New()
+	for _, e := range elems {
+		h.Write([]byte(e))
+		h.Write([]byte{'\n'})
+	}
+	return h.Sum(nil)
+}
+
+func bigMember(i int) string {
+	return fmt.Sprintf("member:%09d", i)
+}
+
+// bigMembers returns the checksum of the members 0 to n-1 in order, which
+// is also their lexicographic order.
+func bigMembers(n int) []byte {
+	h := sha1.New()
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(h, "%s\n", bigMember(i))
+	}
+	return h.Sum(nil)
+}
+
+var _ = Describe("BigKey [slow]", func() {
+	var client, probe, admin *redis.Client
+	var ns *keyspace
+	var collector *stats.Collector
+	var pid int
+	var small string
+
+	// measure runs op while GETs of a small key run on another connection
+	// and the proxy's memory is sampled, then waits for the memory to
+	// settle and fails the spec if the small GETs failed or were slowed
+	// beyond -bigkey.latency, or the memory was not given back.
+	measure := func(name string, op func()) {
+		var impact bigImpact
+		impact.memBefore = proxyMemory(collector, "proxy", pid)
+		impact.memPeak = impact.memBefore
+
+		rec := workload.NewRecorder()
+		var mu sync.Mutex
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				start := time.Now()
+				err := probe.Get(small).Err()
+				mu.Lock()
+				rec.Add(time.Since(start), err)
+				mu.Unlock()
+			}
+		}()
+
+		sampled := make(chan struct{})
+		go func() {
+			defer close(sampled)
+			ticker := time.NewTicker(200 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+				if m := proxyMemory(collector, "proxy", pid); m > impact.memPeak {
+					impact.memPeak = m
+				}
+			}
+		}()
+
+		time.Sleep(time.Second)
+		mu.Lock()
+		impact.baseline = rec.Result()
+		rec = workload.NewRecorder()
+		mu.Unlock()
+
+		collector.Mark(name)
+		func() {
+			// A failure in op panics, the probe must stop anyway.
+			defer func() {
+				close(stop)
+				<-done
+				<-sampled
+			}()
+			op()
+		}()
+		impact.during = rec.Result()
+
+		if impact.memBefore > 0 {
+			Eventually(func() int64 {
+				impact.memLast = proxyMemory(collector, "proxy", pid)
+				return impact.memLast
+			}, 10*time.Second, 200*time.Millisecond).Should(BeNumerically("<=", impact.memBefore+*bigRSSTol),
+				"proxy memory after %s", name)
+		}
+		impact.log(name)
+
+		Expect(impact.during.Errors).To(BeZero(), "small GETs failed while %s: %s", name, impact.during.FirstError)
+		Expect(impact.during.P99).To(BeNumerically("<=", *bigLatency), "small GET p99 while %s", name)
+	}
+
+	// fill adds n elements to a collection in commands of 1000 elements,
+	// 100 commands per pipeline.
+	fill := func(n int, add func(pipe redis.Pipeliner, from, to int)) {
+		const batch, depth = 1000, 100
+		for from := 0; from < n; from += batch * depth {
+			_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+				for i := from; i < n && i < from+batch*depth; i += batch {
+					to := i + batch
+					if to > n {
+						to = n
+					}
+					add(pipe, i, to)
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+	}
+
+	BeforeEach(func() {
+		ns = newKeyspace()
+		client = ns.Wrap(redis.NewClient(&redis.Options{
+			Addr:         proxyAddr,
+			Password:     *proxyPassword,
+			Dialer:       dialerFor(proxyAddr),
+			DialTimeout:  time.Second,
+			ReadTimeout:  *bigTimeout,
+			WriteTimeout: *bigTimeout,
+			PoolSize:     1,
+		}))
+		probe = getRedisClient(proxyAddr, 1)
+		admin = getRedisClient(proxyAddr, 1)
+
+		collector = stats.NewCollector(time.Second)
+		collector.Add("proxy", admin)
+		pid = localProxyPid(collector.ScrapeOne("proxy").Info)
+
+		small = ns.Key("bigkey:small")
+		Expect(probe.Set(small, "hello", 0).Err()).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		ns.Cleanup()
+		Expect(probe.Close()).NotTo(HaveOccurred())
+		Expect(admin.Close()).NotTo(HaveOccurred())
+		Expect(client.Close()).NotTo(HaveOccurred())
+	})
+
+	It("should serve string values of up to -bigkey.value intact", func() {
+		for _, size := range bigValueSizes {
+			if size > *bigValueMax {
+				break
+			}
+			value := make([]byte, size)
+			rand.New(rand.NewSource(int64(size))).Read(value)
+			want := sha1.Sum(value)
+			key := fmt.Sprintf("bigkey:string:%d", size)
+
+			measure(fmt.Sprintf("SET and GET of %dMB", size>>20), func() {
+				Expect(client.Set(key, value, 0).Err()).NotTo(HaveOccurred())
+				Expect(client.StrLen(key).Val()).To(Equal(int64(size)))
+
+				got, err := client.Get(key).Bytes()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(got)).To(Equal(size))
+				Expect(sha1.Sum(got)).To(Equal(want), "checksum of the %dMB value", size>>20)
+
+				tail, err := client.GetRange(key, int64(size-16), -1).Bytes()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(tail).To(Equal(value[size-16:]))
+			})
+			Expect(client.Del(key).Err()).NotTo(HaveOccurred())
+		}
+	})
+
+	It("should serve HGETALL of a hash with -bigkey.elements fields intact", func() {
+		n := *bigElements
+		key := ns.Key("bigkey:hash")
+		fill(n, func(pipe redis.Pipeliner, from, to int) {
+			fields := make(map[string]interface{}, to-from)
+			for i := from; i < to; i++ {
+				fields[bigMember(i)] = i
+			}
+			pipe.HMSet(key, fields)
+		})
+		Expect(client.HLen(key).Val()).To(Equal(int64(n)))
+
+		measure(fmt.Sprintf("HGETALL of %d fields", n), func() {
+			got, err := client.HGetAll(key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(HaveLen(n))
+
+			fields := make([]string, 0, len(got))
+			for field := range got {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			Expect(checksum(fields)).To(Equal(bigMembers(n)), "checksum of the fields")
+			for i := 0; i < n; i += n/100 + 1 {
+				Expect(got[bigMember(i)]).To(Equal(fmt.Sprint(i)))
+			}
+		})
+	})
+
+	It("should serve LRANGE of a list with -bigkey.elements elements in order", func() {
+		n := *bigElements
+		key := ns.Key("bigkey:list")
+		fill(n, func(pipe redis.Pipeliner, from, to int) {
+			values := make([]interface{}, 0, to-from)
+			for i := from; i < to; i++ {
+				values = append(values, bigMember(i))
+			}
+			pipe.RPush(key, values...)
+		})
+		Expect(client.LLen(key).Val()).To(Equal(int64(n)))
+
+		measure(fmt.Sprintf("LRANGE of %d elements", n), func() {
+			got, err := client.LRange(key, 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(HaveLen(n))
+			Expect(checksum(got)).To(Equal(bigMembers(n)), "checksum of the elements in order")
+		})
+	})
+
+	It("should serve SMEMBERS of a set with -bigkey.elements members intact", func() {
+		n := *bigElements
+		key := ns.Key("bigkey:set")
+		fill(n, func(pipe redis.Pipeliner, from, to int) {
+			members := make([]interface{}, 0, to-from)
+			for i := from; i < to; i++ {
+				members = append(members, bigMember(i))
+			}
+			pipe.SAdd(key, members...)
+		})
+		Expect(client.SCard(key).Val()).To(Equal(int64(n)))
+
+		measure(fmt.Sprintf("SMEMBERS of %d members", n), func() {
+			got, err := client.SMembers(key).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(HaveLen(n))
+			sort.Strings(got)
+			Expect(checksum(got)).To(Equal(bigMembers(n)), "checksum of the members")
+		})
+	})
+
+	It("should serve ZRANGE of a zset with -bigkey.elements members in order", func() {
+		n := *bigElements
+		key := ns.Key("bigkey:zset")
+		fill(n, func(pipe redis.Pipeliner, from, to int) {
+			members := make([]redis.Z, 0, to-from)
+			for i := from; i < to; i++ {
+				members = append(members, redis.Z{Score: float64(i), Member: bigMember(i)})
+			}
+			pipe.ZAdd(key, members...)
+		})
+		Expect(client.ZCard(key).Val()).To(Equal(int64(n)))
+
+		measure(fmt.Sprintf("ZRANGE of %d members", n), func() {
+			got, err := client.ZRange(key, 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(HaveLen(n))
+			Expect(checksum(got)).To(Equal(bigMembers(n)), "checksum of the members by score")
+		})
+	})
+
+	It("should serve an MGET of -bigkey.mget keys across shards intact", func() {
+		n := *bigMGetKeys
+		keys := make([]string, n)
+		values := make([]string, n)
+		r := rand.New(rand.NewSource(int64(n)))
+		_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+			for i := range keys {
+				keys[i] = ns.Key(fmt.Sprintf("bigkey:mget:%d", i))
+				value := make([]byte, 1024)
+				r.Read(value)
+				values[i] = string(value)
+				pipe.Set(keys[i], values[i], 0)
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		measure(fmt.Sprintf("MGET of %d keys", n), func() {
+			got, err := client.MGet(keys...).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got).To(HaveLen(n))
+
+			strs := make([]string, n)
+			for i, v := range got {
+				s, ok := v.(string)
+				Expect(ok).To(BeTrue(), "value of %s", keys[i])
+				strs[i] = s
+			}
+			Expect(checksum(strs)).To(Equal(checksum(values)), "checksum of the values in key order")
+		})
+	})
+})
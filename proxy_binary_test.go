@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+)
+
+var binaryKeyLen = flag.Int("binary.keylen", 64<<10, "length in bytes of the longest key written by the binary safety specs")
+
+// binaryCorpus are the bytes most likely to trip a request parser or key
+// hashing: RESP delimiters, NULs, invalid UTF-8 and braces that look like
+// hash tags.
+var binaryCorpus = []struct {
+	name, s string
+}{
+	{"a NUL", "a\x00b"},
+	{"a leading NUL", "\x00key"},
+	{"a trailing NUL", "key\x00"},
+	{"CR/LF", "a\r\nb"},
+	{"a lone CR", "a\rb"},
+	{"a lone LF", "a\nb"},
+	{"a RESP command", "*1\r\n$4\r\nPING\r\n"},
+	{"a RESP length", "$-1\r\n"},
+	{"invalid UTF-8", "\xff\xfe\xc3\x28"},
+	{"a truncated UTF-8 sequence", "key\xe2\x82"},
+	{"every byte", allBytes()},
+	{"a hash tag", "{user1000}.following"},
+	{"an empty hash tag", "{}.following"},
+	{"nested braces", "{{user1000}}"},
+	{"reversed braces", "}user1000{"},
+	{"an unterminated brace", "{user1000"},
+	{"a hash tag with a NUL", "{user\x001000}"},
+	{"spaces and quotes", "a b\t\"c' d"},
+}
+
+// binaryRandom is the number of random byte strings added to the corpus.
+// The entries are generated before flags are parsed, so it is a constant.
+const binaryRandom = 16
+
+func allBytes() string {
+	b := make([]byte, 256)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return string(b)
+}
+
+// binaryEntries returns a table entry per corpus string and per random
+// string. The random strings are seeded by their index, so a failing entry
+// can be rerun with -ginkgo.focus.
+func binaryEntries() []table.TableEntry {
+	var entries []table.TableEntry
+	for _, c := range binaryCorpus {
+		entries = append(entries, table.Entry(c.name, c.s))
+	}
+	for i := 0; i < binaryRandom; i++ {
+		r := rand.New(rand.NewSource(int64(i)))
+		b := make([]byte, 1+r.Intn(64))
+		r.Read(b)
+		entries = append(entries, table.Entry(fmt.Sprintf("random bytes #%d", i), string(b)))
+	}
+	return entries
+}
+
+var _ = Describe("Binary safety", func() {
+	var client *redis.Client
+	var ns *keyspace
+
+	// key returns a key of the keyspace ending with b. The keyspace prefix
+	// has no braces, so hash tags in b stay hash tags.
+	key := func(b string) string {
+		return ns.Key("bin:" + b)
+	}
+
+	// expectOnBackend checks that the backends store exactly key, not a
+	// truncated or unescaped copy of it. Against the external proxy only
+	// masterAddr is known, so the key may be on an unknown master.
+	expectOnBackend := func(key string) {
+		found := int64(0)
+		for _, addr := range masterAddrs() {
+			backend := getRedisClient(addr, 1)
+			n, err := backend.Exists(key).Result()
+			backend.Close()
+			Expect(err).NotTo(HaveOccurred())
+			found += n
+		}
+		if cluster != nil {
+			Expect(found).To(Equal(int64(1)), "backends storing %q", key)
+		} else {
+			Expect(found).To(BeNumerically("<=", 1), "backends storing %q", key)
+		}
+	}
+
+	BeforeEach(func() {
+		ns = newKeyspace()
+		client = getRedisClient(proxyAddr, 1)
+	})
+
+	AfterEach(func() {
+		ns.Cleanup()
+		Expect(client.Close()).NotTo(HaveOccurred())
+	})
+
+	table.DescribeTable("keys",
+		func(b string) {
+			k := key(b)
+			Expect(client.Set(k, "hello", 0).Err()).NotTo(HaveOccurred())
+			expectOnBackend(k)
+
+			Expect(client.Exists(k).Val()).To(Equal(int64(1)))
+			Expect(client.Type(k).Val()).To(Equal("string"))
+			Expect(client.Expire(k, 100*time.Second).Val()).To(BeTrue())
+			Expect(client.TTL(k).Val()).To(BeNumerically(">", 0))
+			Expect(client.Del(k).Val()).To(Equal(int64(1)))
+			Expect(client.Exists(k).Val()).To(BeZero())
+		},
+		binaryEntries()...,
+	)
+
+	table.DescribeTable("strings",
+		func(b string) {
+			k := key(b)
+			Expect(client.Set(k, b, 0).Err()).NotTo(HaveOccurred())
+			Expect(client.Get(k).Result()).To(Equal(b))
+			Expect(client.StrLen(k).Val()).To(Equal(int64(len(b))))
+
+			Expect(client.Append(k, b).Val()).To(Equal(int64(2 * len(b))))
+			Expect(client.Get(k).Result()).To(Equal(b + b))
+			Expect(client.GetRange(k, int64(len(b)), -1).Result()).To(Equal(b))
+
+			Expect(client.GetSet(k, b).Result()).To(Equal(b + b))
+			Expect(client.Get(k).Result()).To(Equal(b))
+		},
+		binaryEntries()...,
+	)
+
+	table.DescribeTable("hashes",
+		func(b string) {
+			k := key(b)
+			Expect(client.HSet(k, b, b).Err()).NotTo(HaveOccurred())
+			Expect(client.HSet(k, "plain", b).Err()).NotTo(HaveOccurred())
+			Expect(client.HGet(k, b).Result()).To(Equal(b))
+			Expect(client.HExists(k, b).Val()).To(BeTrue())
+			Expect(client.HGetAll(k).Result()).To(Equal(map[string]string{b: b, "plain": b}))
+			Expect(client.HKeys(k).Result()).To(ConsistOf(b, "plain"))
+			Expect(client.HDel(k, b).Val()).To(Equal(int64(1)))
+			Expect(client.HGetAll(k).Result()).To(Equal(map[string]string{"plain": b}))
+		},
+		binaryEntries()...,
+	)
+
+	table.DescribeTable("lists",
+		func(b string) {
+			k := key(b)
+			Expect(client.RPush(k, b, "x"+b, b+"x").Err()).NotTo(HaveOccurred())
+			Expect(client.LRange(k, 0, -1).Result()).To(Equal([]string{b, "x" + b, b + "x"}))
+			Expect(client.LIndex(k, 1).Result()).To(Equal("x" + b))
+			Expect(client.LRem(k, 0, b).Val()).To(Equal(int64(1)))
+			Expect(client.LPop(k).Result()).To(Equal("x" + b))
+			Expect(client.RPop(k).Result()).To(Equal(b + "x"))
+		},
+		binaryEntries()...,
+	)
+
+	table.DescribeTable("sets",
+		func(b string) {
+			k := key(b)
+			Expect(client.SAdd(k, b, "x"+b).Err()).NotTo(HaveOccurred())
+			Expect(client.SIsMember(k, b).Val()).To(BeTrue())
+			Expect(client.SMembers(k).Result()).To(ConsistOf(b, "x"+b))
+			Expect(client.SRem(k, b).Val()).To(Equal(int64(1)))
+			Expect(client.SMembers(k).Result()).To(ConsistOf("x" + b))
+		},
+		binaryEntries()...,
+	)
+
+	table.DescribeTable("sorted sets",
+		func(b string) {
+			k := key(b)
+			Expect(client.ZAdd(k, redis.Z{Score: 1, Member: b}, redis.Z{Score: 2, Member: "x" + b}).Err()).NotTo(HaveOccurred())
+			Expect(client.ZScore(k, b).Val()).To(Equal(float64(1)))
+			Expect(client.ZRange(k, 0, -1).Result()).To(Equal([]string{b, "x" + b}))
+			Expect(client.ZRank(k, "x"+b).Val()).To(Equal(int64(1)))
+			Expect(client.ZRem(k, b).Val()).To(Equal(int64(1)))
+			Expect(client.ZRange(k, 0, -1).Result()).To(Equal([]string{"x" + b}))
+		},
+		binaryEntries()...,
+	)
+
+	// The empty key cannot be put in a keyspace, so the spec overwrites and
+	// deletes the shared "" key and only runs where that is allowed.
+	It("should round-trip an empty key [destructive]", func() {
+		requireDestructive()
+		defer client.Del("")
+
+		Expect(client.Set("", "empty", 0).Err()).NotTo(HaveOccurred())
+		expectOnBackend("")
+		Expect(client.Get("").Result()).To(Equal("empty"))
+		Expect(client.Del("").Val()).To(Equal(int64(1)))
+	})
+
+	It("should round-trip an empty value", func() {
+		k := key("empty")
+		Expect(client.Set(k, "", 0).Err()).NotTo(HaveOccurred())
+		Expect(client.Get(k).Result()).To(Equal(""))
+		Expect(client.StrLen(k).Val()).To(BeZero())
+	})
+
+	It("should round-trip a key of -binary.keylen bytes", func() {
+		r := rand.New(rand.NewSource(int64(*binaryKeyLen)))
+		b := make([]byte, *binaryKeyLen)
+		r.Read(b)
+		k := key(string(b))
+
+		Expect(client.Set(k, "long", 0).Err()).NotTo(HaveOccurred())
+		expectOnBackend(k)
+		Expect(client.Get(k).Result()).To(Equal("long"))
+		Expect(client.Del(k).Val()).To(Equal(int64(1)))
+	})
+
+	It("should round-trip binary keys in raw RESP", func() {
+		conn, err := dialProxy()
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		for _, c := range binaryCorpus {
+			k := key(c.s)
+			Expect(writeRaw(conn, []string{"SET", k, c.s}, []string{"GET", k})).To(Succeed())
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		for _, c := range binaryCorpus {
+			Expect(readReply(r)).To(Equal("OK"), c.name)
+			Expect(readReply(r)).To(Equal([]byte(c.s)), c.name)
+		}
+	})
+
+	It("should not split a request on bytes that look like RESP", func() {
+		k := key("resp")
+		v := strings.Repeat("*2\r\n$3\r\nDEL\r\n", 100)
+		Expect(client.Set(k, v, 0).Err()).NotTo(HaveOccurred())
+		Expect(client.Get(k).Result()).To(Equal(v))
+		Expect(client.Ping().Val()).To(Equal("PONG"))
+	})
+})
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+
+	"github.com/lidaohang/test-redis-ngproxy/supervisor"
+	"github.com/lidaohang/test-redis-ngproxy/target"
+)
+
+var topologyPath = flag.String("ngproxy.topology", "",
+	"topology file of a proxy and backends to launch locally instead of using the external ones")
+
+// suite is the proxy and backends the suite runs against, cluster its
+// supervised topology, nil when testing against the externally managed
+// proxy.
+var (
+	suite   *target.Target
+	cluster *supervisor.Supervisor
+)
+
+// startCluster launches the topology from -ngproxy.topology, or configures
+// TLS to the external proxy, and points proxyAddr, masterAddr, slaveAddr,
+// the passwords and the TLS configs at the result.
+func startCluster() error {
+	suite = &target.Target{
+		Topology:        *topologyPath,
+		Proxy:           proxyAddr,
+		Master:          masterAddr,
+		Slave:           slaveAddr,
+		PlainProxy:      *plainProxyAddr,
+		Password:        *proxyPassword,
+		BackendPassword: *backendPassword,
+		TLS:             *tlsEnabled,
+		TLSCA:           *tlsCA,
+		TLSServerName:   *tlsServerName,
+	}
+	if err := suite.Start(); err != nil {
+		return err
+	}
+	cluster = suite.Cluster
+
+	proxyAddr, masterAddr, slaveAddr = suite.Proxy, suite.Master, suite.Slave
+	*plainProxyAddr = suite.PlainProxy
+	*proxyPassword, *backendPassword = suite.Password, suite.BackendPassword
+	proxyTLS, backendTLS = suite.ProxyTLS, suite.BackendTLS
+	return nil
+}
+
+func stopCluster() {
+	if err := suite.Stop(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// TestMain owns the supervised topology instead of BeforeSuite/AfterSuite,
+// because the benchmarks run outside of the ginkgo suite and need the same
+// processes. Interrupted runs still tear everything down.
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	if err := startCluster(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		stopCluster()
+		os.Exit(1)
+	}()
+
+	code := m.Run()
+	stopCluster()
+	os.Exit(code)
+}
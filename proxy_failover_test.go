@@ -0,0 +1,387 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+	logging "github.com/op/go-logging"
+
+	"github.com/lidaohang/test-redis-ngproxy/chaos"
+	"github.com/lidaohang/test-redis-ngproxy/relay"
+	"github.com/lidaohang/test-redis-ngproxy/report"
+	"github.com/lidaohang/test-redis-ngproxy/supervisor"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+// Specs tagged [destructive] shut down, pause or flush backends and only run
+// with -ngproxy.destructive, so that a plain run never harms a shared
+// environment.
+var destructive = flag.Bool("ngproxy.destructive", false, "run the [destructive] specs")
+
+// requireDestructive skips the current spec without -ngproxy.destructive.
+func requireDestructive() {
+	if !*destructive {
+		Skip("requires -ngproxy.destructive")
+	}
+}
+
+// faultReport adds the logging, the HTML report and the expectations of
+// the suite to the outcome of a fault scenario.
+type faultReport struct {
+	*chaos.FaultReport
+}
+
+func (r faultReport) log(logger *logging.Logger) {
+	for phase := chaos.PhaseBefore; phase <= chaos.PhaseSettled; phase++ {
+		for _, shard := range []struct {
+			name string
+			r    workload.Result
+		}{{"faulty", r.Faulty[phase]}, {"healthy", r.Healthy[phase]}} {
+			if shard.r.Ops == 0 {
+				continue
+			}
+			line := fmt.Sprintf("%s %s/%s: ops=%d timeouts=%d proxy_errors=%d other_errors=%d p50=%s p99=%s max=%s",
+				r.Name, chaos.PhaseNames[phase], shard.name, shard.r.Ops,
+				shard.r.Timeouts, shard.r.ReplyErrors, otherErrors(shard.r),
+				shard.r.P50, shard.r.P99, shard.r.Max)
+			logger.Info(line)
+			fmt.Fprintln(GinkgoWriter, line)
+		}
+	}
+
+	line := fmt.Sprintf("%s: faulty shard recovered %s after the fault was healed", r.Name, r.Recovered)
+	if !r.RecoveredOK {
+		line = fmt.Sprintf("%s: faulty shard did not recover", r.Name)
+	}
+	logger.Info(line)
+	fmt.Fprintln(GinkgoWriter, line)
+
+	if r.Reconnects >= 0 {
+		line = fmt.Sprintf("%s: %d backend reconnections", r.Name, r.Reconnects)
+		logger.Info(line)
+		fmt.Fprintln(GinkgoWriter, line)
+	}
+}
+
+// otherErrors returns the errors of r that were neither timeouts nor error
+// replies.
+func otherErrors(r workload.Result) int64 {
+	return r.Errors - r.Timeouts - r.ReplyErrors
+}
+
+// writeHTML writes the timelines of both shards, the fault and the pool
+// stats of the proxy to -report.dir.
+func (r faultReport) writeHTML() (string, error) {
+	summary := &report.Table{Columns: []string{"shard", "phase", "ops", "timeouts", "proxy errors", "other errors", "p50", "p99", "max"}}
+	for phase := chaos.PhaseBefore; phase <= chaos.PhaseSettled; phase++ {
+		for _, shard := range []struct {
+			name string
+			r    workload.Result
+		}{{"faulty", r.Faulty[phase]}, {"healthy", r.Healthy[phase]}} {
+			if shard.r.Ops == 0 {
+				continue
+			}
+			summary.Rows = append(summary.Rows, []string{
+				shard.name, chaos.PhaseNames[phase], fmt.Sprint(shard.r.Ops),
+				fmt.Sprint(shard.r.Timeouts), fmt.Sprint(shard.r.ReplyErrors), fmt.Sprint(otherErrors(shard.r)),
+				shard.r.P50.String(), shard.r.P99.String(), shard.r.Max.String(),
+			})
+		}
+	}
+
+	return report.WriteFile(*reportDir, "failover_"+r.Name, &report.Run{
+		Title:   "Failover: " + r.Name,
+		Started: r.Started,
+		Summary: summary,
+		Series: []report.Series{
+			{Name: "faulty", Points: r.FaultyTimeline},
+			{Name: "healthy", Points: r.HealthyTimeline},
+		},
+		Events: r.Collector.Events(),
+		Pool:   r.Collector.Samples("proxy"),
+	})
+}
+
+// expectRecovered fails the spec unless the workload ran without errors
+// before the fault, the faulty shard served again within -fault.recover of
+// the fault being healed, its errors stopped by then and neither shard
+// failed during -fault.settle after the recovery. Errors while the fault
+// lasts are expected.
+func (r faultReport) expectRecovered() {
+	Expect(r.Faulty[chaos.PhaseBefore].Errors).To(BeZero(), "errors on the faulty shard before the fault")
+	Expect(r.Healthy[chaos.PhaseBefore].Errors).To(BeZero(), "errors on the healthy shard before the fault")
+	Expect(r.RecoveredOK).To(BeTrue(), "the faulty shard did not recover")
+	Expect(r.Recovered).To(BeNumerically("<=", *faultRecover))
+	Expect(r.LastError).To(BeNumerically("<=", *faultRecover), "errors on the faulty shard after the fault was healed")
+	Expect(r.Faulty[chaos.PhaseSettled].Ops).NotTo(BeZero(), "no workload after the recovery")
+	Expect(r.Faulty[chaos.PhaseSettled].Errors).To(BeZero(), "errors on the faulty shard after the recovery")
+	Expect(r.Healthy[chaos.PhaseSettled].Errors).To(BeZero(), "errors on the healthy shard after the recovery")
+}
+
+// expectReconnects fails the spec unless the proxy reconnected to its
+// backends exactly n times over the scenario. A proxy whose INFO has no
+// backend_reconnections fails it rather than passing as zero reconnects.
+func (r faultReport) expectReconnects(n int64) {
+	Expect(r.Reconnects).NotTo(BeNumerically("<", 0), "backend_reconnections was not scraped or is missing from the proxy's INFO")
+	Expect(r.Reconnects).To(Equal(n), "backend reconnections")
+}
+
+// expectReconnectsAtMost fails the spec if the proxy reconnected to its
+// backends more than n times over the scenario, for faults that a proxy
+// may ride out on its existing connections, e.g. latency or a sleep
+// shorter than its backend timeout.
+func (r faultReport) expectReconnectsAtMost(n int64) {
+	Expect(r.Reconnects).NotTo(BeNumerically("<", 0), "backend_reconnections was not scraped or is missing from the proxy's INFO")
+	Expect(r.Reconnects).To(BeNumerically("<=", n), "backend reconnections")
+}
+
+// expectNoErrors fails the spec on any error in any phase, for faults the
+// proxy is expected to hide completely.
+func (r faultReport) expectNoErrors() {
+	for phase := chaos.PhaseBefore; phase <= chaos.PhaseSettled; phase++ {
+		Expect(r.Faulty[phase].Errors).To(BeZero(), "errors on the faulty shard %s the fault", chaos.PhaseNames[phase])
+		Expect(r.Healthy[phase].Errors).To(BeZero(), "errors on the healthy shard %s the fault", chaos.PhaseNames[phase])
+	}
+}
+
+// runFaultScenario runs SET on a key of the faulty master and on a key of
+// another shard, each over its own client so that only the proxy can
+// couple them, through chaos.RunFault with the -fault flags. Errors of the
+// workload are reported instead of failing the spec, errors of inject and
+// heal fail it.
+func runFaultScenario(name, faultyAddr string, inject, heal func() error) faultReport {
+	logger, _ := getLogger("failover_"+name+".log", name)
+
+	faultyKey, err := keyOn(name, faultyAddr)
+	Expect(err).NotTo(HaveOccurred())
+	healthyKey, err := keyOff(name, faultyAddr)
+	if err != nil {
+		logger.Warning(err)
+		healthyKey = ""
+	}
+
+	faulty := chaos.Workload{
+		Client:  getRedisClient(proxyAddr, 10),
+		Profile: workload.Profiles["set"],
+		Options: workload.Options{Clients: 10, Payload: 32, Key: faultyKey},
+	}
+	defer faulty.Client.Close()
+
+	var healthy chaos.Workload
+	if healthyKey != "" {
+		healthy = faulty
+		healthy.Client = getRedisClient(proxyAddr, 10)
+		healthy.Options.Key = healthyKey
+		defer healthy.Client.Close()
+	}
+
+	r := faultReport{chaos.RunFault(chaos.Fault{
+		Name:    name,
+		Inject:  inject,
+		Heal:    heal,
+		After:   *faultAfter,
+		For:     *faultFor,
+		Recover: *faultRecover,
+		Settle:  *faultSettle,
+	}, faulty, healthy)}
+
+	logStatsDelta(logger, r.Collector, "proxy", name)
+	r.log(logger)
+	if *reportDir != "" {
+		path, err := r.writeHTML()
+		if err != nil {
+			logger.Warning(err)
+		} else {
+			fmt.Fprintln(GinkgoWriter, "report written to", path)
+		}
+	}
+
+	Expect(r.InjectErr).NotTo(HaveOccurred())
+	Expect(r.HealErr).NotTo(HaveOccurred())
+	return r
+}
+
+// shutdownFault stops node and restarts it when healed. Without a
+// supervised topology it sends SHUTDOWN to addr and the node stays down.
+func shutdownFault(node *supervisor.Node, addr string) (inject, heal func() error) {
+	if node != nil {
+		return node.Stop, node.Restart
+	}
+
+	client := getRedisClient(addr, 1)
+	inject = func() error {
+		defer client.Close()
+		// The connection is closed by the exiting server.
+		client.Shutdown()
+		return nil
+	}
+	heal = func() error { return nil }
+	return inject, heal
+}
+
+// clusterNode returns the supervised node at addr, nil without a topology.
+func clusterNode(addr string) *supervisor.Node {
+	if cluster == nil {
+		return nil
+	}
+	for _, node := range cluster.Nodes() {
+		if node.Addr == addr {
+			return node
+		}
+	}
+	return nil
+}
+
+// relayedMaster returns the first master that the proxy reaches through a
+// relay, see config.Shard.Relay.
+func relayedMaster() (*supervisor.Node, *relay.Relay) {
+	for _, master := range cluster.Masters {
+		if r := cluster.Relay(master.Shard); r != nil {
+			return master, r
+		}
+	}
+	Skip("requires a shard with relay: true in the topology")
+	return nil, nil
+}
+
+var _ = Describe("Failover [destructive] [slow]", func() {
+	BeforeEach(func() {
+		requireDestructive()
+	})
+
+	requireTopology := func() {
+		if cluster == nil {
+			Skip("requires -ngproxy.topology")
+		}
+	}
+
+	/*
+		压测SET一分钟然后下掉master节点
+	*/
+	It("should recover from a master shutdown", func() {
+		inject, heal := shutdownFault(clusterNode(masterAddr), masterAddr)
+		report := runFaultScenario("master_shutdown", masterAddr, inject, heal)
+		report.expectRecovered()
+		report.expectReconnects(1)
+	})
+
+	/*
+		压测SET一分钟然后下掉slave节点，写master不应受影响
+	*/
+	It("should not notice a slave shutdown", func() {
+		inject, heal := shutdownFault(clusterNode(slaveAddr), slaveAddr)
+		runFaultScenario("slave_shutdown", masterAddr, inject, heal).expectNoErrors()
+	})
+
+	/*
+		压测SET一分钟然后下掉master,slave节点
+	*/
+	It("should recover from a shutdown of both master and slave", func() {
+		injectMaster, healMaster := shutdownFault(clusterNode(masterAddr), masterAddr)
+		injectSlave, healSlave := shutdownFault(clusterNode(slaveAddr), slaveAddr)
+		inject := func() error {
+			if err := injectMaster(); err != nil {
+				return err
+			}
+			return injectSlave()
+		}
+		heal := func() error {
+			if err := healMaster(); err != nil {
+				return err
+			}
+			return healSlave()
+		}
+		runFaultScenario("master_slave_shutdown", masterAddr, inject, heal).expectRecovered()
+	})
+
+	/*
+		压测SET一分钟然后用SIGSTOP冻结master节点，-fault.for 之后恢复
+	*/
+	It("should recover from a paused master", func() {
+		requireTopology()
+
+		master := cluster.Masters[0]
+		report := runFaultScenario("master_pause", master.Addr, master.Pause, master.Resume)
+		report.expectRecovered()
+		report.expectReconnectsAtMost(1)
+	})
+
+	/*
+		压测SET一分钟然后让master执行DEBUG SLEEP -fault.for
+	*/
+	It("should recover from a master in DEBUG SLEEP", func() {
+		clientMaster := redis.NewClient(&redis.Options{
+			Addr:        masterAddr,
+			Password:    *backendPassword,
+			Dialer:      dialerFor(masterAddr),
+			DialTimeout: time.Second,
+			ReadTimeout: *faultFor + 5*time.Second,
+		})
+		defer clientMaster.Close()
+
+		sleeping := make(chan error, 1)
+		inject := func() error {
+			go func() {
+				sleeping <- doCmd(clientMaster, "DEBUG", "SLEEP", faultFor.Seconds()).Err()
+			}()
+			return nil
+		}
+		heal := func() error {
+			select {
+			case err := <-sleeping:
+				return err
+			case <-time.After(5 * time.Second):
+				return fmt.Errorf("DEBUG SLEEP did not return")
+			}
+		}
+
+		report := runFaultScenario("master_debug_sleep", masterAddr, inject, heal)
+		report.expectRecovered()
+		report.expectReconnectsAtMost(1)
+	})
+
+	/*
+		压测SET一分钟然后在代理和master之间注入 -fault.latency 的延迟
+	*/
+	It("should recover from a slow backend", func() {
+		requireTopology()
+
+		master, r := relayedMaster()
+		inject := func() error {
+			r.SetLatency(*slowLatency)
+			return nil
+		}
+		heal := func() error {
+			r.SetLatency(0)
+			return nil
+		}
+
+		report := runFaultScenario("slow_backend", master.Addr, inject, heal)
+		report.expectRecovered()
+		report.expectReconnectsAtMost(1)
+	})
+
+	/*
+		压测SET一分钟然后让代理和master之间的连接停止转发数据
+	*/
+	It("should recover from a stalled backend", func() {
+		requireTopology()
+
+		master, r := relayedMaster()
+		inject := func() error {
+			r.Stall()
+			return nil
+		}
+		heal := func() error {
+			r.Unstall()
+			return nil
+		}
+
+		runFaultScenario("backend_stall", master.Addr, inject, heal).expectRecovered()
+	})
+})
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// percentile returns the p-th percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+func sortLatencies(latencies []time.Duration) []time.Duration {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies
+}
+
+// slowShardAddr returns the master slowed down by slowShard.
+func slowShardAddr() string {
+	if cluster != nil {
+		for _, master := range cluster.Masters {
+			if cluster.Relay(master.Shard) != nil {
+				return master.Addr
+			}
+		}
+	}
+	return masterAddr
+}
+
+// slowShard slows down the master at slowShardAddr and returns a function
+// that restores it. Through a relay only the proxy's link is slowed,
+// otherwise the master itself is kept busy with DEBUG SLEEP, which stalls
+// a shared backend and so requires -ngproxy.destructive.
+func slowShard(b *testing.B) func() {
+	if cluster != nil {
+		for _, master := range cluster.Masters {
+			if r := cluster.Relay(master.Shard); r != nil {
+				r.SetLatency(*slowLatency)
+				return func() { r.SetLatency(0) }
+			}
+		}
+	}
+
+	if !*destructive {
+		b.Skip("requires a shard with relay: true in the topology or -ngproxy.destructive")
+	}
+
+	clientMaster := redis.NewClient(&redis.Options{
+		Addr:        masterAddr,
+		Password:    *backendPassword,
+		Dialer:      dialerFor(masterAddr),
+		DialTimeout: time.Second,
+		ReadTimeout: *slowLatency + 5*time.Second,
+	})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := doCmd(clientMaster, "DEBUG", "SLEEP", slowLatency.Seconds()).Err(); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		clientMaster.Close()
+	}
+}
+
+// measureGet runs n GETs of key and returns the sorted latencies and how
+// many of the GETs failed. Failed GETs count with the time they took.
+func measureGet(client *redis.Client, key string, n int) ([]time.Duration, int) {
+	latencies := make([]time.Duration, 0, n)
+	errors := 0
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		if err := client.Get(key).Err(); err != nil {
+			errors++
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	return sortLatencies(latencies), errors
+}
+
+// benchmarkHeadOfLine measures GET latency on a healthy shard while 10
+// goroutines hammer a slowed shard through the same proxy. With shared set
+// both workloads use the same client, so the measured GETs also wait for
+// pooled connections held by the slow ones. Otherwise the measured GETs
+// have a connection of their own and only the proxy couples them to the
+// slow shard.
+func benchmarkHeadOfLine(b *testing.B, shared bool) {
+	var healthyClient, slowClient *redis.Client
+	if shared {
+		healthyClient = getRedisClient(proxyAddr, 11)
+		slowClient = healthyClient
+	} else {
+		healthyClient = getRedisClient(proxyAddr, 1)
+		slowClient = getRedisClient(proxyAddr, 10)
+		defer slowClient.Close()
+	}
+	defer healthyClient.Close()
+
+	slowAddr := slowShardAddr()
+	slowKey, err := keyOn("hol", slowAddr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	healthyKey, err := keyOff("hol", slowAddr)
+	if err != nil {
+		b.Skip(err)
+	}
+	for _, key := range []string{slowKey, healthyKey} {
+		if err := healthyClient.Set(key, "hello", 0).Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer healthyClient.Del(slowKey, healthyKey)
+
+	baseline, baselineErrors := measureGet(healthyClient, healthyKey, 1000)
+	if baselineErrors > 0 {
+		b.Fatalf("%d of 1000 GETs failed before the shard was slowed", baselineErrors)
+	}
+
+	restore := slowShard(b)
+	defer restore()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Errors are expected once the slow shard times out.
+				slowClient.Get(slowKey)
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	latencies, errors := measureGet(healthyClient, healthyKey, b.N)
+	b.StopTimer()
+
+	close(stop)
+	wg.Wait()
+
+	b.ReportMetric(float64(percentile(baseline, 0.99))/float64(time.Millisecond), "baseline-p99-ms")
+	b.ReportMetric(float64(percentile(latencies, 0.5))/float64(time.Millisecond), "p50-ms")
+	b.ReportMetric(float64(percentile(latencies, 0.99))/float64(time.Millisecond), "p99-ms")
+	b.ReportMetric(float64(percentile(latencies, 0.99))/float64(percentile(baseline, 0.99)), "p99-inflation")
+	b.ReportMetric(float64(errors), "errors")
+}
+
+func BenchmarkHeadOfLineSeparateConns(b *testing.B) {
+	benchmarkHeadOfLine(b, false)
+}
+
+func BenchmarkHeadOfLineSharedConns(b *testing.B) {
+	benchmarkHeadOfLine(b, true)
+}
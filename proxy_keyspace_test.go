@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+)
+
+// keyspace gives a spec its own key prefix, so that specs neither see each
+// other's leftovers nor collide when ginkgo -p runs them in parallel
+// against a shared proxy.
+type keyspace struct {
+	prefix string
+
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+var keyspaceSeq int64
+
+// newKeyspace returns a keyspace unique to this process and spec.
+func newKeyspace() *keyspace {
+	n := atomic.AddInt64(&keyspaceSeq, 1)
+	return &keyspace{
+		prefix: fmt.Sprintf("t%d.%d:", os.Getpid(), n),
+		keys:   make(map[string]bool),
+	}
+}
+
+// Key returns name inside the keyspace and remembers it for Cleanup. Names
+// already inside the keyspace are returned as they are.
+func (ks *keyspace) Key(name string) string {
+	if !strings.HasPrefix(name, ks.prefix) {
+		name = ks.prefix + name
+	}
+	ks.Track(name)
+	return name
+}
+
+// Track remembers key for Cleanup as it is, for keys that were built from
+// Key elsewhere, e.g. by keyOn.
+func (ks *keyspace) Track(key string) {
+	ks.mu.Lock()
+	ks.keys[key] = true
+	ks.mu.Unlock()
+}
+
+// Wrap moves the keys of every command processed by client into the
+// keyspace. Pipelines and transactions bypass WrapProcess, their keys must
+// come from Key. It fails the spec unless the key positions of COMMAND and
+// the arguments of go-redis commands can be read, since otherwise keys
+// would silently leave the keyspace.
+func (ks *keyspace) Wrap(client *redis.Client) *redis.Client {
+	Expect(loadCommandInfos()).To(Succeed(), "keyspace: no key positions")
+	_, err := cmdArgs(redis.NewStatusCmd("PING"))
+	Expect(err).NotTo(HaveOccurred())
+
+	client.WrapProcess(func(old func(redis.Cmder) error) func(redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			args, err := cmdArgs(cmd)
+			if err != nil {
+				// Not sent, its keys would leave the keyspace.
+				return err
+			}
+			for _, i := range keyPositions(args) {
+				if key, ok := args[i].(string); ok {
+					args[i] = ks.Key(key)
+				}
+			}
+			return old(cmd)
+		}
+	})
+	return client
+}
+
+// Cleanup deletes every key of the keyspace.
+func (ks *keyspace) Cleanup() {
+	client := getRedisClient(proxyAddr, 1)
+	defer client.Close()
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	// One at a time, a multi-key DEL may be refused across shards.
+	for key := range ks.keys {
+		client.Del(key)
+	}
+	ks.keys = make(map[string]bool)
+}
+
+// cmdArgs returns the arguments of cmd, shared with cmd. The vendored
+// go-redis keeps them unexported; newer versions have Cmder.Args. A
+// go-redis that lays out its commands differently is an error, since no
+// key would be moved into the keyspace.
+func cmdArgs(cmd redis.Cmder) ([]interface{}, error) {
+	v := reflect.ValueOf(cmd).Elem().FieldByName("_args")
+	if !v.IsValid() {
+		return nil, fmt.Errorf("keyspace: %T has no _args field", cmd)
+	}
+	return *(*[]interface{})(unsafe.Pointer(v.UnsafeAddr())), nil
+}
+
+var (
+	commandInfosOnce sync.Once
+	commandInfos     map[string]*redis.CommandInfo
+	commandInfosErr  error
+)
+
+// loadCommandInfos loads the key positions of every command from COMMAND,
+// asked of the master first since the proxy may not implement it.
+func loadCommandInfos() error {
+	commandInfosOnce.Do(func() {
+		for _, addr := range []string{masterAddr, proxyAddr} {
+			client := getRedisClient(addr, 1)
+			infos, err := client.Command().Result()
+			client.Close()
+			if err == nil {
+				commandInfos, commandInfosErr = infos, nil
+				return
+			}
+			commandInfosErr = fmt.Errorf("COMMAND on %s: %s", addr, err)
+		}
+	})
+	return commandInfosErr
+}
+
+// keyPositions returns the indexes of the keys in args, including the
+// keys that COMMAND cannot describe, like the numkeys of EVAL and the
+// STORE of SORT.
+func keyPositions(args []interface{}) []int {
+	if len(args) < 2 {
+		return nil
+	}
+	name := strings.ToLower(fmt.Sprint(args[0]))
+
+	var positions []int
+	// numKeys adds the keys counted by the argument at i.
+	numKeys := func(i int) {
+		if i >= len(args) {
+			return
+		}
+		n, _ := strconv.Atoi(fmt.Sprint(args[i]))
+		for j := i + 1; j <= i+n && j < len(args); j++ {
+			positions = append(positions, j)
+		}
+	}
+	// after adds the argument following any of the options.
+	after := func(options ...string) {
+		for i := 2; i < len(args)-1; i++ {
+			for _, option := range options {
+				if strings.EqualFold(fmt.Sprint(args[i]), option) {
+					positions = append(positions, i+1)
+				}
+			}
+		}
+	}
+
+	switch name {
+	case "eval", "evalsha":
+		numKeys(2)
+		return positions
+	case "zunionstore", "zinterstore":
+		positions = append(positions, 1)
+		numKeys(2)
+		return positions
+	case "sort":
+		// BY and GET patterns name keys too.
+		positions = append(positions, 1)
+		after("BY", "GET", "STORE")
+		filtered := positions[:0]
+		for _, i := range positions {
+			if s := fmt.Sprint(args[i]); s != "#" && !strings.EqualFold(s, "nosort") {
+				filtered = append(filtered, i)
+			}
+		}
+		return filtered
+	case "georadius", "georadiusbymember":
+		positions = append(positions, 1)
+		after("STORE", "STOREDIST")
+		return positions
+	}
+
+	info := commandInfos[name]
+	if info == nil {
+		// Unknown to the backends, e.g. a command of the proxy itself.
+		return []int{1}
+	}
+	first, last, step := int(info.FirstKeyPos), int(info.LastKeyPos), int(info.StepCount)
+	if first <= 0 || step <= 0 {
+		return nil
+	}
+	if last < 0 {
+		last += len(args)
+	}
+	for i := first; i <= last && i < len(args); i += step {
+		positions = append(positions, i)
+	}
+	return positions
+}
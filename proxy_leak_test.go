@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+)
+
+var (
+	proxyPid   = flag.Int("ngproxy.pid", 0, "pid of a locally launched ngproxy, enables /proc leak checks")
+	leakConns  = flag.Int("leak.conns", 2000, "number of client connections opened by the leak specs")
+	leakRSSTol = flag.Int64("leak.rss", 16<<20, "RSS growth in bytes tolerated by the leak specs")
+)
+
+// localProxyPid returns the pid of the proxy process if it runs on this
+// host, either from -ngproxy.pid, from the supervisor or from the proxy's
+// INFO process_id.
+func localProxyPid(info *stats.Info) int {
+	if *proxyPid != 0 {
+		return *proxyPid
+	}
+	if cluster != nil {
+		return cluster.Proxy.Pid()
+	}
+
+	host, _, err := net.SplitHostPort(proxyAddr)
+	if err != nil {
+		return 0
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return 0
+	}
+	if info == nil || info.Server.ProcessID == 0 {
+		return 0
+	}
+	if _, err := os.Stat(fmt.Sprintf("/proc/%d", info.Server.ProcessID)); err != nil {
+		return 0
+	}
+	return int(info.Server.ProcessID)
+}
+
+// proxyMemory returns the resident memory of the proxy scraped as name by
+// collector, from /proc when pid is known and from its INFO otherwise, 0 if
+// neither is known.
+func proxyMemory(collector *stats.Collector, name string, pid int) int64 {
+	if pid != 0 {
+		if p, err := stats.ReadProc(pid); err == nil {
+			return p.RSS
+		}
+	}
+	s := collector.ScrapeOne(name)
+	if s.Info == nil {
+		return 0
+	}
+	if s.Info.Memory.UsedMemoryRss != 0 {
+		return s.Info.Memory.UsedMemoryRss
+	}
+	return s.Info.Memory.UsedMemory
+}
+
+// connectedClients scrapes connected_clients of the proxy scraped as name
+// by collector, an error if the scrape failed.
+func connectedClients(collector *stats.Collector, name string) (int64, error) {
+	s := collector.ScrapeOne(name)
+	if s.Err != nil {
+		return 0, s.Err
+	}
+	if s.Info == nil {
+		return 0, fmt.Errorf("%s: no INFO scraped", name)
+	}
+	return s.Info.Clients.ConnectedClients, nil
+}
+
+var _ = Describe("Leak [slow]", func() {
+	var admin *redis.Client
+	var collector *stats.Collector
+	var pid int
+	var baseline stats.Proc
+	var procs []stats.Proc
+
+	sampleProc := func() stats.Proc {
+		p, err := stats.ReadProc(pid)
+		Expect(err).NotTo(HaveOccurred())
+		procs = append(procs, p)
+		return p
+	}
+
+	// churn runs fn n times over at most 50 goroutines.
+	churn := func(n int, fn func(i int)) {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, 50)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				defer func() { <-sem }()
+				fn(i)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	BeforeEach(func() {
+		admin = getRedisClient(proxyAddr, 1)
+
+		collector = stats.NewCollector(500 * time.Millisecond)
+		collector.Add("proxy", admin)
+		collector.Start()
+
+		procs = nil
+		pid = localProxyPid(collector.First("proxy"))
+		if pid != 0 {
+			baseline = sampleProc()
+		}
+	})
+
+	AfterEach(func() {
+		// Deferred, so that a failed expectation below still stops the
+		// collector before its admin client is closed.
+		defer admin.Close()
+		defer collector.Stop()
+
+		collector.Mark("churn done")
+
+		base := collector.First("proxy")
+		Expect(base).NotTo(BeNil())
+
+		Eventually(func() (int64, error) {
+			return connectedClients(collector, "proxy")
+		}, 10*time.Second, 200*time.Millisecond).Should(Equal(base.Clients.ConnectedClients))
+
+		if pid != 0 {
+			Eventually(func() int {
+				return sampleProc().FDs
+			}, 10*time.Second, 200*time.Millisecond).Should(BeNumerically("<=", baseline.FDs))
+
+			Expect(sampleProc().RSS).To(BeNumerically("<=", baseline.RSS+*leakRSSTol))
+
+			for _, p := range procs {
+				fmt.Fprintf(GinkgoWriter, "%s fds=%d rss=%d\n", p.Time.Format("15:04:05.000"), p.FDs, p.RSS)
+			}
+		}
+	})
+
+	It("should release connections opened and closed in a loop", func() {
+		churn(*leakConns, func(i int) {
+			client := getRedisClient(proxyAddr, 1)
+			defer client.Close()
+			Expect(client.Ping().Err()).NotTo(HaveOccurred())
+		})
+	})
+
+	It("should release connections abandoned mid-pipeline", func() {
+		defer admin.Del("leak:pipeline")
+
+		churn(*leakConns, func(i int) {
+			conn, err := dialProxy()
+			Expect(err).NotTo(HaveOccurred())
+
+			cmds := make([][]string, 100)
+			for j := range cmds {
+				cmds[j] = []string{"SET", "leak:pipeline", "hello"}
+			}
+			Expect(writeRaw(conn, cmds...)).To(Succeed())
+			Expect(conn.Close()).To(Succeed())
+		})
+	})
+
+	It("should release connections abandoned mid-bulk-reply", func() {
+		value := bytes.Repeat([]byte{'1'}, 1024*1024)
+		Expect(admin.Set("leak:big", value, 0).Err()).NotTo(HaveOccurred())
+		defer admin.Del("leak:big")
+
+		churn(*leakConns/10, func(i int) {
+			conn, err := dialProxy()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(writeRaw(conn, []string{"GET", "leak:big"})).To(Succeed())
+			buf := make([]byte, 4096)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.Close()).To(Succeed())
+		})
+	})
+
+	It("should release connections churned alongside a pooled workload", func() {
+		pooled := getRedisClient(proxyAddr, 10)
+		defer pooled.Close()
+		defer pooled.Del("leak:pooled")
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			for i := 0; i < 1000; i++ {
+				Expect(pooled.Set("leak:pooled", i, 0).Err()).NotTo(HaveOccurred())
+			}
+		}()
+
+		churn(*leakConns, func(i int) {
+			client := getRedisClient(proxyAddr, 1)
+			defer client.Close()
+			Expect(client.Get("leak:pooled").Err()).To(Or(BeNil(), Equal(redis.Nil)))
+		})
+		<-done
+	})
+})
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lidaohang/test-redis-ngproxy/matrix"
+)
+
+var (
+	matrixOut = flag.String("matrix.out", "",
+		"write the command support matrix to <path>.md and <path>.json")
+	matrixReference = flag.String("matrix.reference", "",
+		"backend whose COMMAND table and replies are the reference, defaults to the master")
+	matrixTimeout = flag.Duration("matrix.timeout", 2*time.Second,
+		"how long a command may take through the proxy before it counts as a hang")
+)
+
+// TestCommandMatrix probes every command of the reference backend through
+// the proxy. It only runs with -matrix.out.
+func TestCommandMatrix(t *testing.T) {
+	if *matrixOut == "" {
+		t.Skip("requires -matrix.out")
+	}
+
+	reference := *matrixReference
+	if reference == "" {
+		reference = masterAddr
+	}
+
+	p := &matrix.Prober{
+		Proxy:     matrix.NewClient(proxyAddr, passwordFor(proxyAddr), dialerFor(proxyAddr), *matrixTimeout),
+		Reference: matrix.NewClient(reference, passwordFor(reference), dialerFor(reference), *matrixTimeout),
+	}
+	defer p.Proxy.Close()
+	defer p.Reference.Close()
+
+	results, err := p.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ext, write := range map[string]func(*os.File) error{
+		".md":   func(f *os.File) error { return matrix.WriteMarkdown(f, results) },
+		".json": func(f *os.File) error { return matrix.WriteJSON(f, results) },
+	} {
+		f, err := os.Create(*matrixOut + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = write(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, r := range results {
+		if r.Status == matrix.Hang {
+			t.Errorf("%s %q hangs through the proxy", r.Command, r.Args)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+)
+
+var (
+	pipelineDepth   = flag.Int("pipeline.depth", 100000, "deepest pipeline sent by the pipeline specs")
+	pipelineTimeout = flag.Duration("pipeline.timeout", time.Minute, "read and write timeout of the pipeline client")
+	pipelineStall   = flag.Duration("pipeline.stall", 5*time.Second, "how long the pipeline specs stop reading replies")
+)
+
+// pipelineDepths are the depths of the pipeline specs and benchmarks, up
+// to -pipeline.depth. The table entries are generated before flags are
+// parsed, deeper entries are skipped instead.
+var pipelineDepths = []int{1, 10, 100, 1000, 10000, 100000}
+
+// pipelineKeys is how many keys a pipeline spreads over, enough to reach
+// every shard.
+const pipelineKeys = 1000
+
+// pipelineStep is one command of an interleaved pipeline and its expected
+// reply: a string value, an integer, or an error with the given prefix.
+// An integer grows by perRound every time the pipeline is sent again.
+type pipelineStep struct {
+	args     []interface{}
+	value    string
+	n        int64
+	perRound int64
+	err      string
+}
+
+// interleavedPipeline returns depth commands over pipelineKeys keys of ns,
+// cycling through a SET, a GET of that value, a WRONGTYPE LPUSH on it, an
+// INCR of it that is not an integer, and an INCR of a counter. Every reply
+// depends on the commands before it on the same key, so a reply out of
+// order or for the wrong command does not match.
+func interleavedPipeline(ns *keyspace, depth int) []pipelineStep {
+	counts := make(map[int]int64)
+	slots := make([]int, depth)
+	steps := make([]pipelineStep, depth)
+	for i := range steps {
+		slot := (i / 5) % pipelineKeys
+		slots[i] = slot
+		key := ns.Key(fmt.Sprintf("pipe:%d", slot))
+		value := fmt.Sprintf("v%d", i/5)
+		switch i % 5 {
+		case 0:
+			steps[i] = pipelineStep{args: []interface{}{"SET", key, value}, value: "OK"}
+		case 1:
+			steps[i] = pipelineStep{args: []interface{}{"GET", key}, value: value}
+		case 2:
+			steps[i] = pipelineStep{args: []interface{}{"LPUSH", key, "x"}, err: "WRONGTYPE"}
+		case 3:
+			steps[i] = pipelineStep{args: []interface{}{"INCR", key}, err: "ERR"}
+		case 4:
+			counts[slot]++
+			counter := ns.Key(fmt.Sprintf("pipe:counter:%d", slot))
+			steps[i] = pipelineStep{args: []interface{}{"INCR", counter}, n: counts[slot]}
+		}
+	}
+	for i := range steps {
+		if steps[i].n != 0 {
+			steps[i].perRound = counts[slots[i]]
+		}
+	}
+	return steps
+}
+
+// check returns an error unless val and err are the reply of step i the
+// round-th time the pipeline is sent, counting from 0.
+func (s pipelineStep) check(i, round int, val interface{}, err error) error {
+	switch {
+	case s.err != "":
+		if err == nil || !strings.HasPrefix(err.Error(), s.err) {
+			return fmt.Errorf("reply %d to %v: got %v, %v, want a %s error", i, s.args, val, err, s.err)
+		}
+	case err != nil:
+		return fmt.Errorf("reply %d to %v: %v", i, s.args, err)
+	case s.value != "":
+		if val != s.value {
+			return fmt.Errorf("reply %d to %v: got %v, want %q", i, s.args, val, s.value)
+		}
+	default:
+		if n := s.n + int64(round)*s.perRound; val != n {
+			return fmt.Errorf("reply %d to %v: got %v, want %d", i, s.args, val, n)
+		}
+	}
+	return nil
+}
+
+func pipelineClient(poolSize int) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:         proxyAddr,
+		Password:     *proxyPassword,
+		Dialer:       dialerFor(proxyAddr),
+		DialTimeout:  time.Second,
+		ReadTimeout:  *pipelineTimeout,
+		WriteTimeout: *pipelineTimeout,
+		PoolSize:     poolSize,
+	})
+}
+
+var _ = Describe("Pipeline", func() {
+	var client *redis.Client
+	var ns *keyspace
+
+	BeforeEach(func() {
+		ns = newKeyspace()
+		client = pipelineClient(1)
+	})
+
+	AfterEach(func() {
+		ns.Cleanup()
+		Expect(client.Close()).NotTo(HaveOccurred())
+	})
+
+	verifyChecks("pipeline", func() (*redis.Client, *keyspace) { return client, ns })
+
+	var entries []table.TableEntry
+	for _, depth := range pipelineDepths {
+		entries = append(entries, table.Entry(fmt.Sprintf("%d commands", depth), depth))
+	}
+
+	table.DescribeTable("should reply in request order with per-command errors",
+		func(depth int) {
+			if depth > *pipelineDepth {
+				Skip(fmt.Sprintf("deeper than -pipeline.depth %d", *pipelineDepth))
+			}
+			steps := interleavedPipeline(ns, depth)
+
+			pipe := client.Pipeline()
+			cmds := make([]*redis.Cmd, len(steps))
+			for i, step := range steps {
+				cmds[i] = redis.NewCmd(step.args...)
+				pipe.Process(cmds[i])
+			}
+
+			start := time.Now()
+			// Exec returns the first error, the errors of the steps are checked
+			// one by one below.
+			pipe.Exec()
+			elapsed := time.Since(start)
+			Expect(pipe.Close()).To(Succeed())
+
+			for i, step := range steps {
+				Expect(step.check(i, 0, cmds[i].Val(), cmds[i].Err())).To(Succeed())
+			}
+			fmt.Fprintf(GinkgoWriter, "depth %d: %s, %.0f commands/s\n",
+				depth, elapsed, float64(depth)/elapsed.Seconds())
+		},
+		entries...,
+	)
+
+	It("should deliver every reply in order once a stalled client reads again", func() {
+		depth := *pipelineDepth
+		key := ns.Key("pipe:stall")
+		value := strings.Repeat("1", 1024)
+		Expect(client.Set(key, value, 0).Err()).NotTo(HaveOccurred())
+
+		conn, err := dialProxy()
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		// The proxy stops reading requests once the replies it cannot send
+		// pile up, so the write blocks until the replies are read.
+		var req bytes.Buffer
+		for i := 0; i < depth; i++ {
+			fmt.Fprintf(&req, "*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+		}
+		written := make(chan error, 1)
+		go func() {
+			conn.SetWriteDeadline(time.Now().Add(*pipelineStall + *pipelineTimeout))
+			_, err := conn.Write(req.Bytes())
+			written <- err
+		}()
+
+		// Other clients are served while the replies of this one pile up.
+		time.Sleep(*pipelineStall)
+		other := getRedisClient(proxyAddr, 1)
+		defer other.Close()
+		start := time.Now()
+		Expect(other.Get(key).Result()).To(Equal(value))
+		fmt.Fprintf(GinkgoWriter, "GET of another client while stalled: %s\n", time.Since(start))
+
+		conn.SetReadDeadline(time.Now().Add(*pipelineTimeout))
+		r := bufio.NewReaderSize(conn, 64<<10)
+		for i := 0; i < depth; i++ {
+			reply, err := readReply(r)
+			Expect(err).NotTo(HaveOccurred(), "reply %d of %d", i, depth)
+			Expect(reply).To(Equal([]byte(value)), "reply %d of %d", i, depth)
+		}
+		Expect(<-written).NotTo(HaveOccurred())
+
+		Expect(writeRaw(conn, []string{"PING"})).To(Succeed())
+		Expect(readReply(r)).To(Equal("PONG"))
+	})
+})
+
+// BenchmarkPipelineDepth runs interleaved pipelines of every depth and
+// reports the commands per second of each. Every reply is checked against
+// its step, the expected error replies included.
+func BenchmarkPipelineDepth(b *testing.B) {
+	for _, depth := range pipelineDepths {
+		if depth > *pipelineDepth {
+			break
+		}
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			client := pipelineClient(1)
+			defer client.Close()
+			ns := newKeyspace()
+			defer ns.Cleanup()
+
+			steps := interleavedPipeline(ns, depth)
+			cmds := make([]*redis.Cmd, len(steps))
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				pipe := client.Pipeline()
+				for i, step := range steps {
+					cmds[i] = redis.NewCmd(step.args...)
+					pipe.Process(cmds[i])
+				}
+				// Exec returns the first error, which is an expected one.
+				pipe.Exec()
+				pipe.Close()
+				for i, step := range steps {
+					if err := step.check(i, n, cmds[i].Val(), cmds[i].Err()); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(depth*b.N)/b.Elapsed().Seconds(), "commands/s")
+		})
+	}
+}
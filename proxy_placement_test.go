@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+)
+
+// masterAddrs returns the address of every master known to the tests.
+// Against the external proxy only masterAddr is known.
+func masterAddrs() []string {
+	if cluster == nil {
+		return []string{masterAddr}
+	}
+	addrs := make([]string, len(cluster.Masters))
+	for i, master := range cluster.Masters {
+		addrs[i] = master.Addr
+	}
+	return addrs
+}
+
+// keyOn returns a key starting with prefix that the proxy stores on the
+// master at addr.
+func keyOn(prefix, addr string) (string, error) {
+	return findKey(prefix, addr, true)
+}
+
+// keyOff returns a key starting with prefix that the proxy does not store
+// on the master at addr.
+func keyOff(prefix, addr string) (string, error) {
+	return findKey(prefix, addr, false)
+}
+
+// findKey learns the proxy's placement by writing candidate keys through
+// the proxy and looking for them on the master directly.
+func findKey(prefix, addr string, on bool) (string, error) {
+	proxy := getRedisClient(proxyAddr, 1)
+	defer proxy.Close()
+
+	backend := getRedisClient(addr, 1)
+	defer backend.Close()
+
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("%s:%d", prefix, i)
+		if err := proxy.Set(key, "placement", 0).Err(); err != nil {
+			return "", err
+		}
+		n, err := backend.Exists(key).Result()
+		proxy.Del(key)
+		if err != nil {
+			return "", err
+		}
+		if (n == 1) == on {
+			return key, nil
+		}
+	}
+	return "", fmt.Errorf("no key with prefix %q found for %s (on=%v)", prefix, addr, on)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+	"github.com/lidaohang/test-redis-ngproxy/target"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+var (
+	poolSizes       = flag.String("pool.sizes", "1,5,10,25,50,100,250,500,1000", "comma separated PoolSize values swept by BenchmarkPoolSweep")
+	poolGoroutines  = flag.String("pool.goroutines", "1,10,100,500,1000,5000", "comma separated goroutine counts swept by BenchmarkPoolSweep")
+	poolWaitTimeout = flag.Duration("pool.timeout", time.Second, "go-redis PoolTimeout of the swept clients")
+	poolTolerance   = flag.Float64("pool.tolerance", 0.05, "throughput below the best that a recommended pool size may give up")
+	poolTable       = flag.String("pool.table", "", "file the markdown table of BenchmarkPoolSweep is written to")
+)
+
+func parseInts(s string) ([]int, error) {
+	var ints []int
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// poolCell is the outcome of one PoolSize and goroutine count.
+type poolCell struct {
+	pool, goroutines int
+	result           workload.Result
+	// wait is the mean latency above the one of a single connection, an
+	// estimate of the time spent waiting for a pooled connection derived
+	// from the wall time, not measured.
+	wait  time.Duration
+	stats redis.PoolStats
+	// refused counts failed dials and max clients errors, the proxy's
+	// accept or connection limit.
+	refused int64
+	// clients is the proxy's connected_clients with the pool open.
+	clients int64
+}
+
+// runPoolCell runs n GETs over goroutines sharing a client of pool
+// connections.
+func runPoolCell(pool, goroutines, n int, key string, admin *stats.Collector) poolCell {
+	cell := poolCell{pool: pool, goroutines: goroutines}
+	client := redis.NewClient(&redis.Options{
+		Addr:     proxyAddr,
+		Password: *proxyPassword,
+		Dialer: func() (net.Conn, error) {
+			var conn net.Conn
+			var err error
+			if proxyTLS != nil {
+				conn, err = target.DialTLS(proxyAddr, proxyTLS)
+			} else {
+				conn, err = net.DialTimeout("tcp", proxyAddr, time.Second)
+			}
+			if err != nil {
+				atomic.AddInt64(&cell.refused, 1)
+			}
+			return conn, err
+		},
+		DialTimeout:  time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		PoolSize:     pool,
+		PoolTimeout:  *poolWaitTimeout,
+	})
+	defer client.Close()
+
+	rec := workload.NewRecorder()
+	remaining := int64(n)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.AddInt64(&remaining, -1) >= 0 {
+				start := time.Now()
+				err := client.Get(key).Err()
+				rec.Add(time.Since(start), err)
+				if err != nil && strings.Contains(err.Error(), "max number of clients") {
+					atomic.AddInt64(&cell.refused, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	cell.result = rec.Result()
+	cell.stats = *client.PoolStats()
+	if s := admin.ScrapeOne("proxy"); s.Info != nil {
+		cell.clients = s.Info.Clients.ConnectedClients
+	}
+	return cell
+}
+
+// BenchmarkPoolSweep sweeps go-redis PoolSize and the goroutines sharing
+// the client, well past the pool size, and prints a table of throughput,
+// latency, pool stats and proxy connections with the recommended pool size
+// per goroutine count: the smallest one within -pool.tolerance of the best
+// throughput without errors.
+func BenchmarkPoolSweep(b *testing.B) {
+	sizes, err := parseInts(*poolSizes)
+	if err != nil {
+		b.Fatal(err)
+	}
+	goroutines, err := parseInts(*poolGoroutines)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	admin := getRedisClient(proxyAddr, 1)
+	defer admin.Close()
+	collector := stats.NewCollector(time.Second)
+	collector.Add("proxy", admin)
+
+	ns := newKeyspace()
+	defer ns.Cleanup()
+	key := ns.Key("pool:key")
+	if err := admin.Set(key, "hello", 0).Err(); err != nil {
+		b.Fatal(err)
+	}
+
+	// The latency of a single connection without waiting for the pool.
+	base := runPoolCell(1, 1, 1000, key, collector).result
+	if base.Errors > 0 {
+		b.Fatal(base.FirstError)
+	}
+	baseMean := base.Elapsed / time.Duration(base.Ops)
+
+	cells := make(map[[2]int]poolCell)
+	for _, g := range goroutines {
+		for _, size := range sizes {
+			b.Run(fmt.Sprintf("goroutines=%d/pool=%d", g, size), func(b *testing.B) {
+				cell := runPoolCell(size, g, b.N, key, collector)
+				if ops := cell.result.Ops; ops > 0 {
+					// Elapsed is wall time with up to g operations at once.
+					busy := int64(g)
+					if busy > ops {
+						busy = ops
+					}
+					mean := cell.result.Elapsed * time.Duration(busy) / time.Duration(ops)
+					if mean > baseMean {
+						cell.wait = mean - baseMean
+					}
+				}
+				cells[[2]int{g, size}] = cell
+
+				b.ReportMetric(cell.result.OpsPerSec, "ops/s")
+				b.ReportMetric(float64(cell.result.P99)/float64(time.Millisecond), "p99-ms")
+				b.ReportMetric(float64(cell.wait)/float64(time.Millisecond), "est-wait-ms")
+				b.ReportMetric(float64(cell.stats.Timeouts), "pool-timeouts")
+				b.ReportMetric(float64(cell.stats.Requests-cell.stats.Hits), "pool-misses")
+				b.ReportMetric(float64(cell.result.Errors), "errors")
+			})
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	var md strings.Builder
+	if *poolTable != "" {
+		out = io.MultiWriter(os.Stdout, &md)
+	}
+	writePoolTable(out, cells, goroutines, sizes)
+	if *poolTable != "" {
+		if err := ioutil.WriteFile(*poolTable, []byte(md.String()), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// writePoolTable writes the cells as a markdown table, then the
+// recommended pool size per goroutine count and the cell with the fewest
+// proxy clients where the proxy refused connections.
+func writePoolTable(w io.Writer, cells map[[2]int]poolCell, goroutines, sizes []int) {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', tabwriter.Debug)
+	fmt.Fprintln(tw, "| goroutines\t pool\t ops/s\t p50\t p99\t est. wait (derived)\t pool timeouts\t pool misses\t pool conns\t proxy clients\t refused\t errors\t")
+	fmt.Fprintln(tw, "|---\t---\t---\t---\t---\t---\t---\t---\t---\t---\t---\t---\t")
+	for _, g := range goroutines {
+		for _, size := range sizes {
+			c, ok := cells[[2]int{g, size}]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(tw, "| %d\t %d\t %.0f\t %s\t %s\t %s\t %d\t %d\t %d\t %d\t %d\t %d\t\n",
+				g, size, c.result.OpsPerSec, c.result.P50, c.result.P99, c.wait,
+				c.stats.Timeouts, c.stats.Requests-c.stats.Hits, c.stats.TotalConns,
+				c.clients, c.refused, c.result.Errors)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+
+	var limit *poolCell
+	for _, g := range goroutines {
+		var candidates []poolCell
+		best := 0.0
+		for _, size := range sizes {
+			c, ok := cells[[2]int{g, size}]
+			if !ok {
+				continue
+			}
+			if c.refused > 0 && (limit == nil || c.clients < limit.clients) {
+				limit = &c
+			}
+			if c.result.Errors > 0 {
+				continue
+			}
+			candidates = append(candidates, c)
+			if c.result.OpsPerSec > best {
+				best = c.result.OpsPerSec
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].pool < candidates[j].pool })
+
+		recommended := "none without errors"
+		for _, c := range candidates {
+			if c.result.OpsPerSec >= best*(1-*poolTolerance) {
+				recommended = fmt.Sprintf("%d (%.0f ops/s, p99 %s)", c.pool, c.result.OpsPerSec, c.result.P99)
+				break
+			}
+		}
+		fmt.Fprintf(w, "- %d goroutines: recommended pool size %s\n", g, recommended)
+	}
+
+	if limit != nil {
+		fmt.Fprintf(w, "- the proxy refused connections from pool size %d with %d goroutines, %d clients connected\n",
+			limit.pool, limit.goroutines, limit.clients)
+	} else {
+		fmt.Fprintln(w, "- the proxy accepted every connection of the sweep")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+)
+
+var pubsubIdle = flag.Duration("pubsub.idle", 5*time.Second, "how long a subscriber stays idle before it must still receive")
+
+// subscribe subscribes to channels, or to patterns with pattern set, and
+// waits for the confirmations. It returns nil if the proxy cleanly rejects
+// pub/sub; a subscription that neither confirms nor errors fails.
+func subscribe(client *redis.Client, pattern bool, channels ...string) *redis.PubSub {
+	var pubsub *redis.PubSub
+	if pattern {
+		pubsub = client.PSubscribe(channels...)
+	} else {
+		pubsub = client.Subscribe(channels...)
+	}
+
+	for range channels {
+		msg, err := pubsub.ReceiveTimeout(time.Second)
+		if rejectedByProxy(err) {
+			pubsub.Close()
+			return nil
+		}
+		Expect(msg).To(BeAssignableToTypeOf(&redis.Subscription{}))
+	}
+	return pubsub
+}
+
+var _ = Describe("PubSub", func() {
+	var client *redis.Client
+
+	BeforeEach(func() {
+		client = getRedisClient(proxyAddr, 10)
+	})
+
+	AfterEach(func() {
+		Expect(client.Close()).NotTo(HaveOccurred())
+	})
+
+	It("should receive published messages in order", func() {
+		pubsub := subscribe(client, false, "mychannel")
+		if pubsub == nil {
+			return
+		}
+		defer pubsub.Close()
+
+		for i := 0; i < 100; i++ {
+			n, err := client.Publish("mychannel", strconv.Itoa(i)).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(Equal(int64(1)))
+		}
+
+		for i := 0; i < 100; i++ {
+			msg, err := pubsub.ReceiveMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg.Channel).To(Equal("mychannel"))
+			Expect(msg.Payload).To(Equal(strconv.Itoa(i)))
+		}
+	})
+
+	It("should receive messages of pattern subscriptions", func() {
+		pubsub := subscribe(client, true, "mychannel.*")
+		if pubsub == nil {
+			return
+		}
+		defer pubsub.Close()
+
+		for _, channel := range []string{"mychannel.a", "otherchannel", "mychannel.b"} {
+			err := client.Publish(channel, "hello").Err()
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		for _, channel := range []string{"mychannel.a", "mychannel.b"} {
+			msg, err := pubsub.ReceiveMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg.Pattern).To(Equal("mychannel.*"))
+			Expect(msg.Channel).To(Equal(channel))
+			Expect(msg.Payload).To(Equal("hello"))
+		}
+	})
+
+	It("should deliver to many subscribers", func() {
+		pubsubs := make([]*redis.PubSub, 50)
+		for i := range pubsubs {
+			pubsubs[i] = subscribe(client, false, "mychannel")
+			if pubsubs[i] == nil {
+				return
+			}
+			defer pubsubs[i].Close()
+		}
+
+		n, err := client.Publish("mychannel", "hello").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(int64(len(pubsubs))))
+
+		for _, pubsub := range pubsubs {
+			msg, err := pubsub.ReceiveMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg.Payload).To(Equal("hello"))
+		}
+	})
+
+	It("should keep an idle subscriber usable", func() {
+		pubsub := subscribe(client, false, "mychannel")
+		if pubsub == nil {
+			return
+		}
+		defer pubsub.Close()
+
+		time.Sleep(*pubsubIdle)
+
+		Expect(pubsub.Ping("idle")).To(Succeed())
+		msg, err := pubsub.ReceiveTimeout(time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg).To(Equal(&redis.Pong{Payload: "idle"}))
+
+		err = client.Publish("mychannel", "hello").Err()
+		Expect(err).NotTo(HaveOccurred())
+
+		msg, err = pubsub.ReceiveTimeout(time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg.(*redis.Message).Payload).To(Equal("hello"))
+	})
+
+	It("should stop delivering after Unsubscribe", func() {
+		pubsub := subscribe(client, false, "mychannel", "mychannel2")
+		if pubsub == nil {
+			return
+		}
+		defer pubsub.Close()
+
+		Expect(pubsub.Unsubscribe("mychannel")).To(Succeed())
+		msg, err := pubsub.ReceiveTimeout(time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg).To(Equal(&redis.Subscription{Kind: "unsubscribe", Channel: "mychannel", Count: 1}))
+
+		n, err := client.Publish("mychannel", "hello").Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(int64(0)))
+
+		err = client.Publish("mychannel2", "hello2").Err()
+		Expect(err).NotTo(HaveOccurred())
+
+		msg2, err := pubsub.ReceiveMessage()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msg2.Channel).To(Equal("mychannel2"))
+	})
+
+	It("should reject regular commands on a subscribed connection", func() {
+		conn, err := dialProxy()
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+
+		Expect(writeRaw(conn, []string{"SUBSCRIBE", "mychannel"})).To(Succeed())
+		reply, err := readReply(r)
+		Expect(err).NotTo(HaveOccurred())
+		if _, ok := reply.(replyError); ok {
+			expectRejectedReply(reply)
+			return
+		}
+		Expect(reply).To(Equal([]interface{}{[]byte("subscribe"), []byte("mychannel"), int64(1)}))
+
+		Expect(writeRaw(conn, []string{"GET", "key"})).To(Succeed())
+		reply, err = readReply(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reply).To(BeAssignableToTypeOf(replyError("")))
+	})
+})
+
+// benchmarkPubSub publishes b.N messages to subscribers over the proxy
+// and reports the share delivered. When restart is set it runs alongside
+// the publishing from the middle of the b.N messages on; afterwards every
+// subscriber must be resubscribed and receive again.
+func benchmarkPubSub(b *testing.B, subscribers int, restart func() error) {
+	client := getRedisClient(proxyAddr, 10)
+	defer client.Close()
+
+	const channel = "pubsub:bench"
+
+	var received int64
+	lastSeen := make([]int64, subscribers)
+	for i := 0; i < subscribers; i++ {
+		pubsub := client.Subscribe(channel)
+		if _, err := pubsub.ReceiveTimeout(time.Second); err != nil {
+			b.Fatal(err)
+		}
+		defer pubsub.Close()
+
+		go func(i int, ch <-chan *redis.Message) {
+			for msg := range ch {
+				n, _ := strconv.ParseInt(msg.Payload, 10, 64)
+				atomic.StoreInt64(&lastSeen[i], n)
+				if n < int64(b.N) {
+					atomic.AddInt64(&received, 1)
+				}
+			}
+		}(i, pubsub.Channel())
+	}
+
+	var publishErrs int64
+	var restarted chan error
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if restart != nil && i == b.N/2 {
+			restarted = make(chan error, 1)
+			go func() {
+				restarted <- restart()
+			}()
+		}
+		if err := client.Publish(channel, strconv.Itoa(i)).Err(); err != nil {
+			publishErrs++
+		}
+	}
+
+	b.StopTimer()
+
+	if restart != nil {
+		if restarted == nil {
+			b.Fatal("the restart never ran")
+		}
+		if err := <-restarted; err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// Every subscriber must see a message published after the run.
+	sentinel := int64(b.N + 1)
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		client.Publish(channel, strconv.FormatInt(sentinel, 10))
+		time.Sleep(100 * time.Millisecond)
+
+		missing := 0
+		for i := range lastSeen {
+			if atomic.LoadInt64(&lastSeen[i]) != sentinel {
+				missing++
+			}
+		}
+		if missing == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			b.Fatalf("%d of %d subscribers did not resubscribe", missing, subscribers)
+		}
+	}
+
+	b.ReportMetric(float64(atomic.LoadInt64(&received))/float64(b.N*subscribers), "delivered")
+	b.ReportMetric(float64(publishErrs), "publish-errors")
+}
+
+func BenchmarkPubSub1Subscriber(b *testing.B) {
+	benchmarkPubSub(b, 1, nil)
+}
+
+func BenchmarkPubSub100Subscribers(b *testing.B) {
+	benchmarkPubSub(b, 100, nil)
+}
+
+/*
+发布订阅压测到一半时重启代理，订阅者需要自动重新订阅
+*/
+func BenchmarkPubSubProxyRestart(b *testing.B) {
+	requireCluster(b)
+	benchmarkPubSub(b, 10, cluster.Proxy.Restart)
+}
+
+/*
+发布订阅压测到一半时重启所有master
+*/
+func BenchmarkPubSubBackendRestart(b *testing.B) {
+	requireCluster(b)
+	benchmarkPubSub(b, 10, func() error {
+		for _, master := range cluster.Masters {
+			if err := master.Restart(); err != nil {
+				return fmt.Errorf("%s: %s", master.Name, err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/lidaohang/test-redis-ngproxy/replay"
+)
+
+var (
+	replayReport = flag.String("replay.report", "",
+		"tcpflow report.xml of captured client traffic replayed by the Replay specs, skipped if empty")
+	replayPort        = flag.Int("replay.port", 8015, "proxy port of the capture, flows towards it are replayed")
+	replayConcurrency = flag.Int("replay.concurrency", 10, "flows replayed at once")
+)
+
+var _ = Describe("Replay [slow]", func() {
+
+	BeforeEach(func() {
+		if *replayReport == "" {
+			Skip("requires -replay.report")
+		}
+	})
+
+	It("should replay the captured client flows without errors", func() {
+		flows, err := replay.LoadReport(*replayReport)
+		Expect(err).NotTo(HaveOccurred())
+		flows = replay.ClientFlows(flows, *replayPort)
+		Expect(flows).NotTo(BeEmpty(), "no flows towards port %d", *replayPort)
+
+		client := getRedisClient(proxyAddr, *replayConcurrency)
+		defer client.Close()
+
+		p := &replay.Replayer{Client: client, Concurrency: *replayConcurrency}
+		res, err := p.Run(flows)
+		Expect(err).NotTo(HaveOccurred())
+		fmt.Fprintf(GinkgoWriter, "replayed %d commands of %d flows in %s, %d skipped, %d errors\n",
+			res.Commands, res.Flows, res.Elapsed, res.Skipped, res.Errors)
+
+		Expect(res.Commands).NotTo(BeZero())
+		Expect(res.Errors).To(BeZero(), strings.Join(res.Failures, "\n"))
+	})
+
+})
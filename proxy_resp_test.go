@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/lidaohang/test-redis-ngproxy/target"
+)
+
+var (
+	proxyRejection = flag.String("ngproxy.rejection", `^(ERR (unknown|unsupported) command\b|CROSSSLOT\b)`,
+		"regexp matching the error replies ngproxy documents for commands it refuses")
+	proxyRejectAnyErr = flag.Bool("ngproxy.rejection.anyerr", false,
+		"also accept any ERR reply as a refusal, for proxies whose rejection text differs")
+)
+
+// dialProxy opens a raw connection to the proxy, over TLS with -ngproxy.tls
+// and authenticated when the proxy requires a password.
+func dialProxy() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if proxyTLS != nil {
+		conn, err = target.DialTLS(proxyAddr, proxyTLS)
+	} else {
+		conn, err = net.DialTimeout("tcp", proxyAddr, time.Second)
+	}
+	if err != nil || *proxyPassword == "" {
+		return conn, err
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	err = writeRaw(conn, []string{"AUTH", *proxyPassword})
+	if err == nil {
+		var reply interface{}
+		reply, err = readReply(bufio.NewReader(conn))
+		if err == nil && reply != "OK" {
+			err = fmt.Errorf("AUTH: %v", reply)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// writeRaw sends cmds as RESP arrays over conn without reading replies.
+func writeRaw(conn net.Conn, cmds ...[]string) error {
+	var buf bytes.Buffer
+	for _, args := range cmds {
+		fmt.Fprintf(&buf, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	_, err := conn.Write(buf.Bytes())
+	return err
+}
+
+// replyError is an error reply read by readReply.
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+
+// readReply reads one RESP reply. Status replies are returned as string,
+// error replies as replyError, integers as int64, bulk strings as []byte
+// and arrays as []interface{}. Nil bulk strings and arrays are nil.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply line %q", line)
+	}
+	body := string(line[1 : len(line)-2])
+
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return replyError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		vals := make([]interface{}, n)
+		for i := range vals {
+			if vals[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return vals, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", line[0])
+}
+
+// rejectedByProxy reports whether err is the clean error reply ngproxy
+// documents for a command it does not support. Any other error, a
+// timeout or a dropped connection in particular, fails the spec.
+func rejectedByProxy(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	Expect(errors.As(err, &netErr)).To(BeFalse(), "expected an error reply, got %v", err)
+	Expect(err).NotTo(Equal(io.EOF))
+	if *proxyRejectAnyErr && strings.HasPrefix(err.Error(), "ERR ") {
+		return true
+	}
+	Expect(err).To(MatchError(MatchRegexp(*proxyRejection)))
+	return true
+}
+
+// expectRejectedReply is rejectedByProxy for replies read by readReply.
+func expectRejectedReply(reply interface{}) {
+	err, ok := reply.(replyError)
+	Expect(ok).To(BeTrue(), "expected an error reply, got %v", reply)
+	Expect(rejectedByProxy(err)).To(BeTrue())
+}
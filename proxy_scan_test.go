@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+)
+
+var scanKeys = flag.Int("scan.keys", 5000, "number of keys populated by the scan specs")
+
+// scanAll runs SCAN through the proxy until the cursor returns to 0 and
+// returns how often every key was seen. A cursor that does not terminate
+// after maxPages pages fails the spec.
+func scanAll(client *redis.Client, match string, count int64, maxPages int) map[string]int {
+	seen := make(map[string]int)
+	var cursor uint64
+	for page := 0; ; page++ {
+		Expect(page).To(BeNumerically("<", maxPages), "SCAN cursor did not terminate")
+
+		keys, next, err := client.Scan(cursor, match, count).Result()
+		Expect(err).NotTo(HaveOccurred())
+		for _, key := range keys {
+			seen[key]++
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return seen
+		}
+	}
+}
+
+// deleteKeys deletes keys one DEL each, since a multi-key DEL may be
+// refused across shards, and fails the spec on any error.
+func deleteKeys(client *redis.Client, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	pipe := client.Pipeline()
+	defer pipe.Close()
+	for _, key := range keys {
+		pipe.Del(key)
+	}
+	cmds, err := pipe.Exec()
+	Expect(err).NotTo(HaveOccurred())
+	for _, cmd := range cmds {
+		Expect(cmd.Err()).NotTo(HaveOccurred())
+	}
+}
+
+var _ = Describe("Scan", func() {
+	var client *redis.Client
+	var ns *keyspace
+	var keys []string
+
+	// pattern returns a MATCH pattern inside the keyspace of the spec.
+	pattern := func(p string) string {
+		return ns.prefix + p
+	}
+
+	// populate writes -scan.keys keys, every other one under scan:even:.
+	populate := func() {
+		keys = make([]string, *scanKeys)
+		pipe := client.Pipeline()
+		for i := range keys {
+			keys[i] = fmt.Sprintf("%sscan:%d", ns.prefix, i)
+			if i%2 == 0 {
+				keys[i] = fmt.Sprintf("%sscan:even:%d", ns.prefix, i)
+			}
+			pipe.Set(keys[i], "hello", 0)
+		}
+		_, err := pipe.Exec()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pipe.Close()).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		client = getRedisClient(proxyAddr, 10)
+		ns = newKeyspace()
+		keys = nil
+	})
+
+	AfterEach(func() {
+		deleteKeys(client, keys)
+		ns.Cleanup()
+		Expect(client.Close()).NotTo(HaveOccurred())
+	})
+
+	Context("with -scan.keys keys", func() {
+		BeforeEach(populate)
+
+		It("should spread the keys over every master", func() {
+			for _, addr := range masterAddrs() {
+				backend := getRedisClient(addr, 1)
+				n, err := backend.Exists(keys[:100]...).Result()
+				backend.Close()
+				Expect(err).NotTo(HaveOccurred())
+				if len(masterAddrs()) > 1 {
+					Expect(n).To(BeNumerically("<", 100))
+				}
+				Expect(n).To(BeNumerically(">", 0))
+			}
+		})
+
+		for _, count := range []int64{0, 1, 10, 1000} {
+			count := count
+
+			It(fmt.Sprintf("should return every key with COUNT %d", count), func() {
+				maxPages := len(keys)*4 + 100
+				seen := scanAll(client, pattern("scan:*"), count, maxPages)
+				for _, key := range keys {
+					Expect(seen).To(HaveKey(key))
+				}
+			})
+		}
+
+		It("should filter with MATCH", func() {
+			seen := scanAll(client, pattern("scan:even:*"), 100, len(keys)*4)
+			for _, key := range keys {
+				if strings.HasPrefix(key, pattern("scan:even:")) {
+					Expect(seen).To(HaveKey(key))
+				} else {
+					Expect(seen).NotTo(HaveKey(key))
+				}
+			}
+		})
+
+		It("should terminate with a MATCH that matches nothing", func() {
+			seen := scanAll(client, pattern("scan:nothing:*"), 100, len(keys)*4)
+			Expect(seen).To(BeEmpty())
+		})
+
+		It("should iterate with ScanIterator", func() {
+			seen := make(map[string]bool)
+			iter := client.Scan(0, pattern("scan:*"), 100).Iterator()
+			for iter.Next() {
+				seen[iter.Val()] = true
+			}
+			Expect(iter.Err()).NotTo(HaveOccurred())
+			Expect(seen).To(HaveLen(len(keys)))
+		})
+	})
+
+	It("should HScan, SScan and ZScan a big key", func() {
+		hash, set, zset := ns.Key("scan:hash"), ns.Key("scan:set"), ns.Key("scan:zset")
+
+		pipe := client.Pipeline()
+		for i := 0; i < 1000; i++ {
+			member := fmt.Sprintf("member%d", i)
+			pipe.HSet(hash, member, "hello")
+			pipe.SAdd(set, member)
+			pipe.ZAdd(zset, redis.Z{Score: float64(i), Member: member})
+		}
+		_, err := pipe.Exec()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pipe.Close()).NotTo(HaveOccurred())
+
+		for _, cmd := range []*redis.ScanCmd{
+			client.HScan(hash, 0, "member*", 100),
+			client.SScan(set, 0, "member*", 100),
+			client.ZScan(zset, 0, "member*", 100),
+		} {
+			seen := make(map[string]bool)
+			iter := cmd.Iterator()
+			for iter.Next() {
+				if strings.HasPrefix(iter.Val(), "member") {
+					seen[iter.Val()] = true
+				}
+			}
+			Expect(iter.Err()).NotTo(HaveOccurred())
+			Expect(seen).To(HaveLen(1000))
+		}
+	})
+
+	It("should survive a master failover mid-iteration [destructive]", func() {
+		requireDestructive()
+		if cluster == nil {
+			Skip("requires -ngproxy.topology")
+		}
+
+		populate()
+
+		master := cluster.Masters[0]
+		defer func() {
+			Expect(master.Restart()).To(Succeed())
+		}()
+
+		seen := make(map[string]int)
+		var cursor uint64
+		for page := 0; ; page++ {
+			Expect(page).To(BeNumerically("<", len(keys)*4), "SCAN cursor did not terminate")
+
+			if page == 1 {
+				Expect(master.Stop()).To(Succeed())
+			}
+
+			// Pages may fail until the proxy has failed over.
+			var batch []string
+			var next uint64
+			Eventually(func() error {
+				var err error
+				batch, next, err = client.Scan(cursor, pattern("scan:*"), 100).Result()
+				return err
+			}, 30*time.Second, 100*time.Millisecond).Should(Succeed())
+
+			for _, key := range batch {
+				seen[key]++
+			}
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+
+		for _, key := range keys {
+			Expect(seen).To(HaveKey(key))
+		}
+	})
+})
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"os"
 	"testing"
@@ -9,14 +10,31 @@ import (
 
 	"github.com/go-redis/redis"
 	logging "github.com/op/go-logging"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
 )
 
-const (
+// Addresses of the externally managed proxy and backends. They are replaced
+// by the supervised ones when running with -ngproxy.topology.
+var (
 	proxyAddr  = "10.94.106.240:8015"
 	masterAddr = "127.0.0.1:8001"
 	slaveAddr  = "127.0.0.1:8002"
 )
 
+// Passwords of the proxy and of the backends, empty for none. With
+// -ngproxy.topology they are taken from the topology.
+var (
+	proxyPassword   = flag.String("ngproxy.password", "", "password the proxy requires from clients")
+	backendPassword = flag.String("backend.password", "", "password the backends require")
+)
+
+// passwordFor returns the password of the proxy or backend at addr. The
+// plaintext address of a TLS proxy is the proxy too.
+func passwordFor(addr string) string {
+	return suite.PasswordFor(addr)
+}
+
 var format = logging.MustStringFormatter(
 	`%{color}%{time:2006-01-02T15:04:05.000} %{shortfile} %{shortfunc} > %{level:.4s} %{id:03x}%{color:reset} [%{module}] %{message}`,
 )
@@ -45,122 +63,42 @@ func getLogger(path string, flag string) (*logging.Logger, error) {
 }
 
 func getRedisClient(addr string, poolSize int) *redis.Client {
-	client := redis.NewClient(&redis.Options{
-		Addr:         addr,
-		DialTimeout:  time.Second,
-		ReadTimeout:  time.Second,
-		WriteTimeout: time.Second,
-		PoolSize:     poolSize,
-	})
-
-	return client
+	return suite.Client(addr, poolSize)
 }
 
-/*
-压测GET,SET一分钟
-*/
-func BenchmarkRedisNormal(b *testing.B) {
-
-	logger, _ := getLogger("benchmark_redis_normal.log", "redis_normal")
-
-	client := getRedisClient(proxyAddr, 10)
-	defer client.Close()
-
-	value := bytes.Repeat([]byte{'1'}, 32)
-
-	b.ResetTimer()
-
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-
-			logger.Debugf(proxyAddr, " set key value")
-			if err := client.Set("key", value, 0).Err(); err != nil {
-				b.Fatal(err)
-				logger.Error(err)
-			}
-
-			logger.Debugf(proxyAddr, " get key")
-			got, err := client.Get("key").Bytes()
-			if err != nil {
-				b.Fatal(err)
-				logger.Error(err)
-			}
-			if !bytes.Equal(got, value) {
-				b.Fatalf("got != value")
-				logger.Error(fmt.Sprintf("got=[%s] != value=[%s]", string(got), string(value)))
-			}
-		}
-	})
+// doCmd sends a command that the vendored go-redis has no method for.
+func doCmd(client *redis.Client, args ...interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(args...)
+	client.Process(cmd)
+	return cmd
 }
 
-/*
-压测GET,SET一分钟然后下掉master节点
-*/
-func BenchmarkRedisMasterShutDown(b *testing.B) {
-
-	logger, _ := getLogger("benchmark_redis_master_shutdown.log", "master_down")
-
-	client := getRedisClient(proxyAddr, 10)
-	defer client.Close()
-
-	clientMaster := getRedisClient(masterAddr, 10)
-	defer client.Close()
-
-	now := time.Now()
-	status := true
-
-	value := bytes.Repeat([]byte{'1'}, 32)
-
-	b.ResetTimer()
-
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-
-			ti := time.Now()
-			subM := ti.Sub(now)
-			minutes := subM.Minutes()
-
-			if int(minutes) >= 1 && status {
-				clientMaster.Shutdown()
-				status = false
-			}
-
-			logger.Debugf(proxyAddr, " set key value")
-			if err := client.Set("key", value, 0).Err(); err != nil {
-				b.Fatal(err)
-				logger.Error(err)
-			}
+// logStatsDelta logs how the stats of target changed between the last
+// sample before event and the end of the run.
+func logStatsDelta(logger *logging.Logger, collector *stats.Collector, target, event string) {
+	before := collector.Before(target, event)
+	after := collector.Last(target)
+	if before == nil || after == nil {
+		logger.Warningf("%s: no stats around %q", target, event)
+		return
+	}
 
-			logger.Debugf(proxyAddr, " get key")
-			got, err := client.Get("key").Bytes()
-			if err != nil {
-				b.Fatal(err)
-				logger.Error(err)
-			}
-			if !bytes.Equal(got, value) {
-				b.Fatalf("got != value")
-				logger.Error(fmt.Sprintf("got=[%s] != value=[%s]", string(got), string(value)))
-			}
-		}
-	})
+	logger.Infof("%s: connected_clients %d -> %d, backend_reconnections %d -> %d",
+		target,
+		before.Clients.ConnectedClients, after.Clients.ConnectedClients,
+		before.Stats.BackendReconnections, after.Stats.BackendReconnections)
 }
 
 /*
-压测GET,SET一分钟然后下掉slave节点
+压测GET,SET一分钟
 */
-func BenchmarkRedisSlaveShutDown(b *testing.B) {
+func BenchmarkRedisNormal(b *testing.B) {
 
-	logger, _ := getLogger("benchmark_redis_slave_shutdown.log", "slave_down")
+	logger, _ := getLogger("benchmark_redis_normal.log", "redis_normal")
 
 	client := getRedisClient(proxyAddr, 10)
 	defer client.Close()
 
-	clientSlave := getRedisClient(slaveAddr, 10)
-	defer client.Close()
-
-	now := time.Now()
-	status := true
-
 	value := bytes.Repeat([]byte{'1'}, 32)
 
 	b.ResetTimer()
@@ -168,15 +106,6 @@ func BenchmarkRedisSlaveShutDown(b *testing.B) {
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
 
-			ti := time.Now()
-			subM := ti.Sub(now)
-			minutes := subM.Minutes()
-
-			if int(minutes) >= 1 && status {
-				clientSlave.Shutdown()
-				status = false
-			}
-
 			logger.Debugf(proxyAddr, " set key value")
 			if err := client.Set("key", value, 0).Err(); err != nil {
 				b.Fatal(err)
@@ -197,58 +126,17 @@ func BenchmarkRedisSlaveShutDown(b *testing.B) {
 	})
 }
 
-/*
-压测GET,SET一分钟然后下掉master,slave节点
-*/
-func BenchmarkRedisMasterSlaveShutDown(b *testing.B) {
-
-	logger, _ := getLogger("benchmark_redis_master_shutdown.log", "master_down")
-
-	client := getRedisClient(proxyAddr, 10)
-	defer client.Close()
-
-	clientMaster := getRedisClient(masterAddr, 10)
-	defer client.Close()
-
-	clientSlave := getRedisClient(slaveAddr, 10)
-	defer client.Close()
-
-	now := time.Now()
-	status := true
-
-	value := bytes.Repeat([]byte{'1'}, 32)
-
-	b.ResetTimer()
-
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-
-			ti := time.Now()
-			subM := ti.Sub(now)
-			minutes := subM.Minutes()
-
-			if int(minutes) >= 1 && status {
-				clientMaster.Shutdown()
-				clientSlave.Shutdown()
-				status = false
-			}
-
-			logger.Debugf(proxyAddr, " set key value")
-			if err := client.Set("key", value, 0).Err(); err != nil {
-				b.Fatal(err)
-				logger.Error(err)
-			}
+var (
+	faultAfter   = flag.Duration("fault.after", time.Minute, "workload time before a fault is injected")
+	faultFor     = flag.Duration("fault.for", 30*time.Second, "how long an injected fault lasts")
+	faultRecover = flag.Duration("fault.recover", 30*time.Second, "how long the proxy may take to recover after a fault is healed")
+	faultSettle  = flag.Duration("fault.settle", 5*time.Second, "how long the workload goes on after the faulty shard recovered, without errors")
+	slowLatency  = flag.Duration("fault.latency", 200*time.Millisecond, "latency added to a slowed backend")
+)
 
-			logger.Debugf(proxyAddr, " get key")
-			got, err := client.Get("key").Bytes()
-			if err != nil {
-				b.Fatal(err)
-				logger.Error(err)
-			}
-			if !bytes.Equal(got, value) {
-				b.Fatalf("got != value")
-				logger.Error(fmt.Sprintf("got=[%s] != value=[%s]", string(got), string(value)))
-			}
-		}
-	})
+// requireCluster skips b unless the backends are supervised.
+func requireCluster(b *testing.B) {
+	if cluster == nil {
+		b.Skip("requires -ngproxy.topology")
+	}
 }
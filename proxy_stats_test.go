@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+)
+
+var _ = Describe("Stats", func() {
+	var admin *redis.Client
+	var collector *stats.Collector
+
+	BeforeEach(func() {
+		admin = getRedisClient(proxyAddr, 1)
+
+		collector = stats.NewCollector(100 * time.Millisecond)
+		collector.Add("proxy", admin)
+		collector.Start()
+	})
+
+	AfterEach(func() {
+		collector.Stop()
+		Expect(admin.Close()).NotTo(HaveOccurred())
+	})
+
+	It("should parse proxy INFO", func() {
+		info := collector.First("proxy")
+		Expect(info).NotTo(BeNil())
+		Expect(info.Clients.ConnectedClients).To(BeNumerically(">=", 1))
+	})
+
+	It("should count processed commands", func() {
+		before := collector.ScrapeOne("proxy")
+		Expect(before.Err).NotTo(HaveOccurred())
+
+		client := getRedisClient(proxyAddr, 1)
+		defer client.Close()
+		for i := 0; i < 100; i++ {
+			Expect(client.Ping().Err()).NotTo(HaveOccurred())
+		}
+
+		after := collector.ScrapeOne("proxy")
+		Expect(after.Err).NotTo(HaveOccurred())
+		Expect(after.Info.Stats.TotalCommandsProcessed - before.Info.Stats.TotalCommandsProcessed).
+			To(BeNumerically(">=", 100))
+	})
+
+	It("should return connected_clients to baseline", func() {
+		first := collector.First("proxy")
+		Expect(first).NotTo(BeNil())
+		baseline := first.Clients.ConnectedClients
+
+		clients := make([]*redis.Client, 50)
+		for i := range clients {
+			clients[i] = getRedisClient(proxyAddr, 1)
+			Expect(clients[i].Ping().Err()).NotTo(HaveOccurred())
+		}
+		collector.Mark("clients connected")
+
+		Expect(connectedClients(collector, "proxy")).
+			To(BeNumerically(">=", baseline+int64(len(clients))))
+
+		for _, client := range clients {
+			Expect(client.Close()).NotTo(HaveOccurred())
+		}
+		collector.Mark("clients closed")
+
+		Eventually(func() (int64, error) {
+			return connectedClients(collector, "proxy")
+		}, 5*time.Second, 100*time.Millisecond).Should(Equal(baseline))
+	})
+})
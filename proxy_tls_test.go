@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+	"github.com/lidaohang/test-redis-ngproxy/certs"
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+	"github.com/lidaohang/test-redis-ngproxy/target"
+)
+
+var (
+	tlsEnabled = flag.Bool("ngproxy.tls", false, "dial the external proxy over TLS")
+	tlsCA      = flag.String("ngproxy.tls.ca", "",
+		"PEM file of the CA that signed the external proxy's certificate, the system roots if empty")
+	tlsServerName = flag.String("ngproxy.tls.servername", "",
+		"name expected in the external proxy's certificate, the host of proxyAddr if empty")
+	plainProxyAddr = flag.String("ngproxy.plainaddr", "",
+		"plaintext address of the same proxy, the baseline of the TLS benchmarks")
+)
+
+// proxyTLS and backendTLS configure TLS to the proxy and to the backends,
+// nil for plaintext. They are set by startCluster.
+var proxyTLS, backendTLS *tls.Config
+
+// dialerFor returns the go-redis Dialer for the proxy or backend at addr,
+// nil for the default plaintext dialer.
+func dialerFor(addr string) func() (net.Conn, error) {
+	return suite.Dialer(addr)
+}
+
+var _ = Describe("TLS", func() {
+	var dir string
+
+	BeforeEach(func() {
+		if proxyTLS == nil {
+			Skip("requires -ngproxy.tls or a topology with tls")
+		}
+
+		var err error
+		dir, err = ioutil.TempDir("", "ngproxy-tls")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if dir != "" {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+			dir = ""
+		}
+	})
+
+	It("should serve commands over TLS", func() {
+		var state tls.ConnectionState
+		client := redis.NewClient(&redis.Options{
+			Addr:     proxyAddr,
+			Password: *proxyPassword,
+			Dialer: func() (net.Conn, error) {
+				conn, err := target.DialTLS(proxyAddr, proxyTLS)
+				if err == nil {
+					state = conn.(*tls.Conn).ConnectionState()
+				}
+				return conn, err
+			},
+		})
+		defer client.Close()
+
+		Expect(client.Set("tls:key", "hello", 0).Err()).NotTo(HaveOccurred())
+		Expect(client.Get("tls:key").Val()).To(Equal("hello"))
+		Expect(client.Del("tls:key").Err()).NotTo(HaveOccurred())
+
+		Expect(state.HandshakeComplete).To(BeTrue())
+		Expect(state.PeerCertificates).NotTo(BeEmpty())
+	})
+
+	// Clients that reject the proxy's certificate abort the handshake with
+	// an alert. The proxy must drop those connections and keep serving.
+	It("should drop connections whose handshake the client aborted", func() {
+		admin := getRedisClient(proxyAddr, 1)
+		defer admin.Close()
+		collector := stats.NewCollector(time.Second)
+		collector.Add("proxy", admin)
+		before, err := connectedClients(collector, "proxy")
+		Expect(err).NotTo(HaveOccurred())
+
+		other, err := certs.Generate(dir, proxyTLS.ServerName)
+		Expect(err).NotTo(HaveOccurred())
+		mismatch := proxyTLS.Clone()
+		mismatch.ServerName = "wrong.example.com"
+
+		for i := 0; i < 20; i++ {
+			_, err = target.DialTLS(proxyAddr, other.ClientConfig(proxyTLS.ServerName))
+			var authErr x509.UnknownAuthorityError
+			Expect(errors.As(err, &authErr)).To(BeTrue(), "got %v", err)
+
+			_, err = target.DialTLS(proxyAddr, mismatch)
+			var hostErr x509.HostnameError
+			Expect(errors.As(err, &hostErr)).To(BeTrue(), "got %v", err)
+		}
+
+		Eventually(func() (int64, error) {
+			return connectedClients(collector, "proxy")
+		}, 5*time.Second, 100*time.Millisecond).Should(BeNumerically("<=", before))
+		Expect(admin.Ping().Err()).NotTo(HaveOccurred())
+	})
+
+	It("should refuse plaintext on the TLS port", func() {
+		conn, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		Expect(writeRaw(conn, []string{"PING"})).To(Succeed())
+
+		// The proxy answers with at most a TLS alert record and closes the
+		// connection, it never replies in RESP or waits for more.
+		data, err := ioutil.ReadAll(conn)
+		Expect(isTimeout(err)).To(BeFalse(), "the proxy kept the plaintext connection open")
+		if len(data) > 0 {
+			Expect(data[0]).To(Equal(byte(0x15)), "got %q instead of a TLS alert", data)
+		}
+	})
+})
+
+// benchmarkTLS runs GETs through the TLS proxy and, with a plaintext
+// address known, through the plaintext one as the baseline. With
+// newConnPerOp every GET dials a new connection.
+func benchmarkTLS(b *testing.B, newConnPerOp bool) {
+	if proxyTLS == nil {
+		b.Skip("requires -ngproxy.tls or a topology with tls")
+	}
+
+	run := func(b *testing.B, addr string, dialer func() (net.Conn, error)) {
+		poolSize := 10
+		if newConnPerOp {
+			poolSize = 1
+		}
+		client := redis.NewClient(&redis.Options{
+			Addr:         addr,
+			Password:     *proxyPassword,
+			Dialer:       dialer,
+			DialTimeout:  time.Second,
+			ReadTimeout:  time.Second,
+			WriteTimeout: time.Second,
+			PoolSize:     poolSize,
+		})
+		defer func() { client.Close() }()
+		if err := client.Set("tls:bench", "hello", 0).Err(); err != nil {
+			b.Fatal(err)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := client.Get("tls:bench").Err(); err != nil {
+				b.Fatal(err)
+			}
+			if newConnPerOp {
+				// Drop the pooled connection, the next GET dials again.
+				b.StopTimer()
+				client.Close()
+				client = redis.NewClient(client.Options())
+				b.StartTimer()
+			}
+		}
+	}
+
+	if *plainProxyAddr != "" {
+		b.Run("plaintext", func(b *testing.B) { run(b, *plainProxyAddr, nil) })
+	}
+	b.Run("tls", func(b *testing.B) { run(b, proxyAddr, dialerFor(proxyAddr)) })
+}
+
+func BenchmarkTLSGet(b *testing.B) {
+	benchmarkTLS(b, false)
+}
+
+/*
+每次GET都重新建连，对比TLS握手的开销
+*/
+func BenchmarkTLSConnect(b *testing.B) {
+	benchmarkTLS(b, true)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"reflect"
 	"time"
@@ -9,48 +10,41 @@ import (
 	. "github.com/onsi/gomega"
 
 	"github.com/go-redis/redis"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
 )
 
 var _ = Describe("Commands", func() {
 	var client *redis.Client
+	var ns *keyspace
 
 	BeforeEach(func() {
 		var options = &redis.Options{
-			Addr:     "10.94.106.240:8015",
-			Password: "", // no password set
-			DB:       0,  // use default DB
+			Addr:     proxyAddr,
+			Password: *proxyPassword,
+			Dialer:   dialerFor(proxyAddr),
+			DB:       0, // use default DB
 
 		}
 
-		client = redis.NewClient(options)
+		ns = newKeyspace()
+		client = ns.Wrap(redis.NewClient(options))
 	})
 
 	AfterEach(func() {
+		ns.Cleanup()
 		Expect(client.Close()).NotTo(HaveOccurred())
 	})
 
-	Describe("server", func() {
+	Describe("server [smoke]", func() {
 
-		It("should Ping", func() {
-			ping := client.Ping()
-			Expect(ping.Err()).NotTo(HaveOccurred())
-			Expect(ping.Val()).To(Equal("PONG"))
-		})
+		verifyChecks("server", func() (*redis.Client, *keyspace) { return client, ns })
 
 	})
 
-	Describe("keys", func() {
-
-		It("should Del", func() {
-			err := client.Set("key1", "Hello", 0).Err()
-			Expect(err).NotTo(HaveOccurred())
-			err = client.Set("key2", "World", 0).Err()
-			Expect(err).NotTo(HaveOccurred())
+	Describe("keys [smoke]", func() {
 
-			n, err := client.Del("key1", "key2").Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(n).To(Equal(int64(2)))
-		})
+		verifyChecks("keys", func() (*redis.Client, *keyspace) { return client, ns })
 
 		It("should Dump", func() {
 			set := client.Set("key", "hello", 0)
@@ -62,50 +56,6 @@ var _ = Describe("Commands", func() {
 			Expect(dump.Val()).NotTo(BeEmpty())
 		})
 
-		It("should Exists", func() {
-			set := client.Set("key1", "Hello", 0)
-			Expect(set.Err()).NotTo(HaveOccurred())
-			Expect(set.Val()).To(Equal("OK"))
-
-			n, err := client.Exists("key1").Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(n).To(Equal(int64(1)))
-
-			n, err = client.Exists("key2").Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(n).To(Equal(int64(0)))
-
-			n, err = client.Exists("key1", "key2").Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(n).To(Equal(int64(1)))
-
-			n, err = client.Exists("key1", "key1").Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(n).To(Equal(int64(2)))
-		})
-
-		It("should Expire", func() {
-			set := client.Set("key", "Hello", 0)
-			Expect(set.Err()).NotTo(HaveOccurred())
-			Expect(set.Val()).To(Equal("OK"))
-
-			expire := client.Expire("key", 10*time.Second)
-			Expect(expire.Err()).NotTo(HaveOccurred())
-			Expect(expire.Val()).To(Equal(true))
-
-			ttl := client.TTL("key")
-			Expect(ttl.Err()).NotTo(HaveOccurred())
-			Expect(ttl.Val()).To(Equal(10 * time.Second))
-
-			set = client.Set("key", "Hello World", 0)
-			Expect(set.Err()).NotTo(HaveOccurred())
-			Expect(set.Val()).To(Equal("OK"))
-
-			ttl = client.TTL("key")
-			Expect(ttl.Err()).NotTo(HaveOccurred())
-			Expect(ttl.Val() < 0).To(Equal(true))
-		})
-
 		It("should ExpireAt", func() {
 			set := client.Set("key", "Hello", 0)
 			Expect(set.Err()).NotTo(HaveOccurred())
@@ -221,59 +171,11 @@ var _ = Describe("Commands", func() {
 
 		})
 
-		It("should TTL", func() {
-			client.Del("key").Result()
-
-			ttl := client.TTL("key")
-			Expect(ttl.Err()).NotTo(HaveOccurred())
-			Expect(ttl.Val() < 0).To(Equal(true))
-
-			set := client.Set("key", "hello", 0)
-			Expect(set.Err()).NotTo(HaveOccurred())
-			Expect(set.Val()).To(Equal("OK"))
-
-			expire := client.Expire("key", 60*time.Second)
-			Expect(expire.Err()).NotTo(HaveOccurred())
-			Expect(expire.Val()).To(Equal(true))
-
-			ttl = client.TTL("key")
-			Expect(ttl.Err()).NotTo(HaveOccurred())
-			Expect(ttl.Val()).To(Equal(60 * time.Second))
-		})
-
-		It("should Type", func() {
-			set := client.Set("key", "hello", 0)
-			Expect(set.Err()).NotTo(HaveOccurred())
-			Expect(set.Val()).To(Equal("OK"))
-
-			type_ := client.Type("key")
-			Expect(type_.Err()).NotTo(HaveOccurred())
-			Expect(type_.Val()).To(Equal("string"))
-		})
-
 	})
 
-	Describe("strings", func() {
-
-		It("should Append", func() {
-			client.Del("key").Result()
-
-			n, err := client.Exists("key").Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(n).To(Equal(int64(0)))
-
-			append := client.Append("key", "Hello")
-			Expect(append.Err()).NotTo(HaveOccurred())
-			Expect(append.Val()).To(Equal(int64(5)))
+	Describe("strings [smoke]", func() {
 
-			append = client.Append("key", " World")
-			Expect(append.Err()).NotTo(HaveOccurred())
-			Expect(append.Val()).To(Equal(int64(11)))
-
-			get := client.Get("key")
-			Expect(get.Err()).NotTo(HaveOccurred())
-			Expect(get.Val()).To(Equal("Hello World"))
-		})
+		verifyChecks("strings", func() (*redis.Client, *keyspace) { return client, ns })
 
 		It("should BitCount", func() {
 			set := client.Set("key", "foobar", 0)
@@ -325,20 +227,6 @@ var _ = Describe("Commands", func() {
 			Expect(decrBy.Val()).To(Equal(int64(5)))
 		})
 
-		It("should Get", func() {
-			get := client.Get("_")
-			Expect(get.Err()).To(Equal(redis.Nil))
-			Expect(get.Val()).To(Equal(""))
-
-			set := client.Set("key", "hello", 0)
-			Expect(set.Err()).NotTo(HaveOccurred())
-			Expect(set.Val()).To(Equal("OK"))
-
-			get = client.Get("key")
-			Expect(get.Err()).NotTo(HaveOccurred())
-			Expect(get.Val()).To(Equal("hello"))
-		})
-
 		It("should GetBit", func() {
 			setBit := client.SetBit("key", 7, 1)
 			Expect(setBit.Err()).NotTo(HaveOccurred())
@@ -357,28 +245,6 @@ var _ = Describe("Commands", func() {
 			Expect(getBit.Val()).To(Equal(int64(0)))
 		})
 
-		It("should GetRange", func() {
-			set := client.Set("key", "This is a string", 0)
-			Expect(set.Err()).NotTo(HaveOccurred())
-			Expect(set.Val()).To(Equal("OK"))
-
-			getRange := client.GetRange("key", 0, 3)
-			Expect(getRange.Err()).NotTo(HaveOccurred())
-			Expect(getRange.Val()).To(Equal("This"))
-
-			getRange = client.GetRange("key", -3, -1)
-			Expect(getRange.Err()).NotTo(HaveOccurred())
-			Expect(getRange.Val()).To(Equal("ing"))
-
-			getRange = client.GetRange("key", 0, -1)
-			Expect(getRange.Err()).NotTo(HaveOccurred())
-			Expect(getRange.Val()).To(Equal("This is a string"))
-
-			getRange = client.GetRange("key", 10, 100)
-			Expect(getRange.Err()).NotTo(HaveOccurred())
-			Expect(getRange.Val()).To(Equal("string"))
-		})
-
 		It("should GetSet", func() {
 			client.Del("key").Result()
 
@@ -395,30 +261,6 @@ var _ = Describe("Commands", func() {
 			Expect(get.Val()).To(Equal("0"))
 		})
 
-		It("should Incr", func() {
-			set := client.Set("key", "10", 0)
-			Expect(set.Err()).NotTo(HaveOccurred())
-			Expect(set.Val()).To(Equal("OK"))
-
-			incr := client.Incr("key")
-			Expect(incr.Err()).NotTo(HaveOccurred())
-			Expect(incr.Val()).To(Equal(int64(11)))
-
-			get := client.Get("key")
-			Expect(get.Err()).NotTo(HaveOccurred())
-			Expect(get.Val()).To(Equal("11"))
-		})
-
-		It("should IncrBy", func() {
-			set := client.Set("key", "10", 0)
-			Expect(set.Err()).NotTo(HaveOccurred())
-			Expect(set.Val()).To(Equal("OK"))
-
-			incrBy := client.IncrBy("key", 5)
-			Expect(incrBy.Err()).NotTo(HaveOccurred())
-			Expect(incrBy.Val()).To(Equal(int64(15)))
-		})
-
 		It("should IncrByFloat", func() {
 			set := client.Set("key", "10.50", 0)
 			Expect(set.Err()).NotTo(HaveOccurred())
@@ -445,16 +287,6 @@ var _ = Describe("Commands", func() {
 			Expect(incrByFloat.Val()).To(Equal(float64(996945661)))
 		})
 
-		It("should MSetMGet", func() {
-			mSet := client.MSet("key1", "hello1", "key2", "hello2")
-			Expect(mSet.Err()).NotTo(HaveOccurred())
-			Expect(mSet.Val()).To(Equal("OK"))
-
-			mGet := client.MGet("key1", "key2", "_")
-			Expect(mGet.Err()).NotTo(HaveOccurred())
-			Expect(mGet.Val()).To(Equal([]interface{}{"hello1", "hello2", nil}))
-		})
-
 		It("should Set with expiration", func() {
 			err := client.Set("key", "hello", 100*time.Millisecond).Err()
 			Expect(err).NotTo(HaveOccurred())
@@ -468,16 +300,6 @@ var _ = Describe("Commands", func() {
 			}, "1s", "100ms").Should(Equal(redis.Nil))
 		})
 
-		It("should SetGet", func() {
-			set := client.Set("key", "hello", 0)
-			Expect(set.Err()).NotTo(HaveOccurred())
-			Expect(set.Val()).To(Equal("OK"))
-
-			get := client.Get("key")
-			Expect(get.Err()).NotTo(HaveOccurred())
-			Expect(get.Val()).To(Equal("hello"))
-		})
-
 		It("should SetNX", func() {
 			client.Del("key").Result()
 
@@ -578,7 +400,9 @@ var _ = Describe("Commands", func() {
 
 	})
 
-	Describe("hashes", func() {
+	Describe("hashes [smoke]", func() {
+
+		verifyChecks("hashes", func() (*redis.Client, *keyspace) { return client, ns })
 
 		It("should HDel", func() {
 			hSet := client.HSet("hash", "key", "hello")
@@ -608,53 +432,6 @@ var _ = Describe("Commands", func() {
 			Expect(hExists.Val()).To(Equal(false))
 		})
 
-		It("should HGet", func() {
-			client.Del("hash").Result()
-
-			hSet := client.HSet("hash", "key", "hello")
-			Expect(hSet.Err()).NotTo(HaveOccurred())
-
-			hGet := client.HGet("hash", "key")
-			Expect(hGet.Err()).NotTo(HaveOccurred())
-			Expect(hGet.Val()).To(Equal("hello"))
-
-			hGet = client.HGet("hash", "key1")
-			Expect(hGet.Err()).To(Equal(redis.Nil))
-			Expect(hGet.Val()).To(Equal(""))
-		})
-
-		It("should HGetAll", func() {
-			client.Del("hash").Result()
-
-			err := client.HSet("hash", "key1", "hello1").Err()
-			Expect(err).NotTo(HaveOccurred())
-			err = client.HSet("hash", "key2", "hello2").Err()
-			Expect(err).NotTo(HaveOccurred())
-
-			m, err := client.HGetAll("hash").Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(m).To(Equal(map[string]string{"key1": "hello1", "key2": "hello2"}))
-		})
-
-		It("should HIncrBy", func() {
-			client.Del("hash").Result()
-
-			hSet := client.HSet("hash", "key", "5")
-			Expect(hSet.Err()).NotTo(HaveOccurred())
-
-			hIncrBy := client.HIncrBy("hash", "key", 1)
-			Expect(hIncrBy.Err()).NotTo(HaveOccurred())
-			Expect(hIncrBy.Val()).To(Equal(int64(6)))
-
-			hIncrBy = client.HIncrBy("hash", "key", -1)
-			Expect(hIncrBy.Err()).NotTo(HaveOccurred())
-			Expect(hIncrBy.Val()).To(Equal(int64(5)))
-
-			hIncrBy = client.HIncrBy("hash", "key", -10)
-			Expect(hIncrBy.Err()).NotTo(HaveOccurred())
-			Expect(hIncrBy.Val()).To(Equal(int64(-5)))
-		})
-
 		It("should HIncrByFloat", func() {
 			client.Del("hash").Result()
 
@@ -737,18 +514,6 @@ var _ = Describe("Commands", func() {
 			Expect(v).To(Equal("hello2"))
 		})
 
-		It("should HSet", func() {
-			client.Del("hash").Result()
-
-			hSet := client.HSet("hash", "key", "hello")
-			Expect(hSet.Err()).NotTo(HaveOccurred())
-			Expect(hSet.Val()).To(Equal(true))
-
-			hGet := client.HGet("hash", "key")
-			Expect(hGet.Err()).NotTo(HaveOccurred())
-			Expect(hGet.Val()).To(Equal("hello"))
-		})
-
 		It("should HSetNX", func() {
 			client.Del("hash").Result()
 
@@ -787,6 +552,134 @@ var _ = Describe("Commands", func() {
 
 	Describe("lists", func() {
 
+		verifyChecks("lists", func() (*redis.Client, *keyspace) { return client, ns })
+
+		It("should BLPop", func() {
+			client.Del("list1").Result()
+
+			rPush := client.RPush("list1", "a", "b", "c")
+			Expect(rPush.Err()).NotTo(HaveOccurred())
+
+			bLPop := client.BLPop(time.Second, "list1")
+			Expect(bLPop.Err()).NotTo(HaveOccurred())
+			Expect(bLPop.Val()).To(Equal([]string{ns.Key("list1"), "a"}))
+		})
+
+		It("should BRPop", func() {
+			client.Del("list1").Result()
+
+			rPush := client.RPush("list1", "a", "b", "c")
+			Expect(rPush.Err()).NotTo(HaveOccurred())
+
+			bRPop := client.BRPop(time.Second, "list1")
+			Expect(bRPop.Err()).NotTo(HaveOccurred())
+			Expect(bRPop.Val()).To(Equal([]string{ns.Key("list1"), "c"}))
+		})
+
+		It("should wake up a blocked BLPop on push", func() {
+			client.Del("list").Result()
+
+			pushed := make(chan time.Time, 1)
+			go func() {
+				defer GinkgoRecover()
+
+				time.Sleep(200 * time.Millisecond)
+				other := ns.Wrap(redis.NewClient(client.Options()))
+				defer other.Close()
+				pushed <- time.Now()
+				Expect(other.RPush("list", "hello").Err()).NotTo(HaveOccurred())
+			}()
+
+			bLPop := client.BLPop(5*time.Second, "list")
+			Expect(bLPop.Err()).NotTo(HaveOccurred())
+			Expect(bLPop.Val()).To(Equal([]string{ns.Key("list"), "hello"}))
+			Expect(time.Since(<-pushed)).To(BeNumerically("<", 100*time.Millisecond))
+		})
+
+		It("should time out BLPop accurately", func() {
+			client.Del("list").Result()
+
+			start := time.Now()
+			bLPop := client.BLPop(time.Second, "list")
+			Expect(bLPop.Err()).To(Equal(redis.Nil))
+			Expect(time.Since(start)).To(BeNumerically("~", time.Second, 200*time.Millisecond))
+		})
+
+		It("should BRPopLPush on hash-tagged keys", func() {
+			client.Del("{list}src", "{list}dst").Result()
+
+			rPush := client.RPush("{list}src", "a", "b")
+			Expect(rPush.Err()).NotTo(HaveOccurred())
+
+			bRPopLPush := client.BRPopLPush("{list}src", "{list}dst", time.Second)
+			Expect(bRPopLPush.Err()).NotTo(HaveOccurred())
+			Expect(bRPopLPush.Val()).To(Equal("b"))
+
+			lRange := client.LRange("{list}dst", 0, -1)
+			Expect(lRange.Err()).NotTo(HaveOccurred())
+			Expect(lRange.Val()).To(Equal([]string{"b"}))
+		})
+
+		It("should BRPopLPush across shards or reject it", func() {
+			src, err := keyOn(ns.Key("list"), masterAddr)
+			Expect(err).NotTo(HaveOccurred())
+			dst, err := keyOff(ns.Key("list"), masterAddr)
+			if err != nil {
+				Skip(err.Error())
+			}
+			defer client.Del(src, dst)
+
+			rPush := client.RPush(src, "a")
+			Expect(rPush.Err()).NotTo(HaveOccurred())
+
+			bRPopLPush := client.BRPopLPush(src, dst, time.Second)
+			if rejectedByProxy(bRPopLPush.Err()) {
+				lLen := client.LLen(src)
+				Expect(lLen.Err()).NotTo(HaveOccurred())
+				Expect(lLen.Val()).To(Equal(int64(1)))
+				return
+			}
+			Expect(bRPopLPush.Val()).To(Equal("a"))
+
+			lRange := client.LRange(dst, 0, -1)
+			Expect(lRange.Err()).NotTo(HaveOccurred())
+			Expect(lRange.Val()).To(Equal([]string{"a"}))
+		})
+
+		It("should not pop for a blocked client that disconnected", func() {
+			key, err := keyOn(ns.Key("list"), masterAddr)
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Del(key)
+
+			backend := getRedisClient(masterAddr, 1)
+			defer backend.Close()
+			blocked := func() int64 {
+				raw, err := backend.Info("clients").Result()
+				Expect(err).NotTo(HaveOccurred())
+				info, err := stats.ParseInfo(raw)
+				Expect(err).NotTo(HaveOccurred())
+				return info.Clients.BlockedClients
+			}
+			baseline := blocked()
+
+			conn, err := dialProxy()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writeRaw(conn, []string{"BLPOP", key, "0"})).To(Succeed())
+			Eventually(blocked, 5*time.Second, 50*time.Millisecond).Should(Equal(baseline + 1))
+			Expect(conn.Close()).To(Succeed())
+
+			// The proxy must cancel the BLPOP on the backend, or at
+			// least not leave it blocked there for good.
+			Eventually(blocked, 5*time.Second, 50*time.Millisecond).Should(Equal(baseline))
+
+			rPush := client.RPush(key, "hello")
+			Expect(rPush.Err()).NotTo(HaveOccurred())
+
+			lRange := client.LRange(key, 0, -1)
+			Expect(lRange.Err()).NotTo(HaveOccurred())
+			Expect(lRange.Val()).To(Equal([]string{"hello"}))
+		})
+
 		It("should LIndex", func() {
 			client.Del("list").Result()
 
@@ -825,51 +718,6 @@ var _ = Describe("Commands", func() {
 			Expect(lRange.Val()).To(Equal([]string{"Hello", "There", "World"}))
 		})
 
-		It("should LLen", func() {
-			client.Del("list").Result()
-
-			lPush := client.LPush("list", "World")
-			Expect(lPush.Err()).NotTo(HaveOccurred())
-			lPush = client.LPush("list", "Hello")
-			Expect(lPush.Err()).NotTo(HaveOccurred())
-
-			lLen := client.LLen("list")
-			Expect(lLen.Err()).NotTo(HaveOccurred())
-			Expect(lLen.Val()).To(Equal(int64(2)))
-		})
-
-		It("should LPop", func() {
-			client.Del("list").Result()
-
-			rPush := client.RPush("list", "one")
-			Expect(rPush.Err()).NotTo(HaveOccurred())
-			rPush = client.RPush("list", "two")
-			Expect(rPush.Err()).NotTo(HaveOccurred())
-			rPush = client.RPush("list", "three")
-			Expect(rPush.Err()).NotTo(HaveOccurred())
-
-			lPop := client.LPop("list")
-			Expect(lPop.Err()).NotTo(HaveOccurred())
-			Expect(lPop.Val()).To(Equal("one"))
-
-			lRange := client.LRange("list", 0, -1)
-			Expect(lRange.Err()).NotTo(HaveOccurred())
-			Expect(lRange.Val()).To(Equal([]string{"two", "three"}))
-		})
-
-		It("should LPush", func() {
-			client.Del("list").Result()
-
-			lPush := client.LPush("list", "World")
-			Expect(lPush.Err()).NotTo(HaveOccurred())
-			lPush = client.LPush("list", "Hello")
-			Expect(lPush.Err()).NotTo(HaveOccurred())
-
-			lRange := client.LRange("list", 0, -1)
-			Expect(lRange.Err()).NotTo(HaveOccurred())
-			Expect(lRange.Val()).To(Equal([]string{"Hello", "World"}))
-		})
-
 		It("should LPushX", func() {
 			client.Del("list", "list1", "list2").Result()
 
@@ -893,48 +741,21 @@ var _ = Describe("Commands", func() {
 			Expect(lRange.Val()).To(Equal([]string{}))
 		})
 
-		It("should LRange", func() {
+		It("should LRem", func() {
 			client.Del("list").Result()
 
-			rPush := client.RPush("list", "one")
+			rPush := client.RPush("list", "hello")
 			Expect(rPush.Err()).NotTo(HaveOccurred())
-			rPush = client.RPush("list", "two")
+			rPush = client.RPush("list", "hello")
 			Expect(rPush.Err()).NotTo(HaveOccurred())
-			rPush = client.RPush("list", "three")
+			rPush = client.RPush("list", "key")
+			Expect(rPush.Err()).NotTo(HaveOccurred())
+			rPush = client.RPush("list", "hello")
 			Expect(rPush.Err()).NotTo(HaveOccurred())
 
-			lRange := client.LRange("list", 0, 0)
-			Expect(lRange.Err()).NotTo(HaveOccurred())
-			Expect(lRange.Val()).To(Equal([]string{"one"}))
-
-			lRange = client.LRange("list", -3, 2)
-			Expect(lRange.Err()).NotTo(HaveOccurred())
-			Expect(lRange.Val()).To(Equal([]string{"one", "two", "three"}))
-
-			lRange = client.LRange("list", -100, 100)
-			Expect(lRange.Err()).NotTo(HaveOccurred())
-			Expect(lRange.Val()).To(Equal([]string{"one", "two", "three"}))
-
-			lRange = client.LRange("list", 5, 10)
-			Expect(lRange.Err()).NotTo(HaveOccurred())
-			Expect(lRange.Val()).To(Equal([]string{}))
-		})
-
-		It("should LRem", func() {
-			client.Del("list").Result()
-
-			rPush := client.RPush("list", "hello")
-			Expect(rPush.Err()).NotTo(HaveOccurred())
-			rPush = client.RPush("list", "hello")
-			Expect(rPush.Err()).NotTo(HaveOccurred())
-			rPush = client.RPush("list", "key")
-			Expect(rPush.Err()).NotTo(HaveOccurred())
-			rPush = client.RPush("list", "hello")
-			Expect(rPush.Err()).NotTo(HaveOccurred())
-
-			lRem := client.LRem("list", -2, "hello")
-			Expect(lRem.Err()).NotTo(HaveOccurred())
-			Expect(lRem.Val()).To(Equal(int64(2)))
+			lRem := client.LRem("list", -2, "hello")
+			Expect(lRem.Err()).NotTo(HaveOccurred())
+			Expect(lRem.Val()).To(Equal(int64(2)))
 
 			lRange := client.LRange("list", 0, -1)
 			Expect(lRange.Err()).NotTo(HaveOccurred())
@@ -1002,22 +823,6 @@ var _ = Describe("Commands", func() {
 			Expect(lRange.Val()).To(Equal([]string{"one", "two"}))
 		})
 
-		It("should RPush", func() {
-			client.Del("list").Result()
-
-			rPush := client.RPush("list", "Hello")
-			Expect(rPush.Err()).NotTo(HaveOccurred())
-			Expect(rPush.Val()).To(Equal(int64(1)))
-
-			rPush = client.RPush("list", "World")
-			Expect(rPush.Err()).NotTo(HaveOccurred())
-			Expect(rPush.Val()).To(Equal(int64(2)))
-
-			lRange := client.LRange("list", 0, -1)
-			Expect(lRange.Err()).NotTo(HaveOccurred())
-			Expect(lRange.Val()).To(Equal([]string{"Hello", "World"}))
-		})
-
 		It("should RPushX", func() {
 			client.Del("list", "list2").Result()
 
@@ -1046,56 +851,7 @@ var _ = Describe("Commands", func() {
 
 	Describe("sets", func() {
 
-		It("should SAdd", func() {
-			client.Del("set").Result()
-
-			sAdd := client.SAdd("set", "Hello")
-			Expect(sAdd.Err()).NotTo(HaveOccurred())
-			Expect(sAdd.Val()).To(Equal(int64(1)))
-
-			sAdd = client.SAdd("set", "World")
-			Expect(sAdd.Err()).NotTo(HaveOccurred())
-			Expect(sAdd.Val()).To(Equal(int64(1)))
-
-			sAdd = client.SAdd("set", "World")
-			Expect(sAdd.Err()).NotTo(HaveOccurred())
-			Expect(sAdd.Val()).To(Equal(int64(0)))
-
-			sMembers := client.SMembers("set")
-			Expect(sMembers.Err()).NotTo(HaveOccurred())
-			Expect(sMembers.Val()).To(ConsistOf([]string{"Hello", "World"}))
-		})
-
-		It("should SCard", func() {
-			client.Del("set").Result()
-
-			sAdd := client.SAdd("set", "Hello")
-			Expect(sAdd.Err()).NotTo(HaveOccurred())
-			Expect(sAdd.Val()).To(Equal(int64(1)))
-
-			sAdd = client.SAdd("set", "World")
-			Expect(sAdd.Err()).NotTo(HaveOccurred())
-			Expect(sAdd.Val()).To(Equal(int64(1)))
-
-			sCard := client.SCard("set")
-			Expect(sCard.Err()).NotTo(HaveOccurred())
-			Expect(sCard.Val()).To(Equal(int64(2)))
-		})
-
-		It("should IsMember", func() {
-			client.Del("set").Result()
-
-			sAdd := client.SAdd("set", "one")
-			Expect(sAdd.Err()).NotTo(HaveOccurred())
-
-			sIsMember := client.SIsMember("set", "one")
-			Expect(sIsMember.Err()).NotTo(HaveOccurred())
-			Expect(sIsMember.Val()).To(Equal(true))
-
-			sIsMember = client.SIsMember("set", "two")
-			Expect(sIsMember.Err()).NotTo(HaveOccurred())
-			Expect(sIsMember.Val()).To(Equal(false))
-		})
+		verifyChecks("sets", func() (*redis.Client, *keyspace) { return client, ns })
 
 		It("should SMembers", func() {
 			client.Del("set").Result()
@@ -1180,29 +936,7 @@ var _ = Describe("Commands", func() {
 
 	Describe("sorted sets", func() {
 
-		It("should ZAdd", func() {
-			client.Del("zset").Result()
-
-			added, err := client.ZAdd("zset", redis.Z{1, "one"}).Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(added).To(Equal(int64(1)))
-
-			added, err = client.ZAdd("zset", redis.Z{1, "uno"}).Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(added).To(Equal(int64(1)))
-
-			added, err = client.ZAdd("zset", redis.Z{2, "two"}).Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(added).To(Equal(int64(1)))
-
-			added, err = client.ZAdd("zset", redis.Z{3, "two"}).Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(added).To(Equal(int64(0)))
-
-			vals, err := client.ZRangeWithScores("zset", 0, -1).Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(vals).To(Equal([]redis.Z{{1, "one"}, {1, "uno"}, {3, "two"}}))
-		})
+		verifyChecks("sorted sets", func() (*redis.Client, *keyspace) { return client, ns })
 
 		It("should ZAdd bytes", func() {
 			client.Del("zset").Result()
@@ -1280,46 +1014,6 @@ var _ = Describe("Commands", func() {
 			Expect(zCount.Val()).To(Equal(int64(2)))
 		})
 
-		It("should ZIncrBy", func() {
-			client.Del("zset").Result()
-
-			zAdd := client.ZAdd("zset", redis.Z{1, "one"})
-			Expect(zAdd.Err()).NotTo(HaveOccurred())
-			zAdd = client.ZAdd("zset", redis.Z{2, "two"})
-			Expect(zAdd.Err()).NotTo(HaveOccurred())
-
-			zIncrBy := client.ZIncrBy("zset", 2, "one")
-			Expect(zIncrBy.Err()).NotTo(HaveOccurred())
-			Expect(zIncrBy.Val()).To(Equal(float64(3)))
-
-			val, err := client.ZRangeWithScores("zset", 0, -1).Result()
-			Expect(err).NotTo(HaveOccurred())
-			Expect(val).To(Equal([]redis.Z{{2, "two"}, {3, "one"}}))
-		})
-
-		It("should ZRange", func() {
-			client.Del("zset").Result()
-
-			zAdd := client.ZAdd("zset", redis.Z{1, "one"})
-			Expect(zAdd.Err()).NotTo(HaveOccurred())
-			zAdd = client.ZAdd("zset", redis.Z{2, "two"})
-			Expect(zAdd.Err()).NotTo(HaveOccurred())
-			zAdd = client.ZAdd("zset", redis.Z{3, "three"})
-			Expect(zAdd.Err()).NotTo(HaveOccurred())
-
-			zRange := client.ZRange("zset", 0, -1)
-			Expect(zRange.Err()).NotTo(HaveOccurred())
-			Expect(zRange.Val()).To(Equal([]string{"one", "two", "three"}))
-
-			zRange = client.ZRange("zset", 2, 3)
-			Expect(zRange.Err()).NotTo(HaveOccurred())
-			Expect(zRange.Val()).To(Equal([]string{"three"}))
-
-			zRange = client.ZRange("zset", -2, -1)
-			Expect(zRange.Err()).NotTo(HaveOccurred())
-			Expect(zRange.Val()).To(Equal([]string{"two", "three"}))
-		})
-
 		It("should ZRangeWithScores", func() {
 			client.Del("zset").Result()
 
@@ -1724,15 +1418,585 @@ var _ = Describe("Commands", func() {
 			Expect(zRevRank.Val()).To(Equal(int64(0)))
 		})
 
-		It("should ZScore", func() {
-			client.Del("zset").Result()
+	})
 
-			zAdd := client.ZAdd("zset", redis.Z{1.001, "one"})
-			Expect(zAdd.Err()).NotTo(HaveOccurred())
+	Describe("hyperloglog", func() {
+
+		verifyChecks("hyperloglog", func() (*redis.Client, *keyspace) { return client, ns })
+
+		It("should PFCount and PFMerge hash-tagged keys", func() {
+			client.Del("{hll}1", "{hll}2", "{hll}3").Result()
+
+			Expect(client.PFAdd("{hll}1", "foo", "bar", "zap", "a").Err()).NotTo(HaveOccurred())
+			Expect(client.PFAdd("{hll}2", "a", "b", "c", "foo").Err()).NotTo(HaveOccurred())
+
+			pfCount := client.PFCount("{hll}1", "{hll}2")
+			Expect(pfCount.Err()).NotTo(HaveOccurred())
+			Expect(pfCount.Val()).To(Equal(int64(6)))
+
+			pfMerge := client.PFMerge("{hll}3", "{hll}1", "{hll}2")
+			Expect(pfMerge.Err()).NotTo(HaveOccurred())
+			Expect(pfMerge.Val()).To(Equal("OK"))
+
+			pfCount = client.PFCount("{hll}3")
+			Expect(pfCount.Err()).NotTo(HaveOccurred())
+			Expect(pfCount.Val()).To(Equal(int64(6)))
+		})
+
+		It("should PFCount and PFMerge keys of different shards or reject them", func() {
+			key1, err := keyOn(ns.Key("hll"), masterAddr)
+			Expect(err).NotTo(HaveOccurred())
+			key2, err := keyOff(ns.Key("hll"), masterAddr)
+			if err != nil {
+				Skip(err.Error())
+			}
+			defer client.Del(key1, key2)
+
+			Expect(client.PFAdd(key1, "foo", "bar", "zap", "a").Err()).NotTo(HaveOccurred())
+			Expect(client.PFAdd(key2, "a", "b", "c", "foo").Err()).NotTo(HaveOccurred())
 
-			zScore := client.ZScore("zset", "one")
-			Expect(zScore.Err()).NotTo(HaveOccurred())
-			Expect(zScore.Val()).To(Equal(float64(1.001)))
+			pfCount := client.PFCount(key1, key2)
+			if !rejectedByProxy(pfCount.Err()) {
+				Expect(pfCount.Val()).To(Equal(int64(6)))
+			}
+
+			pfMerge := client.PFMerge(key1, key1, key2)
+			if rejectedByProxy(pfMerge.Err()) {
+				return
+			}
+			pfCount = client.PFCount(key1)
+			Expect(pfCount.Err()).NotTo(HaveOccurred())
+			Expect(pfCount.Val()).To(Equal(int64(6)))
+		})
+
+	})
+
+	Describe("geo", func() {
+
+		var sicily = []*redis.GeoLocation{
+			{Longitude: 13.361389, Latitude: 38.115556, Name: "Palermo"},
+			{Longitude: 15.087269, Latitude: 37.502669, Name: "Catania"},
+		}
+
+		It("should GeoAdd, GeoDist, GeoPos and GeoHash", func() {
+			client.Del("Sicily").Result()
+
+			geoAdd := client.GeoAdd("Sicily", sicily...)
+			Expect(geoAdd.Err()).NotTo(HaveOccurred())
+			Expect(geoAdd.Val()).To(Equal(int64(2)))
+
+			geoDist := client.GeoDist("Sicily", "Palermo", "Catania", "km")
+			Expect(geoDist.Err()).NotTo(HaveOccurred())
+			Expect(geoDist.Val()).To(BeNumerically("~", 166.2742, 0.001))
+
+			geoPos := client.GeoPos("Sicily", "Palermo", "NonExisting")
+			Expect(geoPos.Err()).NotTo(HaveOccurred())
+			Expect(geoPos.Val()).To(HaveLen(2))
+			Expect(geoPos.Val()[0].Longitude).To(BeNumerically("~", 13.361389, 0.0001))
+			Expect(geoPos.Val()[0].Latitude).To(BeNumerically("~", 38.115556, 0.0001))
+			Expect(geoPos.Val()[1]).To(BeNil())
+
+			geoHash := client.GeoHash("Sicily", "Palermo", "Catania")
+			Expect(geoHash.Err()).NotTo(HaveOccurred())
+			Expect(geoHash.Val()).To(Equal([]string{"sqc8b49rny0", "sqdtr74hyu0"}))
+		})
+
+		It("should GeoRadius", func() {
+			client.Del("Sicily").Result()
+
+			geoAdd := client.GeoAdd("Sicily", sicily...)
+			Expect(geoAdd.Err()).NotTo(HaveOccurred())
+
+			geoRadius := client.GeoRadius("Sicily", 15, 37, &redis.GeoRadiusQuery{
+				Radius:   200,
+				Unit:     "km",
+				WithDist: true,
+				Sort:     "ASC",
+			})
+			Expect(geoRadius.Err()).NotTo(HaveOccurred())
+			Expect(geoRadius.Val()).To(HaveLen(2))
+			Expect(geoRadius.Val()[0].Name).To(Equal("Catania"))
+			Expect(geoRadius.Val()[0].Dist).To(BeNumerically("~", 56.4413, 0.001))
+			Expect(geoRadius.Val()[1].Name).To(Equal("Palermo"))
+
+			geoRadius = client.GeoRadiusByMember("Sicily", "Palermo", &redis.GeoRadiusQuery{
+				Radius: 100,
+				Unit:   "km",
+			})
+			Expect(geoRadius.Err()).NotTo(HaveOccurred())
+			Expect(geoRadius.Val()).To(HaveLen(1))
+			Expect(geoRadius.Val()[0].Name).To(Equal("Palermo"))
+		})
+
+		It("should GeoRadius STORE into a hash-tagged key", func() {
+			client.Del("{geo}Sicily", "{geo}near").Result()
+
+			geoAdd := client.GeoAdd("{geo}Sicily", sicily...)
+			Expect(geoAdd.Err()).NotTo(HaveOccurred())
+
+			store := doCmd(client, "GEORADIUS", "{geo}Sicily", 15, 37, 200, "km", "STORE", "{geo}near")
+			Expect(store.Err()).NotTo(HaveOccurred())
+			Expect(store.Val()).To(Equal(int64(2)))
+
+			zCard := client.ZCard("{geo}near")
+			Expect(zCard.Err()).NotTo(HaveOccurred())
+			Expect(zCard.Val()).To(Equal(int64(2)))
+		})
+
+		It("should GeoRadius STORE into a key of another shard or reject it", func() {
+			src, err := keyOn(ns.Key("geo"), masterAddr)
+			Expect(err).NotTo(HaveOccurred())
+			dst, err := keyOff(ns.Key("geo"), masterAddr)
+			if err != nil {
+				Skip(err.Error())
+			}
+			defer client.Del(src, dst)
+
+			geoAdd := client.GeoAdd(src, sicily...)
+			Expect(geoAdd.Err()).NotTo(HaveOccurred())
+
+			store := doCmd(client, "GEORADIUS", src, 15, 37, 200, "km", "STORE", dst)
+			if rejectedByProxy(store.Err()) {
+				return
+			}
+			Expect(store.Val()).To(Equal(int64(2)))
+
+			zCard := client.ZCard(dst)
+			Expect(zCard.Err()).NotTo(HaveOccurred())
+			Expect(zCard.Val()).To(Equal(int64(2)))
+		})
+
+	})
+
+	Describe("bitmaps", func() {
+
+		It("should BitPos", func() {
+			err := client.Set("key", "\xff\xf0\x00", 0).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			pos, err := client.BitPos("key", 0).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pos).To(Equal(int64(12)))
+
+			pos, err = client.BitPos("key", 1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pos).To(Equal(int64(0)))
+
+			pos, err = client.BitPos("key", 0, 2).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pos).To(Equal(int64(16)))
+
+			pos, err = client.BitPos("key", 1, 2).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pos).To(Equal(int64(-1)))
+
+			pos, err = client.BitPos("key", 0, 0, -1).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pos).To(Equal(int64(12)))
+		})
+
+		It("should BitOp on hash-tagged keys", func() {
+			client.Del("{bit}dest").Result()
+
+			Expect(client.Set("{bit}key1", "1", 0).Err()).NotTo(HaveOccurred())
+			Expect(client.Set("{bit}key2", "0", 0).Err()).NotTo(HaveOccurred())
+
+			for _, test := range []struct {
+				op     func(dest string, keys ...string) *redis.IntCmd
+				wanted string
+			}{
+				{client.BitOpAnd, "0"},
+				{client.BitOpOr, "1"},
+				{client.BitOpXor, "\x01"},
+			} {
+				bitOp := test.op("{bit}dest", "{bit}key1", "{bit}key2")
+				Expect(bitOp.Err()).NotTo(HaveOccurred())
+				Expect(bitOp.Val()).To(Equal(int64(1)))
+
+				get := client.Get("{bit}dest")
+				Expect(get.Err()).NotTo(HaveOccurred())
+				Expect(get.Val()).To(Equal(test.wanted))
+			}
+
+			bitOpNot := client.BitOpNot("{bit}dest", "{bit}key1")
+			Expect(bitOpNot.Err()).NotTo(HaveOccurred())
+			Expect(bitOpNot.Val()).To(Equal(int64(1)))
+
+			get := client.Get("{bit}dest")
+			Expect(get.Err()).NotTo(HaveOccurred())
+			Expect(get.Val()).To(Equal("\xce"))
+		})
+
+		It("should BitOp on keys of different shards or reject it", func() {
+			key1, err := keyOn(ns.Key("bit"), masterAddr)
+			Expect(err).NotTo(HaveOccurred())
+			key2, err := keyOff(ns.Key("bit"), masterAddr)
+			if err != nil {
+				Skip(err.Error())
+			}
+			defer client.Del(key1, key2)
+
+			Expect(client.Set(key1, "1", 0).Err()).NotTo(HaveOccurred())
+			Expect(client.Set(key2, "0", 0).Err()).NotTo(HaveOccurred())
+
+			bitOp := client.BitOpOr(key1, key1, key2)
+			if rejectedByProxy(bitOp.Err()) {
+				return
+			}
+			Expect(bitOp.Val()).To(Equal(int64(1)))
+
+			get := client.Get(key1)
+			Expect(get.Err()).NotTo(HaveOccurred())
+			Expect(get.Val()).To(Equal("1"))
+		})
+
+		It("should BitField", func() {
+			client.Del("key").Result()
+
+			bitField := doCmd(client, "BITFIELD", "key",
+				"SET", "i8", 0, 100,
+				"INCRBY", "u4", 8, 3,
+				"GET", "i8", 0,
+				"OVERFLOW", "SAT", "INCRBY", "u4", 8, 100)
+			if rejectedByProxy(bitField.Err()) {
+				return
+			}
+			Expect(bitField.Val()).To(Equal([]interface{}{int64(0), int64(3), int64(100), int64(15)}))
+		})
+
+	})
+
+	Describe("transactions", func() {
+
+		It("should MULTI/EXEC on a single key", func() {
+			client.Del(ns.Key("key")).Result()
+
+			cmds, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.Incr(ns.Key("key"))
+				pipe.IncrBy(ns.Key("key"), 10)
+				pipe.Expire(ns.Key("key"), time.Hour)
+				return nil
+			})
+			if rejectedByProxy(err) {
+				return
+			}
+			Expect(cmds).To(HaveLen(3))
+			Expect(cmds[0].(*redis.IntCmd).Val()).To(Equal(int64(1)))
+			Expect(cmds[1].(*redis.IntCmd).Val()).To(Equal(int64(11)))
+			Expect(cmds[2].(*redis.BoolCmd).Val()).To(Equal(true))
+		})
+
+		It("should MULTI/EXEC on hash-tagged keys", func() {
+			client.Del(ns.Key("{tx}key1"), ns.Key("{tx}key2")).Result()
+
+			cmds, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.Set(ns.Key("{tx}key1"), "hello1", 0)
+				pipe.Set(ns.Key("{tx}key2"), "hello2", 0)
+				pipe.MGet(ns.Key("{tx}key1"), ns.Key("{tx}key2"))
+				return nil
+			})
+			if rejectedByProxy(err) {
+				return
+			}
+			Expect(cmds).To(HaveLen(3))
+			Expect(cmds[2].(*redis.SliceCmd).Val()).To(Equal([]interface{}{"hello1", "hello2"}))
+		})
+
+		It("should MULTI/EXEC across shards or reject it as a whole", func() {
+			key1, err := keyOn(ns.Key("tx"), masterAddr)
+			Expect(err).NotTo(HaveOccurred())
+			key2, err := keyOff(ns.Key("tx"), masterAddr)
+			if err != nil {
+				Skip(err.Error())
+			}
+
+			_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.Set(key1, "hello1", 0)
+				pipe.Set(key2, "hello2", 0)
+				return nil
+			})
+			defer client.Del(key1, key2)
+			if rejectedByProxy(err) {
+				// Nothing of a rejected transaction may be applied.
+				n, err := client.Exists(key1, key2).Result()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(n).To(Equal(int64(0)))
+				return
+			}
+
+			vals, err := client.MGet(key1, key2).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vals).To(Equal([]interface{}{"hello1", "hello2"}))
+		})
+
+		It("should EXEC a WATCHed key that was not modified", func() {
+			err := client.Set(ns.Key("key"), "1", 0).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = client.Watch(func(tx *redis.Tx) error {
+				n, err := tx.Get(ns.Key("key")).Int64()
+				if err != nil {
+					return err
+				}
+				_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+					pipe.Set(ns.Key("key"), n+1, 0)
+					return nil
+				})
+				return err
+			}, ns.Key("key"))
+			if rejectedByProxy(err) {
+				return
+			}
+
+			get := client.Get(ns.Key("key"))
+			Expect(get.Err()).NotTo(HaveOccurred())
+			Expect(get.Val()).To(Equal("2"))
+		})
+
+		It("should abort EXEC when a WATCHed key is modified concurrently", func() {
+			other := ns.Wrap(redis.NewClient(client.Options()))
+			defer other.Close()
+
+			err := client.Set(ns.Key("key"), "1", 0).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			err = client.Watch(func(tx *redis.Tx) error {
+				n, err := tx.Get(ns.Key("key")).Int64()
+				if err != nil {
+					return err
+				}
+
+				err = other.Set(ns.Key("key"), "concurrent", 0).Err()
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+					pipe.Set(ns.Key("key"), n+1, 0)
+					return nil
+				})
+				return err
+			}, ns.Key("key"))
+			if err != redis.TxFailedErr && rejectedByProxy(err) {
+				return
+			}
+			Expect(err).To(Equal(redis.TxFailedErr))
+
+			get := client.Get(ns.Key("key"))
+			Expect(get.Err()).NotTo(HaveOccurred())
+			Expect(get.Val()).To(Equal("concurrent"))
+		})
+
+		It("should keep a WATCH based counter consistent under contention", func() {
+			err := client.Set(ns.Key("key"), "0", 0).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			incr := func(c *redis.Client) error {
+				for {
+					err := c.Watch(func(tx *redis.Tx) error {
+						n, err := tx.Get(ns.Key("key")).Int64()
+						if err != nil {
+							return err
+						}
+						_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+							pipe.Set(ns.Key("key"), n+1, 0)
+							return nil
+						})
+						return err
+					}, ns.Key("key"))
+					if err != redis.TxFailedErr {
+						return err
+					}
+				}
+			}
+
+			errs := make(chan error, 10)
+			for i := 0; i < 10; i++ {
+				go func() {
+					c := ns.Wrap(redis.NewClient(client.Options()))
+					defer c.Close()
+					for j := 0; j < 10; j++ {
+						if err := incr(c); err != nil {
+							errs <- err
+							return
+						}
+					}
+					errs <- nil
+				}()
+			}
+			for i := 0; i < 10; i++ {
+				err := <-errs
+				if rejectedByProxy(err) {
+					return
+				}
+			}
+
+			get := client.Get(ns.Key("key"))
+			Expect(get.Err()).NotTo(HaveOccurred())
+			Expect(get.Val()).To(Equal("100"))
+		})
+
+		It("should DISCARD a queued transaction", func() {
+			err := client.Set(ns.Key("key"), "hello", 0).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			conn, err := dialProxy()
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			r := bufio.NewReader(conn)
+
+			Expect(writeRaw(conn, []string{"MULTI"})).To(Succeed())
+			reply, err := readReply(r)
+			Expect(err).NotTo(HaveOccurred())
+			if _, ok := reply.(replyError); ok {
+				expectRejectedReply(reply)
+				return
+			}
+			Expect(reply).To(Equal("OK"))
+
+			Expect(writeRaw(conn,
+				[]string{"SET", ns.Key("key"), "discarded"},
+				[]string{"DISCARD"},
+				[]string{"GET", ns.Key("key")},
+			)).To(Succeed())
+			for _, wanted := range []interface{}{"QUEUED", "OK", []byte("hello")} {
+				reply, err := readReply(r)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(reply).To(Equal(wanted))
+			}
+		})
+
+		It("should abort EXEC after a queueing error", func() {
+			err := client.Set(ns.Key("key"), "hello", 0).Err()
+			Expect(err).NotTo(HaveOccurred())
+
+			conn, err := dialProxy()
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			r := bufio.NewReader(conn)
+
+			Expect(writeRaw(conn, []string{"MULTI"})).To(Succeed())
+			reply, err := readReply(r)
+			Expect(err).NotTo(HaveOccurred())
+			if _, ok := reply.(replyError); ok {
+				expectRejectedReply(reply)
+				return
+			}
+
+			Expect(writeRaw(conn,
+				[]string{"SET", ns.Key("key"), "aborted"},
+				[]string{"SET", ns.Key("key")},
+				[]string{"EXEC"},
+			)).To(Succeed())
+
+			reply, err = readReply(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reply).To(Equal("QUEUED"))
+
+			reply, err = readReply(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reply).To(BeAssignableToTypeOf(replyError("")))
+
+			reply, err = readReply(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reply).To(MatchError(HavePrefix("EXECABORT")))
+
+			get := client.Get(ns.Key("key"))
+			Expect(get.Err()).NotTo(HaveOccurred())
+			Expect(get.Val()).To(Equal("hello"))
+		})
+
+		It("should apply the rest of a transaction after a runtime error", func() {
+			err := client.Set(ns.Key("{tx}key1"), "hello", 0).Err()
+			Expect(err).NotTo(HaveOccurred())
+			client.Del(ns.Key("{tx}key2")).Result()
+
+			cmds, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.Incr(ns.Key("{tx}key1"))
+				pipe.Set(ns.Key("{tx}key2"), "World", 0)
+				return nil
+			})
+			Expect(err).To(HaveOccurred())
+			if err.Error() != "ERR value is not an integer or out of range" && rejectedByProxy(err) {
+				return
+			}
+			Expect(cmds).To(HaveLen(2))
+			Expect(cmds[0].Err()).To(MatchError("ERR value is not an integer or out of range"))
+			Expect(cmds[1].Err()).NotTo(HaveOccurred())
+
+			get := client.Get(ns.Key("{tx}key2"))
+			Expect(get.Err()).NotTo(HaveOccurred())
+			Expect(get.Val()).To(Equal("World"))
+		})
+
+	})
+
+	Describe("scripting", func() {
+
+		verifyChecks("scripting", func() (*redis.Client, *keyspace) { return client, ns })
+
+		It("should route EVAL by its first key", func() {
+			key, err := keyOn(ns.Key("lua"), masterAddr)
+			Expect(err).NotTo(HaveOccurred())
+			defer client.Del(key)
+
+			eval := setScript.Eval(client, []string{key}, "hello")
+			if rejectedByProxy(eval.Err()) {
+				return
+			}
+			Expect(eval.Val()).To(Equal("OK"))
+
+			backend := getRedisClient(masterAddr, 1)
+			defer backend.Close()
+			get := backend.Get(key)
+			Expect(get.Err()).NotTo(HaveOccurred())
+			Expect(get.Val()).To(Equal("hello"))
+		})
+
+		It("should EVAL without keys or reject it", func() {
+			eval := client.Eval(`return ARGV[1]`, nil, "hello")
+			if rejectedByProxy(eval.Err()) {
+				return
+			}
+			Expect(eval.Val()).To(Equal("hello"))
+		})
+
+		It("should EVAL on hash-tagged keys", func() {
+			client.Del("{lua}key1", "{lua}key2").Result()
+
+			eval := client.Eval(`
+				redis.call("SET", KEYS[1], ARGV[1])
+				redis.call("SET", KEYS[2], ARGV[2])
+				return redis.call("MGET", KEYS[1], KEYS[2])
+			`, []string{"{lua}key1", "{lua}key2"}, "hello1", "hello2")
+			if rejectedByProxy(eval.Err()) {
+				return
+			}
+			Expect(eval.Val()).To(Equal([]interface{}{"hello1", "hello2"}))
+		})
+
+		It("should reject EVAL on keys of different shards or keep them readable", func() {
+			key1, err := keyOn(ns.Key("lua"), masterAddr)
+			Expect(err).NotTo(HaveOccurred())
+			key2, err := keyOff(ns.Key("lua"), masterAddr)
+			if err != nil {
+				Skip(err.Error())
+			}
+			defer client.Del(key1, key2)
+
+			eval := client.Eval(`
+				redis.call("SET", KEYS[1], ARGV[1])
+				return redis.call("SET", KEYS[2], ARGV[2])
+			`, []string{key1, key2}, "hello1", "hello2")
+			if rejectedByProxy(eval.Err()) {
+				return
+			}
+
+			// A proxy that routes by the first key writes key2 to the
+			// wrong shard, where it can't be read back through the proxy.
+			vals, err := client.MGet(key1, key2).Result()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(vals).To(Equal([]interface{}{"hello1", "hello2"}))
 		})
 
 	})
@@ -1811,6 +2075,143 @@ var _ = Describe("Commands", func() {
 
 })
 
+// setScript sets KEYS[1] to ARGV[1].
+var setScript = redis.NewScript(`return redis.call("SET", KEYS[1], ARGV[1])`)
+
+// scriptLoadedOn returns, per master, whether the script is cached.
+func scriptLoadedOn(hash string) []bool {
+	var loaded []bool
+	for _, addr := range masterAddrs() {
+		backend := getRedisClient(addr, 1)
+		exists, err := backend.ScriptExists(hash).Result()
+		backend.Close()
+		Expect(err).NotTo(HaveOccurred())
+		loaded = append(loaded, exists[0])
+	}
+	return loaded
+}
+
+// The script cache is shared by every client of a backend, so these specs
+// would see each other's SCRIPT FLUSH when run in parallel. They only run
+// with -ngproxy.destructive, which the parallel run never sets.
+var _ = Describe("Script cache [destructive]", func() {
+	var client *redis.Client
+	var ns *keyspace
+
+	BeforeEach(func() {
+		requireDestructive()
+
+		ns = newKeyspace()
+		client = ns.Wrap(getRedisClient(proxyAddr, 10))
+	})
+
+	AfterEach(func() {
+		if client == nil {
+			return
+		}
+		ns.Cleanup()
+		Expect(client.Close()).NotTo(HaveOccurred())
+		client = nil
+	})
+
+	It("should EVALSHA a script loaded with SCRIPT LOAD", func() {
+		load := setScript.Load(client)
+		if rejectedByProxy(load.Err()) {
+			return
+		}
+		Expect(load.Val()).To(Equal(setScript.Hash()))
+
+		// SCRIPT LOAD either fans out to every master, or EVALSHA of
+		// a key on a master without the script is a clean NOSCRIPT.
+		loaded := scriptLoadedOn(setScript.Hash())
+		for i, addr := range masterAddrs() {
+			key, err := keyOn(ns.Key("lua"), addr)
+			Expect(err).NotTo(HaveOccurred())
+
+			evalSha := setScript.EvalSha(client, []string{key}, "hello")
+			client.Del(key)
+			if loaded[i] {
+				Expect(evalSha.Err()).NotTo(HaveOccurred())
+				Expect(evalSha.Val()).To(Equal("OK"))
+			} else {
+				Expect(evalSha.Err()).To(MatchError(HavePrefix("NOSCRIPT")))
+			}
+		}
+	})
+
+	It("should report SCRIPT EXISTS consistently with the backends", func() {
+		load := setScript.Load(client)
+		if rejectedByProxy(load.Err()) {
+			return
+		}
+
+		exists := client.ScriptExists(setScript.Hash(), "0000000000000000000000000000000000000000")
+		if rejectedByProxy(exists.Err()) {
+			return
+		}
+		Expect(exists.Val()).To(HaveLen(2))
+		Expect(exists.Val()[1]).To(Equal(false))
+
+		// Whether SCRIPT LOAD and SCRIPT EXISTS fan out or not, a
+		// false answer means some master really lacks the script.
+		loaded := scriptLoadedOn(setScript.Hash())
+		Expect(loaded).To(ContainElement(true))
+		if !exists.Val()[0] {
+			Expect(loaded).To(ContainElement(false))
+		}
+	})
+
+	It("should SCRIPT FLUSH every master", func() {
+		load := setScript.Load(client)
+		if rejectedByProxy(load.Err()) {
+			return
+		}
+
+		flush := client.ScriptFlush()
+		if rejectedByProxy(flush.Err()) {
+			return
+		}
+		Expect(flush.Val()).To(Equal("OK"))
+
+		Expect(scriptLoadedOn(setScript.Hash())).NotTo(ContainElement(true))
+	})
+
+	It("should fall back from EVALSHA to EVAL when a master lost its script cache", func() {
+		key, err := keyOn(ns.Key("lua"), masterAddr)
+		Expect(err).NotTo(HaveOccurred())
+		defer client.Del(key)
+
+		load := setScript.Load(client)
+		if rejectedByProxy(load.Err()) {
+			return
+		}
+
+		// A restarted master starts with an empty script cache, like a
+		// slave promoted by failover. Against the external proxy the
+		// master can't be restarted, flushing it directly looks the same.
+		if node := clusterNode(masterAddr); node != nil {
+			Expect(node.Restart()).To(Succeed())
+		} else {
+			backend := getRedisClient(masterAddr, 1)
+			defer backend.Close()
+			Expect(backend.ScriptFlush().Err()).NotTo(HaveOccurred())
+		}
+
+		// The proxy may need a moment to reconnect to the restarted master.
+		Eventually(func() error {
+			return setScript.EvalSha(client, []string{key}, "hello").Err()
+		}, 10*time.Second, 100*time.Millisecond).Should(MatchError(HavePrefix("NOSCRIPT")))
+
+		run := setScript.Run(client, []string{key}, "hello")
+		Expect(run.Err()).NotTo(HaveOccurred())
+		Expect(run.Val()).To(Equal("OK"))
+
+		get := client.Get(key)
+		Expect(get.Err()).NotTo(HaveOccurred())
+		Expect(get.Val()).To(Equal("hello"))
+	})
+})
+
 type numberStruct struct {
 	Number int
 }
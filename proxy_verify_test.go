@@ -0,0 +1,26 @@
+package main
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/go-redis/redis"
+
+	"github.com/lidaohang/test-redis-ngproxy/verify"
+)
+
+// verifyChecks registers a spec per check of verify.Checks in group, so that
+// the suite and the ngproxy-test verify command run the same checks. current
+// returns the client and keyspace of the enclosing container.
+func verifyChecks(group string, current func() (*redis.Client, *keyspace)) {
+	for _, check := range verify.Checks {
+		if check.Group != group {
+			continue
+		}
+		check := check
+		It("should "+check.Name, func() {
+			client, ns := current()
+			Expect(check.Run(client, ns.Key)).To(Succeed())
+		})
+	}
+}
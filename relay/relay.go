@@ -0,0 +1,284 @@
+// Package relay is a TCP relay that sits between ngproxy and a backend, or
+// between a client and ngproxy, and injects latency and stalls. It can
+// also terminate TLS in front of a plaintext proxy.
+package relay
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// Relay forwards every accepted connection to a target address.
+type Relay struct {
+	ln     net.Listener
+	target string
+
+	mu      sync.Mutex
+	latency time.Duration
+	stalled chan struct{} // closed while not stalled
+	conns   map[net.Conn]struct{}
+	closed  bool
+
+	// replyStall is the StallReplies in effect, nil for none.
+	replyStall *replyStall
+
+	wg sync.WaitGroup
+}
+
+// replyStall is one call of StallReplies. Every connection counts its own
+// budget of after bytes from the target from then on.
+type replyStall struct {
+	after   int
+	resumed chan struct{} // closed by Unstall
+}
+
+// replyBudget is the state of the current replyStall on one connection.
+type replyBudget struct {
+	stall *replyStall
+	left  int
+}
+
+// New listens on addr, e.g. "127.0.0.1:0", and relays to target.
+func New(addr, target string) (*Relay, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newRelay(ln, target), nil
+}
+
+// NewTLS is New with clients connecting over TLS. The relay terminates
+// TLS and forwards plaintext to target.
+func NewTLS(addr, target string, config *tls.Config) (*Relay, error) {
+	ln, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return newRelay(ln, target), nil
+}
+
+func newRelay(ln net.Listener, target string) *Relay {
+	r := &Relay{
+		ln:      ln,
+		target:  target,
+		stalled: make(chan struct{}),
+		conns:   make(map[net.Conn]struct{}),
+	}
+	close(r.stalled)
+
+	r.wg.Add(1)
+	go r.serve()
+	return r
+}
+
+// Addr is the address clients connect to.
+func (r *Relay) Addr() string {
+	return r.ln.Addr().String()
+}
+
+// Target is the address the relay forwards to.
+func (r *Relay) Target() string {
+	return r.target
+}
+
+// SetLatency delays every chunk of data in both directions by d.
+func (r *Relay) SetLatency(d time.Duration) {
+	r.mu.Lock()
+	r.latency = d
+	r.mu.Unlock()
+}
+
+// Stall stops forwarding data until Unstall while keeping every
+// connection open, like a backend that hangs.
+func (r *Relay) Stall() {
+	r.mu.Lock()
+	select {
+	case <-r.stalled:
+		r.stalled = make(chan struct{})
+	default:
+	}
+	r.mu.Unlock()
+}
+
+// StallReplies forwards after more bytes from the target on every
+// connection, then stops forwarding from the target until Unstall.
+// Requests still reach the target, so a client times out waiting for the
+// reply to a command that was applied, or in the middle of a reply.
+func (r *Relay) StallReplies(after int) {
+	r.mu.Lock()
+	if r.replyStall != nil {
+		close(r.replyStall.resumed)
+	}
+	r.replyStall = &replyStall{after: after, resumed: make(chan struct{})}
+	r.mu.Unlock()
+}
+
+// Unstall resumes forwarding after Stall or StallReplies.
+func (r *Relay) Unstall() {
+	r.mu.Lock()
+	select {
+	case <-r.stalled:
+	default:
+		close(r.stalled)
+	}
+	if r.replyStall != nil {
+		close(r.replyStall.resumed)
+		r.replyStall = nil
+	}
+	r.mu.Unlock()
+}
+
+// Reset closes every relayed connection, new ones are still accepted.
+func (r *Relay) Reset() {
+	r.mu.Lock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+	r.mu.Unlock()
+}
+
+// Close stops accepting and closes every relayed connection.
+func (r *Relay) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+
+	err := r.ln.Close()
+	r.Unstall()
+	r.Reset()
+	r.wg.Wait()
+	return err
+}
+
+func (r *Relay) serve() {
+	defer r.wg.Done()
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		r.wg.Add(1)
+		go r.handle(conn)
+	}
+}
+
+func (r *Relay) track(conns ...net.Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	for _, conn := range conns {
+		r.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (r *Relay) untrack(conns ...net.Conn) {
+	r.mu.Lock()
+	for _, conn := range conns {
+		delete(r.conns, conn)
+	}
+	r.mu.Unlock()
+}
+
+func (r *Relay) handle(client net.Conn) {
+	defer r.wg.Done()
+
+	backend, err := net.DialTimeout("tcp", r.target, 5*time.Second)
+	if err != nil {
+		client.Close()
+		return
+	}
+	if !r.track(client, backend) {
+		client.Close()
+		backend.Close()
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		r.pipe(backend, client, false)
+	}()
+	go func() {
+		defer wg.Done()
+		r.pipe(client, backend, true)
+	}()
+	wg.Wait()
+
+	r.untrack(client, backend)
+}
+
+// pipe copies src to dst applying the current latency and stall, and
+// closes both ends once either side is done. replies is set for the
+// direction from the target to the client.
+func (r *Relay) pipe(dst, src net.Conn, replies bool) {
+	defer dst.Close()
+	defer src.Close()
+
+	var budget replyBudget
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			r.mu.Lock()
+			latency := r.latency
+			stalled := r.stalled
+			r.mu.Unlock()
+
+			<-stalled
+			if latency > 0 {
+				time.Sleep(latency)
+			}
+			data := buf[:n]
+			if replies {
+				var werr error
+				if data, werr = r.forwardReplies(dst, data, &budget); werr != nil {
+					return
+				}
+			}
+			if _, werr := dst.Write(data); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// forwardReplies writes the part of data within the reply budget of the
+// connection to dst, waits while replies are stalled and returns the rest.
+func (r *Relay) forwardReplies(dst net.Conn, data []byte, budget *replyBudget) ([]byte, error) {
+	for len(data) > 0 {
+		r.mu.Lock()
+		stall := r.replyStall
+		r.mu.Unlock()
+		if stall == nil {
+			return data, nil
+		}
+		if budget.stall != stall {
+			budget.stall = stall
+			budget.left = stall.after
+		}
+
+		m := len(data)
+		if m > budget.left {
+			m = budget.left
+		}
+		budget.left -= m
+		if m == 0 {
+			<-stall.resumed
+			continue
+		}
+		if _, err := dst.Write(data[:m]); err != nil {
+			return nil, err
+		}
+		data = data[m:]
+	}
+	return data, nil
+}
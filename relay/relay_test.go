@@ -0,0 +1,178 @@
+package relay
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lidaohang/test-redis-ngproxy/certs"
+)
+
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	return ln
+}
+
+func roundTrip(t *testing.T, conn net.Conn) time.Duration {
+	start := time.Now()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("got %q", buf)
+	}
+	return time.Since(start)
+}
+
+func TestRelay(t *testing.T) {
+	ln := echoServer(t)
+	defer ln.Close()
+
+	r, err := New("127.0.0.1:0", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	conn, err := net.Dial("tcp", r.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	roundTrip(t, conn)
+
+	r.SetLatency(50 * time.Millisecond)
+	if d := roundTrip(t, conn); d < 100*time.Millisecond {
+		t.Fatalf("round trip took %s with 50ms latency each way", d)
+	}
+	r.SetLatency(0)
+
+	r.Stall()
+	time.AfterFunc(200*time.Millisecond, r.Unstall)
+	if d := roundTrip(t, conn); d < 200*time.Millisecond {
+		t.Fatalf("round trip took %s while stalled for 200ms", d)
+	}
+
+	r.Reset()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the connection to be closed by Reset")
+	}
+}
+
+func TestRelayStallReplies(t *testing.T) {
+	ln := echoServer(t)
+	defer ln.Close()
+
+	r, err := New("127.0.0.1:0", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	conn, err := net.Dial("tcp", r.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r.StallReplies(5)
+	if _, err := conn.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("got %q, %v before the stall", buf, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Fatalf("got %q while replies are stalled", buf[:n])
+	}
+
+	r.Unstall()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf = make([]byte, 6)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != " world" {
+		t.Fatalf("got %q, %v after Unstall", buf, err)
+	}
+	roundTrip(t, conn)
+}
+
+func TestRelayStallRepliesPerConnection(t *testing.T) {
+	ln := echoServer(t)
+	defer ln.Close()
+
+	r, err := New("127.0.0.1:0", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	r.StallReplies(5)
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", r.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write([]byte("hello world")); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("connection %d: got %q, %v within its budget", i, buf, err)
+		}
+	}
+}
+
+func TestRelayTLS(t *testing.T) {
+	ln := echoServer(t)
+	defer ln.Close()
+
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := certs.Generate(dir, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewTLS("127.0.0.1:0", ln.Addr().String(), b.ServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	conn, err := tls.Dial("tcp", r.Addr(), b.ClientConfig("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	roundTrip(t, conn)
+}
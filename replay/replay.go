@@ -0,0 +1,315 @@
+// Package replay sends the commands of captured client connections to the
+// proxy again. Captures are tcpflow output: the report.xml written by
+// "tcpflow -o dir port <proxy port>" and one file per direction of every
+// connection, of which the client to proxy files hold RESP requests.
+package replay
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Flow is one direction of a captured connection.
+type Flow struct {
+	File    string
+	Src     string
+	Dst     string
+	SrcPort int
+	DstPort int
+	Start   time.Time
+	End     time.Time
+}
+
+type fileobject struct {
+	Filename string `xml:"filename"`
+	Flow     struct {
+		Start   string `xml:"startime,attr"`
+		End     string `xml:"endtime,attr"`
+		Src     string `xml:"src_ipn,attr"`
+		Dst     string `xml:"dst_ipn,attr"`
+		SrcPort int    `xml:"srcport,attr"`
+		DstPort int    `xml:"dstport,attr"`
+	} `xml:"tcpflow"`
+}
+
+// LoadReport reads the flows of a tcpflow DFXML report. File is relative
+// to the report's directory. tcpflow reports a file again every time it
+// appends to it, only the first entry of a file is kept. A report cut off
+// by an interrupted tcpflow is read up to its last complete flow.
+func LoadReport(path string) ([]Flow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(path)
+	seen := make(map[string]bool)
+	var flows []Flow
+
+	dec := xml.NewDecoder(f)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return flows, nil
+		}
+		if err != nil {
+			if len(flows) > 0 {
+				return flows, nil
+			}
+			return nil, fmt.Errorf("replay: %s: %s", path, err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "fileobject" {
+			continue
+		}
+
+		var file fileobject
+		if err := dec.DecodeElement(&file, &start); err != nil {
+			return flows, nil
+		}
+		if file.Filename == "" || seen[file.Filename] {
+			continue
+		}
+		seen[file.Filename] = true
+
+		flow := Flow{
+			File:    filepath.Join(dir, file.Filename),
+			Src:     file.Flow.Src,
+			Dst:     file.Flow.Dst,
+			SrcPort: file.Flow.SrcPort,
+			DstPort: file.Flow.DstPort,
+		}
+		flow.Start, _ = time.Parse(time.RFC3339Nano, file.Flow.Start)
+		flow.End, _ = time.Parse(time.RFC3339Nano, file.Flow.End)
+		flows = append(flows, flow)
+	}
+}
+
+// ClientFlows returns the flows towards port, the requests of the clients,
+// in the order the connections started.
+func ClientFlows(flows []Flow, port int) []Flow {
+	var out []Flow
+	for _, flow := range flows {
+		if flow.DstPort == port {
+			out = append(out, flow)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+// ReadCommands parses a stream of requests, RESP arrays of bulk strings or
+// inline commands. A request cut off by the end of the capture is dropped.
+func ReadCommands(r io.Reader) ([][]string, error) {
+	br := bufio.NewReader(r)
+	var cmds [][]string
+	for {
+		args, err := readCommand(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return cmds, nil
+		}
+		if err != nil {
+			return cmds, err
+		}
+		if len(args) > 0 {
+			cmds = append(cmds, args)
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, fmt.Errorf("replay: malformed array header %q", line)
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		header, err := readLine(r)
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		if len(header) == 0 || header[0] != '$' {
+			return nil, fmt.Errorf("replay: malformed bulk header %q", header)
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("replay: malformed bulk header %q", header)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, noEOF(err)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// noEOF turns an EOF inside a request into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// DefaultSkip are commands that are not replayed because they would take
+// down or flush the backends, or change the state of the connection.
+var DefaultSkip = []string{
+	"shutdown", "debug", "flushall", "flushdb", "monitor", "slaveof",
+	"replicaof", "config", "client", "select", "auth", "quit",
+	"subscribe", "psubscribe", "unsubscribe", "punsubscribe",
+	"multi", "exec", "discard", "watch", "unwatch",
+}
+
+// CommandStats counts the replays of one command.
+type CommandStats struct {
+	Count  int `json:"count"`
+	Errors int `json:"errors"`
+}
+
+// Result summarizes a replay.
+type Result struct {
+	Flows    int                      `json:"flows"`
+	Commands int                      `json:"commands"`
+	Skipped  int                      `json:"skipped"`
+	Errors   int                      `json:"errors"`
+	Elapsed  time.Duration            `json:"elapsed_ns"`
+	Stats    map[string]*CommandStats `json:"commands_by_name"`
+	Failures []string                 `json:"failures,omitempty"`
+}
+
+// maxFailures bounds the failures kept in a Result.
+const maxFailures = 100
+
+// Replayer sends the commands of flows to a client. Flows are replayed
+// concurrently, the commands of a flow in order.
+type Replayer struct {
+	Client *redis.Client
+	// Skip are lower case command names not replayed, DefaultSkip if nil.
+	Skip []string
+	// Concurrency bounds the flows replayed at once, 10 if zero.
+	Concurrency int
+}
+
+// Run replays flows and returns the summary. It fails only if a flow
+// cannot be read.
+func (p *Replayer) Run(flows []Flow) (*Result, error) {
+	skip := p.Skip
+	if skip == nil {
+		skip = DefaultSkip
+	}
+	skipped := make(map[string]bool, len(skip))
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	concurrency := p.Concurrency
+	if concurrency <= 0 {
+		concurrency = 10
+	}
+
+	res := &Result{Stats: make(map[string]*CommandStats)}
+	var mu sync.Mutex
+	record := func(args []string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		name := strings.ToLower(args[0])
+		if skipped[name] {
+			res.Skipped++
+			return
+		}
+		s := res.Stats[name]
+		if s == nil {
+			s = &CommandStats{}
+			res.Stats[name] = s
+		}
+		res.Commands++
+		s.Count++
+		if err != nil && err != redis.Nil {
+			res.Errors++
+			s.Errors++
+			if len(res.Failures) < maxFailures {
+				res.Failures = append(res.Failures, fmt.Sprintf("%q: %s", args, err))
+			}
+		}
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var readErr error
+	sem := make(chan struct{}, concurrency)
+	for _, flow := range flows {
+		f, err := os.Open(flow.File)
+		if err != nil {
+			readErr = err
+			break
+		}
+		cmds, err := ReadCommands(f)
+		f.Close()
+		if err != nil {
+			readErr = fmt.Errorf("%s: %s", flow.File, err)
+			break
+		}
+		res.Flows++
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(cmds [][]string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			for _, args := range cmds {
+				if skipped[strings.ToLower(args[0])] {
+					record(args, nil)
+					continue
+				}
+				record(args, p.send(args))
+			}
+		}(cmds)
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+	return res, readErr
+}
+
+func (p *Replayer) send(args []string) error {
+	cmdArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		cmdArgs[i] = arg
+	}
+	cmd := redis.NewCmd(cmdArgs...)
+	p.Client.Process(cmd)
+	return cmd.Err()
+}
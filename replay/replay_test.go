@@ -0,0 +1,60 @@
+package replay
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadReport(t *testing.T) {
+	flows, err := LoadReport("../report.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) == 0 {
+		t.Fatal("no flows")
+	}
+	seen := make(map[string]bool)
+	for _, flow := range flows {
+		if seen[flow.File] {
+			t.Fatalf("%s reported twice", flow.File)
+		}
+		seen[flow.File] = true
+	}
+
+	clients := ClientFlows(flows, 8015)
+	if len(clients) == 0 || len(clients) == len(flows) {
+		t.Fatalf("got %d client flows of %d", len(clients), len(flows))
+	}
+	for i, flow := range clients {
+		if flow.DstPort != 8015 || flow.Start.IsZero() {
+			t.Fatalf("got %+v", flow)
+		}
+		if i > 0 && flow.Start.Before(clients[i-1].Start) {
+			t.Fatal("client flows are not in start order")
+		}
+	}
+}
+
+func TestReadCommands(t *testing.T) {
+	stream := "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nhe\r\no\r\n" +
+		"PING\r\n" +
+		"\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n" +
+		"*2\r\n$3\r\nGET\r\n$3\r\nk"
+
+	cmds, err := ReadCommands(strings.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"SET", "key", "he\r\no"}, {"PING"}, {"GET", "key"}}
+	if !reflect.DeepEqual(cmds, want) {
+		t.Fatalf("got %q, want %q", cmds, want)
+	}
+
+	_, err = ReadCommands(strings.NewReader("*x\r\n"))
+	if err == nil || err == io.ErrUnexpectedEOF {
+		t.Fatalf("got %v, want a malformed header error", err)
+	}
+}
@@ -0,0 +1,146 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"time"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+)
+
+// Chart geometry in SVG user units.
+const (
+	chartWidth  = 900
+	chartHeight = 260
+	marginLeft  = 70
+	marginRight = 160
+	marginTop   = 30
+	marginBelow = 40
+)
+
+// line is one series of a chart.
+type line struct {
+	Name   string
+	Color  string
+	Dashed bool
+
+	points []point
+}
+
+type point struct {
+	t time.Time
+	y float64
+}
+
+func (l *line) add(t time.Time, y float64) {
+	l.points = append(l.points, point{t, y})
+}
+
+// axis is the time axis shared by every chart of a run.
+type axis struct {
+	start, end time.Time
+	events     []stats.Event
+}
+
+func (a axis) x(t time.Time) float64 {
+	span := a.end.Sub(a.start).Seconds()
+	if span <= 0 {
+		span = 1
+	}
+	plot := float64(chartWidth - marginLeft - marginRight)
+	return marginLeft + plot*t.Sub(a.start).Seconds()/span
+}
+
+// chart draws lines as an inline SVG line chart with a y axis in unit and
+// the events as vertical markers.
+func (a axis) chart(title, unit string, lines []line) template.HTML {
+	max := 0.0
+	for _, l := range lines {
+		for _, p := range l.points {
+			max = math.Max(max, p.y)
+		}
+	}
+	top := niceCeil(max)
+	plot := float64(chartHeight - marginTop - marginBelow)
+	y := func(v float64) float64 {
+		return marginTop + plot - plot*v/top
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-size="11">`, chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<text x="%d" y="18" font-size="14" font-weight="bold">%s</text>`, marginLeft, html.EscapeString(title))
+
+	// Horizontal grid and y labels.
+	for i := 0; i <= 4; i++ {
+		v := top * float64(i) / 4
+		fmt.Fprintf(&b, `<line x1="%d" x2="%d" y1="%.1f" y2="%.1f" stroke="#eee"/>`,
+			marginLeft, chartWidth-marginRight, y(v), y(v))
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`, marginLeft-6, y(v)+4, formatValue(v))
+	}
+	fmt.Fprintf(&b, `<text x="12" y="%d" transform="rotate(-90 12 %d)" text-anchor="middle">%s</text>`,
+		chartHeight/2, chartHeight/2, html.EscapeString(unit))
+
+	// Time labels in seconds from the start.
+	span := a.end.Sub(a.start)
+	step := niceCeil(span.Seconds() / 8)
+	for s := 0.0; s <= span.Seconds(); s += step {
+		x := a.x(a.start.Add(time.Duration(s * float64(time.Second))))
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%ss</text>`, x, chartHeight-marginBelow+16, formatValue(s))
+	}
+	fmt.Fprintf(&b, `<line x1="%d" x2="%d" y1="%.1f" y2="%.1f" stroke="#888"/>`,
+		marginLeft, chartWidth-marginRight, y(0), y(0))
+
+	for _, e := range a.events {
+		x := a.x(e.Time)
+		fmt.Fprintf(&b, `<line x1="%.1f" x2="%.1f" y1="%d" y2="%.1f" stroke="#d62728" stroke-dasharray="4 3"/>`,
+			x, x, marginTop, y(0))
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" fill="#d62728" transform="rotate(-90 %.1f %d)" text-anchor="end">%s</text>`,
+			x+4, marginTop, x+4, marginTop, html.EscapeString(e.Name))
+	}
+
+	for i, l := range lines {
+		if len(l.points) > 0 {
+			dash := ""
+			if l.Dashed {
+				dash = ` stroke-dasharray="5 3"`
+			}
+			fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="1.5"%s points="`, l.Color, dash)
+			for _, p := range l.points {
+				fmt.Fprintf(&b, "%.1f,%.1f ", a.x(p.t), y(p.y))
+			}
+			b.WriteString(`"/>`)
+		}
+
+		ly := marginTop + 14*i
+		fmt.Fprintf(&b, `<line x1="%d" x2="%d" y1="%d" y2="%d" stroke="%s" stroke-width="2"/>`,
+			chartWidth-marginRight+10, chartWidth-marginRight+26, ly, ly, l.Color)
+		fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, chartWidth-marginRight+30, ly+4, html.EscapeString(l.Name))
+	}
+
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// niceCeil rounds v up to 1, 2 or 5 times a power of ten, 1 for v <= 0.
+func niceCeil(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	pow := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if v <= m*pow {
+			return m * pow
+		}
+	}
+	return 10 * pow
+}
+
+func formatValue(v float64) string {
+	if v == math.Trunc(v) {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.2g", v)
+}
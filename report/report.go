@@ -0,0 +1,185 @@
+// Package report writes the results of benchmark and chaos runs as a
+// self-contained HTML file for CI: a summary table and charts of latency,
+// throughput, errors and connection pool stats over time, with the fault
+// injections marked. The functional specs are reported as JUnit XML by
+// ginkgo's JUnit reporter instead.
+package report
+
+import (
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+// Series is the timeline of one workload, e.g. one profile or one shard.
+type Series struct {
+	Name   string
+	Points []workload.Point
+}
+
+// Table is a summary table.
+type Table struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// Run is everything reported about one run.
+type Run struct {
+	Title   string
+	Started time.Time
+	Summary *Table
+	Series  []Series
+	// Events are drawn as vertical markers, e.g. fault injections.
+	Events []stats.Event
+	// Pool are samples of the workload client, see stats.Sample.Pool.
+	Pool []stats.Sample
+}
+
+// WriteFile writes run as HTML to dir/name.html, creating dir, and returns
+// the path.
+func WriteFile(dir, name string, run *Run) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name+".html")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	err = WriteHTML(f, run)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return path, err
+}
+
+// WriteHTML writes run as a single HTML page without external resources.
+func WriteHTML(w io.Writer, run *Run) error {
+	end := run.Started
+	for _, s := range run.Series {
+		if n := len(s.Points); n > 0 && s.Points[n-1].Time.After(end) {
+			end = s.Points[n-1].Time
+		}
+	}
+	for _, s := range run.Pool {
+		if s.Time.After(end) {
+			end = s.Time
+		}
+	}
+	for _, e := range run.Events {
+		if e.Time.After(end) {
+			end = e.Time
+		}
+	}
+	axis := axis{start: run.Started, end: end, events: run.Events}
+
+	var latency, throughput, errs []line
+	for i, s := range run.Series {
+		color := palette[i%len(palette)]
+		p50 := line{Name: s.Name + " p50", Color: color, Dashed: true}
+		p99 := line{Name: s.Name + " p99", Color: color}
+		ops := line{Name: s.Name, Color: color}
+		failed := line{Name: s.Name, Color: color}
+		for j, p := range s.Points {
+			interval := time.Second
+			if j+1 < len(s.Points) {
+				interval = s.Points[j+1].Time.Sub(p.Time)
+			}
+			x := p.Time
+			ops.add(x, float64(p.Ops)/interval.Seconds())
+			failed.add(x, float64(p.Errors))
+			// Intervals without operations have no latency, not zero.
+			if p.Ops > 0 {
+				p50.add(x, ms(p.P50))
+				p99.add(x, ms(p.P99))
+			}
+		}
+		latency = append(latency, p50, p99)
+		throughput = append(throughput, ops)
+		errs = append(errs, failed)
+	}
+
+	total := line{Name: "total conns", Color: palette[0]}
+	free := line{Name: "free conns", Color: palette[1]}
+	timeouts := line{Name: "pool timeouts", Color: palette[3]}
+	for _, s := range run.Pool {
+		if s.Pool == nil {
+			continue
+		}
+		total.add(s.Time, float64(s.Pool.TotalConns))
+		free.add(s.Time, float64(s.Pool.FreeConns))
+		timeouts.add(s.Time, float64(s.Pool.Timeouts))
+	}
+
+	charts := []template.HTML{
+		axis.chart("Latency", "ms", latency),
+		axis.chart("Throughput", "ops/s", throughput),
+		axis.chart("Errors", "errors per interval", errs),
+	}
+	if len(total.points) > 0 {
+		charts = append(charts, axis.chart("Connection pool", "connections", []line{total, free, timeouts}))
+	}
+
+	var events []eventRow
+	for _, e := range run.Events {
+		events = append(events, eventRow{Offset: e.Time.Sub(run.Started).Round(time.Millisecond), Name: e.Name})
+	}
+
+	return page.Execute(w, struct {
+		*Run
+		Charts []template.HTML
+		Events []eventRow
+	}{run, charts, events})
+}
+
+type eventRow struct {
+	Offset time.Duration
+	Name   string
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+var palette = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f"}
+
+var page = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+svg { display: block; margin-bottom: 2em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Started {{.Started.Format "2006-01-02 15:04:05 MST"}}</p>
+{{with .Summary}}
+<h2>Summary</h2>
+<table>
+<tr>{{range .Columns}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}
+{{with .Events}}
+<h2>Events</h2>
+<table>
+<tr><th>event</th><th>offset</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.Offset}}</td></tr>
+{{end}}</table>
+{{end}}
+{{range .Charts}}{{.}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,74 @@
+package report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+	"github.com/lidaohang/test-redis-ngproxy/workload"
+)
+
+func TestWriteHTML(t *testing.T) {
+	start := time.Date(2017, 6, 8, 16, 41, 0, 0, time.UTC)
+	var points []workload.Point
+	for i := 0; i < 10; i++ {
+		points = append(points, workload.Point{
+			Time: start.Add(time.Duration(i) * time.Second),
+			Ops:  1000,
+			P50:  time.Millisecond,
+			P99:  5 * time.Millisecond,
+		})
+	}
+	points[5].Ops = 0
+	points[6].Errors = 7
+
+	run := &Run{
+		Title:   "master <pause>",
+		Started: start,
+		Summary: &Table{Columns: []string{"phase", "ops"}, Rows: [][]string{{"baseline", "5000"}}},
+		Series:  []Series{{Name: "faulty", Points: points}},
+		Events:  []stats.Event{{Time: start.Add(5 * time.Second), Name: "pause shard0-master"}},
+		Pool: []stats.Sample{
+			{Time: start, Pool: &redis.PoolStats{TotalConns: 10, FreeConns: 10}},
+			{Time: start.Add(9 * time.Second), Pool: &redis.PoolStats{TotalConns: 10, FreeConns: 2, Timeouts: 3}},
+		},
+	}
+
+	var b bytes.Buffer
+	if err := WriteHTML(&b, run); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"<title>master &lt;pause&gt;</title>",
+		"<td>baseline</td>",
+		"pause shard0-master",
+		"<td>5s</td>",
+		">Latency<", ">Throughput<", ">Errors<", ">Connection pool<",
+		"faulty p99",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q", want)
+		}
+	}
+	if strings.Contains(out, "<pause>") {
+		t.Error("title is not escaped")
+	}
+	if strings.Contains(out, "<script") || strings.Contains(out, "src=") {
+		t.Error("report loads external resources")
+	}
+}
+
+func TestNiceCeil(t *testing.T) {
+	for _, c := range []struct{ in, want float64 }{
+		{0, 1}, {0.3, 0.5}, {1, 1}, {1.1, 2}, {4, 5}, {7, 10}, {1234, 2000},
+	} {
+		if got := niceCeil(c.in); got != c.want {
+			t.Errorf("niceCeil(%v) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
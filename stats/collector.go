@@ -0,0 +1,212 @@
+package stats
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Sample is one INFO scrape of one target, with the connection pool
+// stats of the client it was scraped through, or of the pool given to
+// AddPool.
+type Sample struct {
+	Time time.Time
+	Info *Info
+	Pool *redis.PoolStats
+	Err  error
+}
+
+// Event marks a point of the workload timeline, e.g. "master shutdown".
+type Event struct {
+	Time time.Time
+	Name string
+}
+
+// Collector periodically runs INFO against a set of named targets and
+// keeps every sample together with the workload events.
+type Collector struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	targets map[string]target
+	names   []string
+	samples map[string][]Sample
+	events  []Event
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// target is scraped through client, its samples carry the pool stats of
+// pool.
+type target struct {
+	client, pool *redis.Client
+}
+
+// NewCollector returns a collector that scrapes every interval once
+// started.
+func NewCollector(interval time.Duration) *Collector {
+	return &Collector{
+		interval: interval,
+		targets:  make(map[string]target),
+		samples:  make(map[string][]Sample),
+	}
+}
+
+// Add registers a target under name. The collector does not own the
+// client and never closes it.
+func (c *Collector) Add(name string, client *redis.Client) {
+	c.AddPool(name, client, client)
+}
+
+// AddPool registers a target under name that is scraped through client,
+// with the pool stats of pool in its samples. It keeps INFO off the pool
+// of a measured workload, which may be saturated or broken by a fault.
+func (c *Collector) AddPool(name string, client, pool *redis.Client) {
+	c.mu.Lock()
+	if _, ok := c.targets[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.targets[name] = target{client, pool}
+	c.mu.Unlock()
+}
+
+// Start takes a first sample of every target synchronously, so that it
+// can be used as the baseline, and then keeps scraping in background.
+func (c *Collector) Start() {
+	c.stop = make(chan struct{})
+	c.Scrape()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.Scrape()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops background scraping and takes a final sample.
+func (c *Collector) Stop() {
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	c.wg.Wait()
+	c.stop = nil
+	c.Scrape()
+}
+
+// Scrape samples every target once.
+func (c *Collector) Scrape() {
+	c.mu.Lock()
+	names := append([]string(nil), c.names...)
+	c.mu.Unlock()
+
+	for _, name := range names {
+		c.scrape(name)
+	}
+}
+
+// ScrapeOne samples a single target once and returns the sample.
+func (c *Collector) ScrapeOne(name string) Sample {
+	return c.scrape(name)
+}
+
+func (c *Collector) scrape(name string) Sample {
+	c.mu.Lock()
+	t := c.targets[name]
+	c.mu.Unlock()
+
+	s := Sample{Time: time.Now(), Pool: t.pool.PoolStats()}
+	raw, err := t.client.Info().Result()
+	if err == nil {
+		s.Info, err = ParseInfo(raw)
+	}
+	s.Err = err
+
+	c.mu.Lock()
+	c.samples[name] = append(c.samples[name], s)
+	c.mu.Unlock()
+	return s
+}
+
+// Mark records a workload event at the current time.
+func (c *Collector) Mark(name string) {
+	c.mu.Lock()
+	c.events = append(c.events, Event{Time: time.Now(), Name: name})
+	c.mu.Unlock()
+}
+
+// Events returns the recorded workload events.
+func (c *Collector) Events() []Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Event(nil), c.events...)
+}
+
+// Samples returns every sample of the named target in scrape order.
+func (c *Collector) Samples(name string) []Sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Sample(nil), c.samples[name]...)
+}
+
+// First returns the first successful sample of the named target.
+func (c *Collector) First(name string) *Info {
+	for _, s := range c.Samples(name) {
+		if s.Err == nil {
+			return s.Info
+		}
+	}
+	return nil
+}
+
+// Last returns the last successful sample of the named target.
+func (c *Collector) Last(name string) *Info {
+	samples := c.Samples(name)
+	for i := len(samples) - 1; i >= 0; i-- {
+		if samples[i].Err == nil {
+			return samples[i].Info
+		}
+	}
+	return nil
+}
+
+// Before returns the last successful sample of the named target taken
+// before the named event, or nil if there is none.
+func (c *Collector) Before(name, event string) *Info {
+	at, ok := c.eventTime(event)
+	if !ok {
+		return nil
+	}
+	var info *Info
+	for _, s := range c.Samples(name) {
+		if s.Time.After(at) {
+			break
+		}
+		if s.Err == nil {
+			info = s.Info
+		}
+	}
+	return info
+}
+
+func (c *Collector) eventTime(name string) (time.Time, bool) {
+	for _, e := range c.Events() {
+		if e.Name == name {
+			return e.Time, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,153 @@
+// Package stats scrapes INFO from ngproxy and its redis backends so that
+// tests can assert on the proxy's own view of clients, memory and traffic.
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Server is the "# Server" section.
+type Server struct {
+	Version         string
+	ProcessID       int64
+	TCPPort         int64
+	UptimeInSeconds int64
+}
+
+// Clients is the "# Clients" section.
+type Clients struct {
+	ConnectedClients int64
+	BlockedClients   int64
+}
+
+// Memory is the "# Memory" section.
+type Memory struct {
+	UsedMemory    int64
+	UsedMemoryRss int64
+}
+
+// Stats is the "# Stats" section. ngproxy reports its backend reconnects
+// here as well; BackendReconnections is -1 when INFO has no such field,
+// e.g. from redis-server, so that it is not mistaken for no reconnect.
+type Stats struct {
+	TotalConnectionsReceived int64
+	TotalCommandsProcessed   int64
+	RejectedConnections      int64
+	KeyspaceHits             int64
+	KeyspaceMisses           int64
+	BackendReconnections     int64
+}
+
+// Replication is the "# Replication" section.
+type Replication struct {
+	Role            string
+	ConnectedSlaves int64
+	MasterLinkUp    bool
+}
+
+// Info is a parsed INFO reply. Sections keeps every raw field so that
+// fields without a typed counterpart can still be asserted on.
+type Info struct {
+	Sections map[string]map[string]string
+
+	Server      Server
+	Clients     Clients
+	Memory      Memory
+	Stats       Stats
+	Replication Replication
+}
+
+// Get returns the raw value of field in section, section is matched
+// case-insensitively.
+func (i *Info) Get(section, field string) (string, bool) {
+	fields, ok := i.Sections[strings.ToLower(section)]
+	if !ok {
+		return "", false
+	}
+	v, ok := fields[field]
+	return v, ok
+}
+
+// Int returns field in section as an integer, or 0 if it is missing.
+func (i *Info) Int(section, field string) int64 {
+	v, _ := i.Get(section, field)
+	n, _ := strconv.ParseInt(v, 10, 64)
+	return n
+}
+
+// ParseInfo parses the bulk string returned by INFO.
+func ParseInfo(s string) (*Info, error) {
+	info := &Info{
+		Sections: make(map[string]map[string]string),
+	}
+
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			section = strings.ToLower(strings.TrimSpace(line[1:]))
+			continue
+		}
+
+		ind := strings.IndexByte(line, ':')
+		if ind < 0 {
+			return nil, fmt.Errorf("stats: malformed INFO line: %q", line)
+		}
+		fields, ok := info.Sections[section]
+		if !ok {
+			fields = make(map[string]string)
+			info.Sections[section] = fields
+		}
+		fields[line[:ind]] = line[ind+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	v, _ := info.Get("server", "redis_version")
+	if v == "" {
+		v, _ = info.Get("server", "version")
+	}
+	info.Server = Server{
+		Version:         v,
+		ProcessID:       info.Int("server", "process_id"),
+		TCPPort:         info.Int("server", "tcp_port"),
+		UptimeInSeconds: info.Int("server", "uptime_in_seconds"),
+	}
+	info.Clients = Clients{
+		ConnectedClients: info.Int("clients", "connected_clients"),
+		BlockedClients:   info.Int("clients", "blocked_clients"),
+	}
+	info.Memory = Memory{
+		UsedMemory:    info.Int("memory", "used_memory"),
+		UsedMemoryRss: info.Int("memory", "used_memory_rss"),
+	}
+	reconnects := int64(-1)
+	if _, ok := info.Get("stats", "backend_reconnections"); ok {
+		reconnects = info.Int("stats", "backend_reconnections")
+	}
+	info.Stats = Stats{
+		TotalConnectionsReceived: info.Int("stats", "total_connections_received"),
+		TotalCommandsProcessed:   info.Int("stats", "total_commands_processed"),
+		RejectedConnections:      info.Int("stats", "rejected_connections"),
+		KeyspaceHits:             info.Int("stats", "keyspace_hits"),
+		KeyspaceMisses:           info.Int("stats", "keyspace_misses"),
+		BackendReconnections:     reconnects,
+	}
+	role, _ := info.Get("replication", "role")
+	link, _ := info.Get("replication", "master_link_status")
+	info.Replication = Replication{
+		Role:            role,
+		ConnectedSlaves: info.Int("replication", "connected_slaves"),
+		MasterLinkUp:    link == "up",
+	}
+
+	return info, nil
+}
@@ -0,0 +1,59 @@
+package stats
+
+import "testing"
+
+const redisInfo = "# Server\r\n" +
+	"redis_version:3.2.8\r\n" +
+	"process_id:4242\r\n" +
+	"tcp_port:8001\r\n" +
+	"\r\n" +
+	"# Clients\r\n" +
+	"connected_clients:12\r\n" +
+	"blocked_clients:1\r\n" +
+	"\r\n" +
+	"# Memory\r\n" +
+	"used_memory:1048576\r\n" +
+	"used_memory_rss:2097152\r\n" +
+	"\r\n" +
+	"# Stats\r\n" +
+	"total_connections_received:100\r\n" +
+	"total_commands_processed:5000\r\n" +
+	"\r\n" +
+	"# Replication\r\n" +
+	"role:slave\r\n" +
+	"master_host:127.0.0.1\r\n" +
+	"master_link_status:up\r\n"
+
+func TestParseInfo(t *testing.T) {
+	info, err := ParseInfo(redisInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Server.Version != "3.2.8" || info.Server.ProcessID != 4242 || info.Server.TCPPort != 8001 {
+		t.Fatalf("got server %+v", info.Server)
+	}
+	if info.Clients.ConnectedClients != 12 || info.Clients.BlockedClients != 1 {
+		t.Fatalf("got clients %+v", info.Clients)
+	}
+	if info.Memory.UsedMemory != 1048576 || info.Memory.UsedMemoryRss != 2097152 {
+		t.Fatalf("got memory %+v", info.Memory)
+	}
+	if info.Stats.TotalCommandsProcessed != 5000 || info.Stats.BackendReconnections != -1 {
+		t.Fatalf("got stats %+v", info.Stats)
+	}
+	if info.Replication.Role != "slave" || !info.Replication.MasterLinkUp {
+		t.Fatalf("got replication %+v", info.Replication)
+	}
+
+	host, ok := info.Get("Replication", "master_host")
+	if !ok || host != "127.0.0.1" {
+		t.Fatalf("got master_host=%q, %v", host, ok)
+	}
+}
+
+func TestParseInfoMalformed(t *testing.T) {
+	if _, err := ParseInfo("# Server\r\nredis_version\r\n"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,56 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Proc is a sample of a locally running process taken from /proc.
+type Proc struct {
+	Time time.Time
+	FDs  int
+	// RSS is the resident set size in bytes.
+	RSS int64
+}
+
+// ReadProc samples the open file descriptors and resident memory of pid.
+func ReadProc(pid int) (Proc, error) {
+	p := Proc{Time: time.Now()}
+
+	fds, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return p, err
+	}
+	p.FDs = len(fds)
+
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return p, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "VmRSS:") {
+			continue
+		}
+		// VmRSS:	    1234 kB
+		fields := strings.Fields(line[len("VmRSS:"):])
+		if len(fields) == 0 {
+			break
+		}
+		kb, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return p, err
+		}
+		p.RSS = kb * 1024
+		break
+	}
+	return p, scanner.Err()
+}
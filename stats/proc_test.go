@@ -0,0 +1,16 @@
+package stats
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReadProc(t *testing.T) {
+	p, err := ReadProc(os.Getpid())
+	if err != nil {
+		t.Skip(err)
+	}
+	if p.FDs == 0 || p.RSS == 0 {
+		t.Fatalf("got %+v", p)
+	}
+}
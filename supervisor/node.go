@@ -0,0 +1,265 @@
+package supervisor
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Node roles.
+const (
+	RoleProxy  = "proxy"
+	RoleMaster = "master"
+	RoleSlave  = "slave"
+)
+
+var errNotRunning = errors.New("supervisor: node is not running")
+
+// Node is one locally launched process: ngproxy or a redis-server.
+type Node struct {
+	Name  string
+	Role  string
+	Shard string
+	Addr  string
+
+	// master is the node this slave replicates from.
+	master *Node
+	// password is sent with AUTH by Client.
+	password string
+	// tlsConfig is used by Client when the node serves TLS.
+	tlsConfig *tls.Config
+
+	binary  string
+	args    []string
+	logPath string
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	done   chan struct{}
+	paused bool
+}
+
+// Pid returns the pid of the running process or 0.
+func (n *Node) Pid() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.cmd == nil || n.cmd.Process == nil {
+		return 0
+	}
+	return n.cmd.Process.Pid
+}
+
+// Running reports whether the process has been started and not exited.
+func (n *Node) Running() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.done == nil {
+		return false
+	}
+	select {
+	case <-n.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Client returns a new client connected to the node.
+func (n *Node) Client() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:         n.Addr,
+		Password:     n.password,
+		TLSConfig:    n.tlsConfig,
+		DialTimeout:  time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		PoolSize:     1,
+	})
+}
+
+// start launches the process and waits until it answers PING.
+func (n *Node) start() error {
+	logFile, err := os.OpenFile(n.logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(n.binary, n.args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// Own process group, so that a ^C of the test run reaches the
+	// supervisor instead of killing the nodes behind its back.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return fmt.Errorf("supervisor: %s: %s", n.Name, err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		logFile.Close()
+		close(done)
+	}()
+
+	n.mu.Lock()
+	n.cmd = cmd
+	n.done = done
+	n.paused = false
+	n.mu.Unlock()
+
+	return n.waitReady(10 * time.Second)
+}
+
+func (n *Node) waitReady(timeout time.Duration) error {
+	client := n.Client()
+	defer client.Close()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := client.Ping().Err()
+		if err == nil {
+			break
+		}
+		if !n.Running() {
+			return fmt.Errorf("supervisor: %s exited, see %s", n.Name, n.logPath)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("supervisor: %s is not ready after %s: %s", n.Name, timeout, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if n.master != nil {
+		return n.replicate(client, timeout)
+	}
+	return nil
+}
+
+// replicate makes the node a slave of its master and waits for the link.
+func (n *Node) replicate(client *redis.Client, timeout time.Duration) error {
+	host, port, err := net.SplitHostPort(n.master.Addr)
+	if err != nil {
+		return err
+	}
+	if err := client.SlaveOf(host, port).Err(); err != nil {
+		return fmt.Errorf("supervisor: %s: SLAVEOF %s: %s", n.Name, n.master.Addr, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := client.Info("replication").Result()
+		if err == nil && masterLinkUp(info) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("supervisor: %s: replication link to %s is not up after %s",
+				n.Name, n.master.Addr, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (n *Node) signal(sig os.Signal) error {
+	n.mu.Lock()
+	cmd := n.cmd
+	n.mu.Unlock()
+	if cmd == nil || !n.Running() {
+		return errNotRunning
+	}
+	return cmd.Process.Signal(sig)
+}
+
+func (n *Node) wait(timeout time.Duration) error {
+	n.mu.Lock()
+	done := n.done
+	n.mu.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("supervisor: %s did not exit after %s", n.Name, timeout)
+	}
+}
+
+// Kill sends SIGKILL and waits for the process to exit.
+func (n *Node) Kill() error {
+	if err := n.signal(syscall.SIGKILL); err != nil {
+		return err
+	}
+	return n.wait(5 * time.Second)
+}
+
+// Stop sends SIGTERM and waits for the process to exit. A paused node is
+// resumed first so that it can handle the signal.
+func (n *Node) Stop() error {
+	if err := n.signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	if n.isPaused() {
+		if err := n.Resume(); err != nil {
+			return err
+		}
+	}
+	return n.wait(10 * time.Second)
+}
+
+// Pause sends SIGSTOP. The process keeps its sockets open but stops
+// answering, which is how a hung backend looks to the proxy.
+func (n *Node) Pause() error {
+	if err := n.signal(syscall.SIGSTOP); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.paused = true
+	n.mu.Unlock()
+	return nil
+}
+
+// Resume sends SIGCONT to a paused node.
+func (n *Node) Resume() error {
+	if err := n.signal(syscall.SIGCONT); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.paused = false
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *Node) isPaused() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.paused
+}
+
+// Restart stops the node if it is running and starts it again on the same
+// address. A restarted slave replicates from its master again.
+func (n *Node) Restart() error {
+	if n.Running() {
+		if err := n.Stop(); err != nil {
+			return err
+		}
+	}
+	return n.start()
+}
+
+// shutdown kills the node without reporting a node that is already gone.
+func (n *Node) shutdown() error {
+	if !n.Running() {
+		return nil
+	}
+	if err := n.Kill(); err != nil && err != errNotRunning {
+		return err
+	}
+	return nil
+}
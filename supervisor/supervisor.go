@@ -0,0 +1,361 @@
+// Package supervisor launches ngproxy and its redis backends locally from a
+// config.Topology, so that tests can kill, pause and restart them.
+package supervisor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+
+	"github.com/lidaohang/test-redis-ngproxy/certs"
+	"github.com/lidaohang/test-redis-ngproxy/config"
+	"github.com/lidaohang/test-redis-ngproxy/relay"
+	"github.com/lidaohang/test-redis-ngproxy/stats"
+)
+
+// ShardData is the view of a shard passed to the proxy templates.
+type ShardData struct {
+	Name   string
+	Master string
+	Slaves []string
+}
+
+// ProxyData is passed to the proxy config template and args.
+type ProxyData struct {
+	Addr       string
+	Port       int
+	Dir        string
+	ConfigFile string
+	Shards     []ShardData
+
+	Password        string
+	BackendPassword string
+
+	// TLS is set when the proxy itself serves clients over TLS and
+	// BackendTLS when the backends only accept TLS. The files are PEM.
+	TLS        bool
+	BackendTLS bool
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+}
+
+// Supervisor owns every process of a topology.
+type Supervisor struct {
+	topo *config.Topology
+	dir  string
+
+	Proxy   *Node
+	Masters []*Node
+	Slaves  []*Node
+
+	nodes  map[string]*Node
+	order  []*Node
+	relays map[string]*relay.Relay
+
+	certs      *certs.Bundle
+	terminator *relay.Relay
+}
+
+// New allocates free ports and a working directory for topo. Nothing is
+// started until Start is called.
+func New(topo *config.Topology) (*Supervisor, error) {
+	dir, err := ioutil.TempDir("", "ngproxy-test")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Supervisor{
+		topo:   topo,
+		dir:    dir,
+		nodes:  make(map[string]*Node),
+		relays: make(map[string]*relay.Relay),
+	}
+
+	if err := s.init(); err != nil {
+		s.Stop()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Supervisor) init() error {
+	if s.topo.TLS.Enabled() {
+		b, err := certs.Generate(filepath.Join(s.dir, "tls"), s.topo.Host)
+		if err != nil {
+			return err
+		}
+		s.certs = b
+	}
+
+	for _, shard := range s.topo.Shards {
+		master, err := s.newRedis(shard.Name+"-master", RoleMaster, shard.Name, nil)
+		if err != nil {
+			return err
+		}
+		s.Masters = append(s.Masters, master)
+
+		if shard.Relay {
+			r, err := relay.New(net.JoinHostPort(s.topo.Host, "0"), master.Addr)
+			if err != nil {
+				return err
+			}
+			s.relays[shard.Name] = r
+		}
+
+		for i := 1; i <= shard.Slaves; i++ {
+			name := shard.Name + "-slave" + strconv.Itoa(i)
+			slave, err := s.newRedis(name, RoleSlave, shard.Name, master)
+			if err != nil {
+				return err
+			}
+			s.Slaves = append(s.Slaves, slave)
+		}
+	}
+
+	return s.newProxy()
+}
+
+// Dir is the working directory holding configs, data and logs.
+func (s *Supervisor) Dir() string {
+	return s.dir
+}
+
+// Node returns the node with the given name, e.g. "proxy",
+// "shard0-master" or "shard0-slave1".
+func (s *Supervisor) Node(name string) *Node {
+	return s.nodes[name]
+}
+
+// Relay returns the relay between the proxy and the master of shard, or
+// nil if the shard has none.
+func (s *Supervisor) Relay(shard string) *relay.Relay {
+	return s.relays[shard]
+}
+
+// Certs returns the generated certificates, nil without TLS.
+func (s *Supervisor) Certs() *certs.Bundle {
+	return s.certs
+}
+
+// TLSAddr is the address clients dial over TLS: the proxy itself, or the
+// terminating relay in front of it. It is empty without client TLS.
+func (s *Supervisor) TLSAddr() string {
+	switch {
+	case s.terminator != nil:
+		return s.terminator.Addr()
+	case s.topo.TLS.Proxy:
+		return s.Proxy.Addr
+	}
+	return ""
+}
+
+// Nodes returns every node in start order.
+func (s *Supervisor) Nodes() []*Node {
+	return append([]*Node(nil), s.order...)
+}
+
+// Start launches the backends, configures replication and then launches
+// the proxy. On error everything started so far is killed.
+func (s *Supervisor) Start() error {
+	for _, n := range s.order {
+		if err := n.start(); err != nil {
+			s.Stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop kills every node in reverse start order and removes the working
+// directory. It is safe to call more than once.
+func (s *Supervisor) Stop() error {
+	var firstErr error
+	for i := len(s.order) - 1; i >= 0; i-- {
+		if err := s.order[i].shutdown(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, r := range s.relays {
+		r.Close()
+	}
+	if s.terminator != nil {
+		s.terminator.Close()
+	}
+	if err := os.RemoveAll(s.dir); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func (s *Supervisor) add(n *Node) {
+	s.nodes[n.Name] = n
+	s.order = append(s.order, n)
+}
+
+func (s *Supervisor) newRedis(name, role, shard string, master *Node) (*Node, error) {
+	port, err := freePort(s.topo.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(s.dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"--port", strconv.Itoa(port),
+		"--bind", s.topo.Host,
+		"--dir", dir,
+		"--daemonize", "no",
+	}
+	if s.topo.TLS.Backends {
+		// TLS only: the plaintext port is disabled.
+		args[1] = "0"
+		args = append(args,
+			"--tls-port", strconv.Itoa(port),
+			"--tls-cert-file", s.certs.CertFile,
+			"--tls-key-file", s.certs.KeyFile,
+			"--tls-ca-cert-file", s.certs.CAFile,
+			"--tls-auth-clients", "no",
+			"--tls-replication", "yes")
+	}
+	if s.topo.BackendPassword != "" {
+		args = append(args,
+			"--requirepass", s.topo.BackendPassword,
+			"--masterauth", s.topo.BackendPassword)
+	}
+	args = append(args, s.topo.RedisArgs...)
+
+	n := &Node{
+		Name:     name,
+		Role:     role,
+		Shard:    shard,
+		Addr:     net.JoinHostPort(s.topo.Host, strconv.Itoa(port)),
+		master:   master,
+		password: s.topo.BackendPassword,
+		binary:   s.topo.RedisServer,
+		args:     args,
+		logPath:  filepath.Join(s.dir, name+".log"),
+	}
+	if s.topo.TLS.Backends {
+		n.tlsConfig = s.certs.ClientConfig(s.topo.Host)
+	}
+	s.add(n)
+	return n, nil
+}
+
+func (s *Supervisor) newProxy() error {
+	port, err := freePort(s.topo.Host)
+	if err != nil {
+		return err
+	}
+
+	data := ProxyData{
+		Addr:       net.JoinHostPort(s.topo.Host, strconv.Itoa(port)),
+		Port:       port,
+		Dir:        s.dir,
+		ConfigFile: filepath.Join(s.dir, "ngproxy.conf"),
+
+		Password:        s.topo.Password,
+		BackendPassword: s.topo.BackendPassword,
+
+		TLS:        s.topo.TLS.Proxy,
+		BackendTLS: s.topo.TLS.Backends,
+	}
+	if s.certs != nil {
+		data.CAFile = s.certs.CAFile
+		data.CertFile = s.certs.CertFile
+		data.KeyFile = s.certs.KeyFile
+	}
+	for _, master := range s.Masters {
+		shard := ShardData{Name: master.Shard, Master: master.Addr}
+		if r := s.relays[master.Shard]; r != nil {
+			shard.Master = r.Addr()
+		}
+		for _, slave := range s.Slaves {
+			if slave.master == master {
+				shard.Slaves = append(shard.Slaves, slave.Addr)
+			}
+		}
+		data.Shards = append(data.Shards, shard)
+	}
+
+	if s.topo.Proxy.ConfigTemplate != "" {
+		tmpl, err := template.ParseFiles(s.topo.Proxy.ConfigTemplate)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(data.ConfigFile, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	args := make([]string, len(s.topo.Proxy.Args))
+	for i, arg := range s.topo.Proxy.Args {
+		tmpl, err := template.New("arg").Parse(arg)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return err
+		}
+		args[i] = buf.String()
+	}
+
+	s.Proxy = &Node{
+		Name:     RoleProxy,
+		Role:     RoleProxy,
+		Addr:     data.Addr,
+		password: s.topo.Password,
+		binary:   s.topo.Proxy.Binary,
+		args:     args,
+		logPath:  filepath.Join(s.dir, "ngproxy.log"),
+	}
+	if s.topo.TLS.Proxy {
+		s.Proxy.tlsConfig = s.certs.ClientConfig(s.topo.Host)
+	}
+	s.add(s.Proxy)
+
+	if s.topo.TLS.Terminate {
+		r, err := relay.NewTLS(net.JoinHostPort(s.topo.Host, "0"), s.Proxy.Addr, s.certs.ServerConfig())
+		if err != nil {
+			return err
+		}
+		s.terminator = r
+	}
+	return nil
+}
+
+// freePort asks the kernel for an unused port on host.
+func freePort(host string) (int, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func masterLinkUp(raw string) bool {
+	info, err := stats.ParseInfo(raw)
+	if err != nil {
+		return false
+	}
+	return info.Replication.MasterLinkUp
+}
+
+func (s *Supervisor) String() string {
+	return fmt.Sprintf("Supervisor<%s proxy=%s shards=%d>", s.dir, s.Proxy.Addr, len(s.Masters))
+}
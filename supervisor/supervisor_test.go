@@ -0,0 +1,124 @@
+package supervisor
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/go-redis/redis"
+	"github.com/lidaohang/test-redis-ngproxy/config"
+)
+
+// redis-server stands in for the proxy here: it answers PING on the
+// rendered port, which is all the supervisor needs.
+func testTopology(t *testing.T) *config.Topology {
+	path, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("redis-server is not installed")
+	}
+	return &config.Topology{
+		RedisServer: path,
+		RedisArgs:   []string{"--save", "", "--appendonly", "no"},
+		Host:        "127.0.0.1",
+		Proxy: config.Proxy{
+			Binary: path,
+			Args:   []string{"--port", "{{.Port}}", "--save", ""},
+		},
+		Shards: []config.Shard{{Name: "shard0", Slaves: 1}},
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	s, err := New(testTopology(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	master := s.Node("shard0-master")
+	slave := s.Node("shard0-slave1")
+	if master == nil || slave == nil || s.Proxy == nil {
+		t.Fatalf("got nodes %v", s.Nodes())
+	}
+
+	client := master.Client()
+	defer client.Close()
+	if err := client.Set("key", "hello", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := master.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping().Err(); err == nil {
+		t.Fatal("paused master answered PING")
+	}
+	if err := master.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping().Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := slave.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	if slave.Running() {
+		t.Fatal("killed slave is running")
+	}
+	if err := slave.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	slaveClient := slave.Client()
+	defer slaveClient.Close()
+	if err := slaveClient.Get("key").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Proxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Proxy.Restart(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSupervisorTerminateTLS(t *testing.T) {
+	topo := testTopology(t)
+	topo.TLS.Terminate = true
+
+	s, err := New(topo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if s.TLSAddr() == "" || s.TLSAddr() == s.Proxy.Addr {
+		t.Fatalf("got TLS address %q for proxy %s", s.TLSAddr(), s.Proxy.Addr)
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:      s.TLSAddr(),
+		TLSConfig: s.Certs().ClientConfig(topo.Host),
+	})
+	defer client.Close()
+	if err := client.Ping().Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFreePort(t *testing.T) {
+	port, err := freePort("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port == 0 {
+		t.Fatal("got port 0")
+	}
+}
@@ -0,0 +1,183 @@
+// Package target is the proxy and backends the test suite and the
+// ngproxy-test commands run against: an externally managed proxy, or a
+// topology launched for the run.
+package target
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/lidaohang/test-redis-ngproxy/certs"
+	"github.com/lidaohang/test-redis-ngproxy/config"
+	"github.com/lidaohang/test-redis-ngproxy/supervisor"
+)
+
+// Target is configured from flags, Start replaces the addresses, passwords
+// and TLS configs by the launched ones when Topology is set.
+type Target struct {
+	Topology string
+
+	// Proxy, Master and Slave are the addresses of the proxy, of a master
+	// and of a slave of the master's shard. PlainProxy is the plaintext
+	// address of a TLS proxy, empty if none.
+	Proxy      string
+	Master     string
+	Slave      string
+	PlainProxy string
+
+	// Password the proxy requires from clients and password the backends
+	// require, empty for none.
+	Password        string
+	BackendPassword string
+
+	// TLS dials the external proxy over TLS, checking its certificate
+	// against TLSCA, the system roots if empty, for TLSServerName, the host
+	// of Proxy if empty.
+	TLS           bool
+	TLSCA         string
+	TLSServerName string
+
+	// Cluster is the launched topology, nil for the external proxy.
+	Cluster *supervisor.Supervisor
+
+	// ProxyTLS and BackendTLS configure TLS to the proxy and to the
+	// backends, nil for plaintext.
+	ProxyTLS, BackendTLS *tls.Config
+}
+
+// Start launches the topology, or configures TLS to the external proxy.
+func (t *Target) Start() error {
+	if t.Topology == "" {
+		return t.setupTLS()
+	}
+
+	topo, err := config.Load(t.Topology)
+	if err != nil {
+		return err
+	}
+	s, err := supervisor.New(topo)
+	if err != nil {
+		return err
+	}
+	if err := s.Start(); err != nil {
+		return err
+	}
+	t.Cluster = s
+
+	t.Password = topo.Password
+	t.BackendPassword = topo.BackendPassword
+
+	t.Proxy = s.Proxy.Addr
+	if b := s.Certs(); b != nil {
+		if topo.TLS.Backends {
+			t.BackendTLS = b.ClientConfig(topo.Host)
+		}
+		if addr := s.TLSAddr(); addr != "" {
+			if topo.TLS.Terminate {
+				t.PlainProxy = t.Proxy
+			}
+			t.Proxy = addr
+			t.ProxyTLS = b.ClientConfig(topo.Host)
+		}
+	}
+	t.Master = s.Masters[0].Addr
+	for _, slave := range s.Slaves {
+		if slave.Shard == s.Masters[0].Shard {
+			t.Slave = slave.Addr
+			break
+		}
+	}
+	return nil
+}
+
+// setupTLS configures TLS to the external proxy.
+func (t *Target) setupTLS() error {
+	if !t.TLS {
+		return nil
+	}
+
+	config := &tls.Config{ServerName: t.TLSServerName}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(t.Proxy)
+		if err != nil {
+			return err
+		}
+		config.ServerName = host
+	}
+	if t.TLSCA != "" {
+		pool, err := certs.LoadCA(t.TLSCA)
+		if err != nil {
+			return err
+		}
+		config.RootCAs = pool
+	}
+	t.ProxyTLS = config
+	return nil
+}
+
+// Stop stops the launched topology.
+func (t *Target) Stop() error {
+	if t.Cluster == nil {
+		return nil
+	}
+	return t.Cluster.Stop()
+}
+
+// RequireCluster fails what acts on the processes of the topology.
+func (t *Target) RequireCluster() error {
+	if t.Cluster == nil {
+		return errors.New("requires a topology")
+	}
+	return nil
+}
+
+// Dialer returns the go-redis Dialer for the proxy or backend at addr, nil
+// for the default plaintext dialer.
+func (t *Target) Dialer(addr string) func() (net.Conn, error) {
+	if addr == t.PlainProxy && addr != "" {
+		return nil
+	}
+	config := t.BackendTLS
+	if addr == t.Proxy {
+		config = t.ProxyTLS
+	}
+	if config == nil {
+		return nil
+	}
+	return func() (net.Conn, error) {
+		return DialTLS(addr, config)
+	}
+}
+
+// PasswordFor returns the password of the proxy or backend at addr. The
+// plaintext address of a TLS proxy is the proxy too.
+func (t *Target) PasswordFor(addr string) string {
+	if addr == t.Proxy || (addr == t.PlainProxy && addr != "") {
+		return t.Password
+	}
+	return t.BackendPassword
+}
+
+// Client returns a client of the proxy or backend at addr with poolSize
+// connections.
+func (t *Target) Client(addr string, poolSize int) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:         addr,
+		Password:     t.PasswordFor(addr),
+		Dialer:       t.Dialer(addr),
+		DialTimeout:  time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		PoolSize:     poolSize,
+	})
+}
+
+// DialTLS dials addr and completes the TLS handshake within a second.
+func DialTLS(addr string, config *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: time.Second}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
@@ -0,0 +1,46 @@
+package target
+
+import "testing"
+
+func TestPasswordFor(t *testing.T) {
+	target := &Target{
+		Proxy:           "127.0.0.1:8443",
+		PlainProxy:      "127.0.0.1:8015",
+		Master:          "127.0.0.1:8001",
+		Password:        "proxy",
+		BackendPassword: "backend",
+	}
+	for addr, want := range map[string]string{
+		target.Proxy:      "proxy",
+		target.PlainProxy: "proxy",
+		target.Master:     "backend",
+	} {
+		if got := target.PasswordFor(addr); got != want {
+			t.Errorf("PasswordFor(%s) = %q, want %q", addr, got, want)
+		}
+	}
+
+	target.PlainProxy = ""
+	if got := target.PasswordFor(""); got != "backend" {
+		t.Errorf("PasswordFor of an empty address = %q, want the backend password", got)
+	}
+}
+
+func TestStartExternalTLS(t *testing.T) {
+	target := &Target{Proxy: "proxy.example:8015", Master: "127.0.0.1:8001", TLS: true}
+	if err := target.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if target.ProxyTLS == nil || target.ProxyTLS.ServerName != "proxy.example" {
+		t.Fatalf("got proxy TLS config %+v, want the host of the proxy as server name", target.ProxyTLS)
+	}
+	if target.Dialer(target.Proxy) == nil {
+		t.Error("got a plaintext dialer for the TLS proxy")
+	}
+	if target.Dialer(target.Master) != nil {
+		t.Error("got a TLS dialer for a plaintext backend")
+	}
+	if err := target.RequireCluster(); err == nil {
+		t.Error("RequireCluster succeeded without a topology")
+	}
+}
@@ -0,0 +1,446 @@
+// Package verify is a functional check of the proxy: a short command of
+// every group with its expected reply. The ngproxy-test verify command runs
+// the checks without the ginkgo suite, the suite runs them as specs.
+package verify
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Check is one functional check. key returns a key of the check's own
+// keyspace, every key it returns is deleted after the check.
+type Check struct {
+	Group string
+	Name  string
+	Run   func(client *redis.Client, key func(string) string) error
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	Group   string        `json:"group"`
+	Name    string        `json:"name"`
+	Passed  bool          `json:"passed"`
+	Error   string        `json:"error,omitempty"`
+	Elapsed time.Duration `json:"elapsed_ns"`
+}
+
+// Checks are run in order by Run, and registered as specs of the matching
+// Commands groups by the ginkgo suite.
+var Checks = []Check{
+	{"server", "Ping", func(c *redis.Client, key func(string) string) error {
+		return expect(c.Ping().Result())("PONG")
+	}},
+	{"server", "Echo", func(c *redis.Client, key func(string) string) error {
+		return expect(c.Echo("hello").Result())("hello")
+	}},
+
+	{"keys", "Del", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.Set(key("key1"), "Hello", 0).Result())("OK"); err != nil {
+			return err
+		}
+		if err := expect(c.Set(key("key2"), "World", 0).Result())("OK"); err != nil {
+			return err
+		}
+		return expect(c.Del(key("key1"), key("key2")).Result())(int64(2))
+	}},
+	{"keys", "Exists", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.Set(key("key1"), "Hello", 0).Result())("OK"); err != nil {
+			return err
+		}
+		if err := expect(c.Exists(key("key1")).Result())(int64(1)); err != nil {
+			return err
+		}
+		if err := expect(c.Exists(key("key2")).Result())(int64(0)); err != nil {
+			return err
+		}
+		if err := expect(c.Exists(key("key1"), key("key2")).Result())(int64(1)); err != nil {
+			return err
+		}
+		return expect(c.Exists(key("key1"), key("key1")).Result())(int64(2))
+	}},
+	{"keys", "Expire", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.Set(key("key"), "Hello", 0).Result())("OK"); err != nil {
+			return err
+		}
+		if err := expect(c.Expire(key("key"), 10*time.Second).Result())(true); err != nil {
+			return err
+		}
+		if err := expect(c.TTL(key("key")).Result())(10 * time.Second); err != nil {
+			return err
+		}
+		if err := expect(c.Set(key("key"), "Hello World", 0).Result())("OK"); err != nil {
+			return err
+		}
+		ttl, err := c.TTL(key("key")).Result()
+		if err != nil {
+			return err
+		}
+		if ttl >= 0 {
+			return fmt.Errorf("got TTL %s after SET, want none", ttl)
+		}
+		return nil
+	}},
+	{"keys", "TTL", func(c *redis.Client, key func(string) string) error {
+		ttl, err := c.TTL(key("key")).Result()
+		if err != nil {
+			return err
+		}
+		if ttl >= 0 {
+			return fmt.Errorf("got TTL %s of a missing key, want none", ttl)
+		}
+		if err := expect(c.Set(key("key"), "hello", 0).Result())("OK"); err != nil {
+			return err
+		}
+		if err := expect(c.Expire(key("key"), 60*time.Second).Result())(true); err != nil {
+			return err
+		}
+		return expect(c.TTL(key("key")).Result())(60 * time.Second)
+	}},
+	{"keys", "Type", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.Set(key("key"), "hello", 0).Result())("OK"); err != nil {
+			return err
+		}
+		return expect(c.Type(key("key")).Result())("string")
+	}},
+
+	{"strings", "Append", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.Exists(key("key")).Result())(int64(0)); err != nil {
+			return err
+		}
+		if err := expect(c.Append(key("key"), "Hello").Result())(int64(5)); err != nil {
+			return err
+		}
+		if err := expect(c.Append(key("key"), " World").Result())(int64(11)); err != nil {
+			return err
+		}
+		return expect(c.Get(key("key")).Result())("Hello World")
+	}},
+	{"strings", "Get", func(c *redis.Client, key func(string) string) error {
+		if err := c.Get(key("_")).Err(); err != redis.Nil {
+			return fmt.Errorf("got %v of a missing key, want nil", err)
+		}
+		if err := expect(c.Set(key("key"), "hello", 0).Result())("OK"); err != nil {
+			return err
+		}
+		return expect(c.Get(key("key")).Result())("hello")
+	}},
+	{"strings", "GetRange", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.Set(key("key"), "This is a string", 0).Result())("OK"); err != nil {
+			return err
+		}
+		if err := expect(c.GetRange(key("key"), 0, 3).Result())("This"); err != nil {
+			return err
+		}
+		if err := expect(c.GetRange(key("key"), -3, -1).Result())("ing"); err != nil {
+			return err
+		}
+		if err := expect(c.GetRange(key("key"), 0, -1).Result())("This is a string"); err != nil {
+			return err
+		}
+		return expect(c.GetRange(key("key"), 10, 100).Result())("string")
+	}},
+	{"strings", "Incr", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.Set(key("key"), "10", 0).Result())("OK"); err != nil {
+			return err
+		}
+		if err := expect(c.Incr(key("key")).Result())(int64(11)); err != nil {
+			return err
+		}
+		return expect(c.Get(key("key")).Result())("11")
+	}},
+	{"strings", "IncrBy", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.Set(key("key"), "10", 0).Result())("OK"); err != nil {
+			return err
+		}
+		return expect(c.IncrBy(key("key"), 5).Result())(int64(15))
+	}},
+	{"strings", "MSetMGet", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.MSet(key("key1"), "hello1", key("key2"), "hello2").Result())("OK"); err != nil {
+			return err
+		}
+		return expect(c.MGet(key("key1"), key("key2"), key("_")).Result())(
+			[]interface{}{"hello1", "hello2", nil})
+	}},
+	{"strings", "SetGet", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.Set(key("key"), "hello", 0).Result())("OK"); err != nil {
+			return err
+		}
+		return expect(c.Get(key("key")).Result())("hello")
+	}},
+
+	{"hashes", "HGet", func(c *redis.Client, key func(string) string) error {
+		if err := c.HSet(key("hash"), "key", "hello").Err(); err != nil {
+			return err
+		}
+		if err := expect(c.HGet(key("hash"), "key").Result())("hello"); err != nil {
+			return err
+		}
+		if err := c.HGet(key("hash"), "key1").Err(); err != redis.Nil {
+			return fmt.Errorf("got %v of a missing field, want nil", err)
+		}
+		return nil
+	}},
+	{"hashes", "HGetAll", func(c *redis.Client, key func(string) string) error {
+		if err := c.HSet(key("hash"), "key1", "hello1").Err(); err != nil {
+			return err
+		}
+		if err := c.HSet(key("hash"), "key2", "hello2").Err(); err != nil {
+			return err
+		}
+		return expect(c.HGetAll(key("hash")).Result())(
+			map[string]string{"key1": "hello1", "key2": "hello2"})
+	}},
+	{"hashes", "HIncrBy", func(c *redis.Client, key func(string) string) error {
+		if err := c.HSet(key("hash"), "key", "5").Err(); err != nil {
+			return err
+		}
+		if err := expect(c.HIncrBy(key("hash"), "key", 1).Result())(int64(6)); err != nil {
+			return err
+		}
+		if err := expect(c.HIncrBy(key("hash"), "key", -1).Result())(int64(5)); err != nil {
+			return err
+		}
+		return expect(c.HIncrBy(key("hash"), "key", -10).Result())(int64(-5))
+	}},
+	{"hashes", "HSet", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.HSet(key("hash"), "key", "hello").Result())(true); err != nil {
+			return err
+		}
+		return expect(c.HGet(key("hash"), "key").Result())("hello")
+	}},
+
+	{"lists", "LLen", func(c *redis.Client, key func(string) string) error {
+		if err := c.LPush(key("list"), "World").Err(); err != nil {
+			return err
+		}
+		if err := c.LPush(key("list"), "Hello").Err(); err != nil {
+			return err
+		}
+		return expect(c.LLen(key("list")).Result())(int64(2))
+	}},
+	{"lists", "LPop", func(c *redis.Client, key func(string) string) error {
+		if err := c.RPush(key("list"), "one", "two", "three").Err(); err != nil {
+			return err
+		}
+		if err := expect(c.LPop(key("list")).Result())("one"); err != nil {
+			return err
+		}
+		return expect(c.LRange(key("list"), 0, -1).Result())([]string{"two", "three"})
+	}},
+	{"lists", "LPush", func(c *redis.Client, key func(string) string) error {
+		if err := c.LPush(key("list"), "World").Err(); err != nil {
+			return err
+		}
+		if err := c.LPush(key("list"), "Hello").Err(); err != nil {
+			return err
+		}
+		return expect(c.LRange(key("list"), 0, -1).Result())([]string{"Hello", "World"})
+	}},
+	{"lists", "LRange", func(c *redis.Client, key func(string) string) error {
+		if err := c.RPush(key("list"), "one", "two", "three").Err(); err != nil {
+			return err
+		}
+		if err := expect(c.LRange(key("list"), 0, 0).Result())([]string{"one"}); err != nil {
+			return err
+		}
+		all := []string{"one", "two", "three"}
+		if err := expect(c.LRange(key("list"), -3, 2).Result())(all); err != nil {
+			return err
+		}
+		if err := expect(c.LRange(key("list"), -100, 100).Result())(all); err != nil {
+			return err
+		}
+		return expect(c.LRange(key("list"), 5, 10).Result())([]string{})
+	}},
+	{"lists", "RPush", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.RPush(key("list"), "Hello").Result())(int64(1)); err != nil {
+			return err
+		}
+		if err := expect(c.RPush(key("list"), "World").Result())(int64(2)); err != nil {
+			return err
+		}
+		return expect(c.LRange(key("list"), 0, -1).Result())([]string{"Hello", "World"})
+	}},
+
+	{"sets", "SAdd", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.SAdd(key("set"), "Hello").Result())(int64(1)); err != nil {
+			return err
+		}
+		if err := expect(c.SAdd(key("set"), "World").Result())(int64(1)); err != nil {
+			return err
+		}
+		if err := expect(c.SAdd(key("set"), "World").Result())(int64(0)); err != nil {
+			return err
+		}
+		members, err := c.SMembers(key("set")).Result()
+		if err != nil {
+			return err
+		}
+		sort.Strings(members)
+		return expect(members, nil)([]string{"Hello", "World"})
+	}},
+	{"sets", "SCard", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.SAdd(key("set"), "Hello").Result())(int64(1)); err != nil {
+			return err
+		}
+		if err := expect(c.SAdd(key("set"), "World").Result())(int64(1)); err != nil {
+			return err
+		}
+		return expect(c.SCard(key("set")).Result())(int64(2))
+	}},
+	{"sets", "IsMember", func(c *redis.Client, key func(string) string) error {
+		if err := c.SAdd(key("set"), "one").Err(); err != nil {
+			return err
+		}
+		if err := expect(c.SIsMember(key("set"), "one").Result())(true); err != nil {
+			return err
+		}
+		return expect(c.SIsMember(key("set"), "two").Result())(false)
+	}},
+
+	{"sorted sets", "ZAdd", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.ZAdd(key("zset"), redis.Z{Score: 1, Member: "one"}).Result())(int64(1)); err != nil {
+			return err
+		}
+		if err := expect(c.ZAdd(key("zset"), redis.Z{Score: 1, Member: "uno"}).Result())(int64(1)); err != nil {
+			return err
+		}
+		if err := expect(c.ZAdd(key("zset"), redis.Z{Score: 2, Member: "two"}).Result())(int64(1)); err != nil {
+			return err
+		}
+		if err := expect(c.ZAdd(key("zset"), redis.Z{Score: 3, Member: "two"}).Result())(int64(0)); err != nil {
+			return err
+		}
+		return expect(c.ZRangeWithScores(key("zset"), 0, -1).Result())(
+			[]redis.Z{{Score: 1, Member: "one"}, {Score: 1, Member: "uno"}, {Score: 3, Member: "two"}})
+	}},
+	{"sorted sets", "ZIncrBy", func(c *redis.Client, key func(string) string) error {
+		if err := c.ZAdd(key("zset"), redis.Z{Score: 1, Member: "one"}, redis.Z{Score: 2, Member: "two"}).Err(); err != nil {
+			return err
+		}
+		if err := expect(c.ZIncrBy(key("zset"), 2, "one").Result())(float64(3)); err != nil {
+			return err
+		}
+		return expect(c.ZRangeWithScores(key("zset"), 0, -1).Result())(
+			[]redis.Z{{Score: 2, Member: "two"}, {Score: 3, Member: "one"}})
+	}},
+	{"sorted sets", "ZRange", func(c *redis.Client, key func(string) string) error {
+		err := c.ZAdd(key("zset"), redis.Z{Score: 1, Member: "one"}, redis.Z{Score: 2, Member: "two"}, redis.Z{Score: 3, Member: "three"}).Err()
+		if err != nil {
+			return err
+		}
+		if err := expect(c.ZRange(key("zset"), 0, -1).Result())([]string{"one", "two", "three"}); err != nil {
+			return err
+		}
+		if err := expect(c.ZRange(key("zset"), 2, 3).Result())([]string{"three"}); err != nil {
+			return err
+		}
+		return expect(c.ZRange(key("zset"), -2, -1).Result())([]string{"two", "three"})
+	}},
+	{"sorted sets", "ZScore", func(c *redis.Client, key func(string) string) error {
+		if err := c.ZAdd(key("zset"), redis.Z{Score: 1.001, Member: "one"}).Err(); err != nil {
+			return err
+		}
+		return expect(c.ZScore(key("zset"), "one").Result())(float64(1.001))
+	}},
+
+	{"hyperloglog", "PFAdd and PFCount", func(c *redis.Client, key func(string) string) error {
+		if err := expect(c.PFAdd(key("hll"), "a", "b", "c", "d", "e", "f", "g").Result())(int64(1)); err != nil {
+			return err
+		}
+		if err := expect(c.PFAdd(key("hll"), "a", "b").Result())(int64(0)); err != nil {
+			return err
+		}
+		return expect(c.PFCount(key("hll")).Result())(int64(7))
+	}},
+
+	{"pipeline", "SET and GET in a pipeline", func(c *redis.Client, key func(string) string) error {
+		var get *redis.StringCmd
+		_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key("a"), "1", 0)
+			pipe.Set(key("b"), "2", 0)
+			get = pipe.Get(key("a"))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return expect(get.Result())("1")
+	}},
+
+	{"scripting", "EVAL with a key", func(c *redis.Client, key func(string) string) error {
+		script := `redis.call("SET", KEYS[1], ARGV[1]); return redis.call("GET", KEYS[1])`
+		return expect(c.Eval(script, []string{key("a")}, "hello").Result())("hello")
+	}},
+}
+
+// expect returns a check of the reply of a command against want.
+func expect(got interface{}, err error) func(want interface{}) error {
+	return func(want interface{}) error {
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("got %#v, want %#v", got, want)
+		}
+		return nil
+	}
+}
+
+// Run runs the checks whose "group name" matches focus, every check when
+// focus is nil. Keys are prefixed by prefix.
+func Run(client *redis.Client, prefix string, focus *regexp.Regexp) []Result {
+	var results []Result
+	for i, check := range Checks {
+		if focus != nil && !focus.MatchString(check.Group+" "+check.Name) {
+			continue
+		}
+
+		var mu sync.Mutex
+		keys := make(map[string]bool)
+		key := func(name string) string {
+			name = fmt.Sprintf("%sverify:%d:%s", prefix, i, name)
+			mu.Lock()
+			keys[name] = true
+			mu.Unlock()
+			return name
+		}
+
+		start := time.Now()
+		err := check.Run(client, key)
+		r := Result{
+			Group:   check.Group,
+			Name:    check.Name,
+			Passed:  err == nil,
+			Elapsed: time.Since(start),
+		}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		results = append(results, r)
+
+		// One at a time, a multi-key DEL may be refused across shards.
+		for name := range keys {
+			client.Del(name)
+		}
+	}
+	return results
+}
+
+// Failed returns how many results did not pass.
+func Failed(results []Result) int {
+	n := 0
+	for _, r := range results {
+		if !r.Passed {
+			n++
+		}
+	}
+	return n
+}
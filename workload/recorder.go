@@ -0,0 +1,154 @@
+package workload
+
+import (
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Result is the measurement of a run, or of one phase of a chaos scenario.
+// Latencies are in nanoseconds and accurate to about 5%.
+type Result struct {
+	Profile string `json:"profile,omitempty"`
+	Clients int    `json:"clients,omitempty"`
+	Payload int    `json:"payload,omitempty"`
+
+	Elapsed time.Duration `json:"elapsed_ns"`
+	Ops     int64         `json:"ops"`
+	Errors  int64         `json:"errors"`
+	// Timeouts and ReplyErrors are the errors that were client timeouts
+	// and error replies, e.g. the proxy's own backend timeout. The rest
+	// are other network errors.
+	Timeouts    int64         `json:"timeouts"`
+	ReplyErrors int64         `json:"reply_errors"`
+	OpsPerSec   float64       `json:"ops_per_sec"`
+	P50         time.Duration `json:"p50_ns"`
+	P99         time.Duration `json:"p99_ns"`
+	Max         time.Duration `json:"max_ns"`
+	FirstError  string        `json:"first_error,omitempty"`
+}
+
+// bucketGrowth is the ratio between the bounds of consecutive latency
+// buckets.
+const bucketGrowth = 1.05
+
+// Recorder counts operations into a latency histogram, so that runs of
+// any length take constant memory. It is safe for concurrent use.
+type Recorder struct {
+	mu       sync.Mutex
+	start    time.Time
+	buckets  []int64
+	ops      int64
+	errors   int64
+	timeouts int64
+	replies  int64
+	max      time.Duration
+	firstErr error
+}
+
+// NewRecorder returns a recorder whose elapsed time starts now.
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// Add records one operation.
+func (r *Recorder) Add(latency time.Duration, err error) {
+	i := bucket(latency)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.buckets) <= i {
+		r.buckets = append(r.buckets, 0)
+	}
+	r.buckets[i]++
+	r.ops++
+	if latency > r.max {
+		r.max = latency
+	}
+	if err != nil {
+		r.errors++
+		switch {
+		case isTimeout(err):
+			r.timeouts++
+		case isReply(err):
+			r.replies++
+		}
+		if r.firstErr == nil {
+			r.firstErr = err
+		}
+	}
+}
+
+// Result returns the measurements so far.
+func (r *Recorder) Result() Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := Result{
+		Elapsed:     time.Since(r.start),
+		Ops:         r.ops,
+		Errors:      r.errors,
+		Timeouts:    r.timeouts,
+		ReplyErrors: r.replies,
+		P50:         r.percentile(0.50),
+		P99:         r.percentile(0.99),
+		Max:         r.max,
+	}
+	if res.Elapsed > 0 {
+		res.OpsPerSec = float64(r.ops) / res.Elapsed.Seconds()
+	}
+	if r.firstErr != nil {
+		res.FirstError = r.firstErr.Error()
+	}
+	return res
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// isReply reports whether err is an error reply rather than a failure of
+// the connection.
+func isReply(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return false
+	}
+	return err != io.EOF && err != io.ErrUnexpectedEOF
+}
+
+// percentile returns the upper bound of the bucket holding the p-th
+// operation, capped by the slowest one.
+func (r *Recorder) percentile(p float64) time.Duration {
+	if r.ops == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p * float64(r.ops)))
+	var seen int64
+	for i, n := range r.buckets {
+		seen += n
+		if seen >= rank {
+			if d := upperBound(i); d < r.max {
+				return d
+			}
+			return r.max
+		}
+	}
+	return r.max
+}
+
+// bucket returns the histogram bucket of latency. Bucket bounds start at
+// 1µs and grow by bucketGrowth.
+func bucket(latency time.Duration) int {
+	us := float64(latency) / float64(time.Microsecond)
+	if us < 1 {
+		return 0
+	}
+	return int(math.Log(us) / math.Log(bucketGrowth))
+}
+
+func upperBound(i int) time.Duration {
+	return time.Duration(math.Pow(bucketGrowth, float64(i+1)) * float64(time.Microsecond))
+}
@@ -0,0 +1,78 @@
+package workload
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder()
+	for i := 1; i <= 100; i++ {
+		r.Add(time.Duration(i)*time.Millisecond, nil)
+	}
+	r.Add(time.Second, errors.New("boom"))
+
+	res := r.Result()
+	if res.Ops != 101 || res.Errors != 1 || res.FirstError != "boom" {
+		t.Fatalf("got %+v", res)
+	}
+	if res.Max != time.Second {
+		t.Fatalf("got max %s", res.Max)
+	}
+	for _, c := range []struct {
+		got, want time.Duration
+	}{{res.P50, 51 * time.Millisecond}, {res.P99, 100 * time.Millisecond}} {
+		if c.got < c.want || float64(c.got) > float64(c.want)*bucketGrowth*bucketGrowth {
+			t.Errorf("got %s, want about %s", c.got, c.want)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRecorderErrorClasses(t *testing.T) {
+	r := NewRecorder()
+	r.Add(time.Millisecond, timeoutError{})
+	r.Add(time.Millisecond, errors.New("ERR backend timeout"))
+	r.Add(time.Millisecond, io.EOF)
+	r.Add(time.Millisecond, nil)
+
+	res := r.Result()
+	if res.Errors != 3 || res.Timeouts != 1 || res.ReplyErrors != 1 {
+		t.Fatalf("got %+v", res)
+	}
+}
+
+func TestRecorderEmpty(t *testing.T) {
+	res := NewRecorder().Result()
+	if res.Ops != 0 || res.P50 != 0 || res.P99 != 0 {
+		t.Fatalf("got %+v", res)
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	start := time.Now().Add(-2500 * time.Millisecond)
+	tl := NewTimeline(start, time.Second)
+	tl.Add(time.Millisecond, nil)
+	tl.Add(3*time.Millisecond, errors.New("boom"))
+
+	points := tl.Points()
+	if len(points) != 3 {
+		t.Fatalf("got %d points", len(points))
+	}
+	if points[0].Ops != 0 || points[1].Ops != 0 {
+		t.Fatalf("got %+v", points)
+	}
+	if p := points[2]; p.Ops != 2 || p.Errors != 1 || p.Max != 3*time.Millisecond {
+		t.Fatalf("got %+v", p)
+	}
+	if !points[1].Time.Equal(start.Add(time.Second)) {
+		t.Fatalf("got time %s", points[1].Time)
+	}
+}
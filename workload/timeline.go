@@ -0,0 +1,81 @@
+package workload
+
+import (
+	"sync"
+	"time"
+)
+
+// Point is the workload of one interval of a Timeline.
+type Point struct {
+	Time   time.Time     `json:"time"`
+	Ops    int64         `json:"ops"`
+	Errors int64         `json:"errors"`
+	P50    time.Duration `json:"p50_ns"`
+	P99    time.Duration `json:"p99_ns"`
+	Max    time.Duration `json:"max_ns"`
+}
+
+// Timeline records operations into fixed intervals by completion time,
+// for latency and error charts. It is safe for concurrent use.
+type Timeline struct {
+	start    time.Time
+	interval time.Duration
+
+	mu    sync.Mutex
+	slots []*Recorder
+}
+
+// NewTimeline returns a timeline of intervals starting at start. Timelines
+// sharing a start can be drawn on the same axis.
+func NewTimeline(start time.Time, interval time.Duration) *Timeline {
+	return &Timeline{start: start, interval: interval}
+}
+
+// Start returns the start of the first interval.
+func (t *Timeline) Start() time.Time {
+	return t.start
+}
+
+// Add records one operation completed now.
+func (t *Timeline) Add(latency time.Duration, err error) {
+	i := int(time.Since(t.start) / t.interval)
+	if i < 0 {
+		i = 0
+	}
+
+	t.mu.Lock()
+	for len(t.slots) <= i {
+		t.slots = append(t.slots, nil)
+	}
+	rec := t.slots[i]
+	if rec == nil {
+		rec = &Recorder{}
+		t.slots[i] = rec
+	}
+	t.mu.Unlock()
+
+	rec.Add(latency, err)
+}
+
+// Points returns one point per interval up to the last operation. Intervals
+// without operations have zero points.
+func (t *Timeline) Points() []Point {
+	t.mu.Lock()
+	slots := append([]*Recorder(nil), t.slots...)
+	t.mu.Unlock()
+
+	points := make([]Point, len(slots))
+	for i, rec := range slots {
+		points[i].Time = t.start.Add(time.Duration(i) * t.interval)
+		if rec == nil {
+			continue
+		}
+		r := rec.Result()
+		points[i].Ops = r.Ops
+		points[i].Errors = r.Errors
+		points[i].P50 = r.P50
+		points[i].P99 = r.P99
+		points[i].Max = r.Max
+	}
+	return points
+}
@@ -0,0 +1,214 @@
+// Package workload drives named load profiles, the operations of the
+// benchmarks, against the proxy for a fixed time and measures throughput
+// and latency.
+package workload
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Op is one operation of a profile on key with value as payload.
+type Op func(client *redis.Client, key string, value []byte) error
+
+// Profile is a named operation.
+type Profile struct {
+	Name        string
+	Description string
+	Op          Op
+}
+
+// Profiles are the built-in profiles by name.
+var Profiles = map[string]Profile{
+	"ping": {"ping", "PING", func(client *redis.Client, key string, value []byte) error {
+		return client.Ping().Err()
+	}},
+	"get": {"get", "GET of an existing key", func(client *redis.Client, key string, value []byte) error {
+		return client.Get(key).Err()
+	}},
+	"set": {"set", "SET of the payload", func(client *redis.Client, key string, value []byte) error {
+		return client.Set(key, value, 0).Err()
+	}},
+	"setget": {"setget", "SET then GET, checking the value", func(client *redis.Client, key string, value []byte) error {
+		if err := client.Set(key, value, 0).Err(); err != nil {
+			return err
+		}
+		got, err := client.Get(key).Bytes()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, value) {
+			return fmt.Errorf("GET %s returned %d bytes, want %d", key, len(got), len(value))
+		}
+		return nil
+	}},
+	"mget": {"mget", "MGET of two keys", func(client *redis.Client, key string, value []byte) error {
+		return client.MGet(key+":1", key+":2").Err()
+	}},
+	"setexpire": {"setexpire", "SET then EXPIRE", func(client *redis.Client, key string, value []byte) error {
+		if err := client.Set(key, value, 0).Err(); err != nil {
+			return err
+		}
+		return client.Expire(key, time.Minute).Err()
+	}},
+	"pipeline": {"pipeline", "pipelined SET and EXPIRE", func(client *redis.Client, key string, value []byte) error {
+		_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, value, 0)
+			pipe.Expire(key, time.Minute)
+			return nil
+		})
+		return err
+	}},
+	"zadd": {"zadd", "ZADD of one member", func(client *redis.Client, key string, value []byte) error {
+		// Prepare writes key as a string.
+		return client.ZAdd(key+":zset", redis.Z{Score: 1, Member: "hello"}).Err()
+	}},
+}
+
+// Names returns the names of the built-in profiles, sorted.
+func Names() []string {
+	names := make([]string, 0, len(Profiles))
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Options shape a run of a profile.
+type Options struct {
+	// Clients is the number of goroutines issuing operations.
+	Clients int
+	// Payload is the size of the value in bytes.
+	Payload int
+	// Keys is the number of distinct keys, spread over the shards.
+	Keys int
+	// KeyPrefix prefixes every key.
+	KeyPrefix string
+	// Key, if set, is the only key of the run instead of Keys keys under
+	// KeyPrefix, e.g. a key of a given shard.
+	Key string
+	// Duration bounds the run, zero runs until stop is closed.
+	Duration time.Duration
+	// Timeline, if set, records every operation too.
+	Timeline *Timeline
+}
+
+func (o *Options) init() {
+	if o.Clients <= 0 {
+		o.Clients = 10
+	}
+	if o.Payload <= 0 {
+		o.Payload = 32
+	}
+	if o.Keys <= 0 {
+		o.Keys = 1
+	}
+}
+
+// key returns the n-th key of the run.
+func (o *Options) key(n int) string {
+	if o.Key != "" {
+		return o.Key
+	}
+	return o.KeyPrefix + "key" + strconv.Itoa(n%o.Keys)
+}
+
+// Prepare writes the keys that the read profiles expect to exist.
+func Prepare(client *redis.Client, opts Options) error {
+	opts.init()
+	value := bytes.Repeat([]byte{'1'}, opts.Payload)
+	for i := 0; i < opts.Keys; i++ {
+		key := opts.key(i)
+		for _, k := range []string{key, key + ":1", key + ":2"} {
+			if err := client.Set(k, value, 0).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Drive runs p with opts.Clients goroutines until opts.Duration passes or
+// stop is closed, and passes the outcome of every operation to record,
+// usually Recorder.Add.
+func Drive(client *redis.Client, p Profile, opts Options, stop <-chan struct{}, record func(time.Duration, error)) {
+	opts.init()
+	value := bytes.Repeat([]byte{'1'}, opts.Payload)
+
+	var deadline <-chan time.Time
+	if opts.Duration > 0 {
+		timer := time.NewTimer(opts.Duration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-deadline:
+		}
+		close(done)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := i; ; n += opts.Clients {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := opts.key(n)
+				start := time.Now()
+				err := p.Op(client, key, value)
+				latency := time.Since(start)
+				record(latency, err)
+				if opts.Timeline != nil {
+					opts.Timeline.Add(latency, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Run runs p for opts.Duration on a client of opts.Clients connections and
+// returns the measurements. A zero Duration would never end, Run then
+// returns at once with no operations.
+func Run(client *redis.Client, p Profile, opts Options) Result {
+	opts.init()
+	rec := NewRecorder()
+	if opts.Duration > 0 {
+		Drive(client, p, opts, nil, rec.Add)
+	}
+
+	r := rec.Result()
+	r.Profile = p.Name
+	r.Clients = opts.Clients
+	r.Payload = opts.Payload
+	return r
+}
+
+// NewClient returns a client with a connection per workload goroutine.
+func NewClient(addr, password string, dialer func() (net.Conn, error), clients int) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:         addr,
+		Password:     password,
+		Dialer:       dialer,
+		DialTimeout:  time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+		PoolSize:     clients,
+	})
+}
@@ -0,0 +1,14 @@
+package workload
+
+import "testing"
+
+func TestRunWithoutDuration(t *testing.T) {
+	client := NewClient("127.0.0.1:1", "", nil, 1)
+	defer client.Close()
+
+	// Without a duration nor a stop channel Drive would never return.
+	res := Run(client, Profiles["ping"], Options{})
+	if res.Ops != 0 {
+		t.Fatalf("got %+v", res)
+	}
+}